@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// parseBotUserIDs splits twitter/bot_user_id, which holds the IDs of all
+// bot accounts separated by commas. The first one is the primary account:
+// it keeps using the credentials and cursors stored before there could be
+// more than one.
+func parseBotUserIDs(s string) []string {
+	r := []string{}
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+func isBotUser(botUserIDs []string, id string) bool {
+	for _, b := range botUserIDs {
+		if b == id {
+			return true
+		}
+	}
+	return false
+}
+
+func credentialsKey(accountID string) *datastore.Key {
+	return datastore.NameKey(credentialsEntity, accountID, nil)
+}
+
+// loadUserCredentials returns the stored credentials of the bot account.
+// The primary account falls back to the entity used before credentials were
+// stored per account.
+func loadUserCredentials(ctx context.Context, ds *datastore.Client, accountID string, primary bool) (*TwitterUserCredentials, error) {
+	r := &TwitterUserCredentials{}
+	err := ds.Get(ctx, credentialsKey(accountID), r)
+	if err == datastore.ErrNoSuchEntity && primary {
+		err = ds.Get(ctx, datastore.NameKey(credentialsEntity, credentialsID, nil), r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// cursorScope returns the prefix of the DM cursor keys of an account. The
+// primary account has none, so it keeps its existing cursors.
+func cursorScope(accountID string, primary bool) string {
+	if primary {
+		return ""
+	}
+	return "account/" + accountID + "/"
+}
+
+// authenticateBot checks that the request uses HTTP basic auth with the
+// OAuth token and token secret of a bot account as username and password.
+// It returns the account and a client acting as it, or writes an error
+// response and returns false.
+func authenticateBot(w http.ResponseWriter, r *http.Request, botUserIDs []string) (*twitter.User, *twitter.Client, bool) {
+	token, secret, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tweet-saver"`)
+		http.Error(w, "missing credentials", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	appCreds, err := clients.appCredentials(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get app credentials: %s", err), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	twClient := twitterClient(&appCreds, &TwitterUserCredentials{Token: token, TokenSecret: secret})
+	user, _, err := twClient.Accounts.VerifyCredentials(&twitter.AccountVerifyParams{SkipStatus: twitter.Bool(true)})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify credentials: %s", err), http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	if !isBotUser(botUserIDs, user.IDStr) {
+		http.Error(w, fmt.Sprintf("Unauthorized user %s", user.IDStr), http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	return user, twClient, true
+}
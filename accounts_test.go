@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlersRequireBotCredentials(t *testing.T) {
+	bots := []string{"1"}
+	for name, h := range map[string]http.Handler{
+		"/backfill":        backfillHandler(bots),
+		"/refresh_metrics": refreshMetricsHandler(bots),
+		"/replay_response": replayHandler(nil, bots),
+		"/replay":          replayEventsHandler(nil, bots),
+		"/export":          exportHandler(bots),
+		"/quote_groups":    quoteGroupsHandler(bots),
+		"/redact":          redactHandler(bots),
+		"/selftest":        selftestHandler(nil, bots),
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, name, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without credentials: status %d, want %d", name, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
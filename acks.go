@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const pendingAckEntity = "PendingAck"
+
+const (
+	// Acknowledgements sent per poll at most, so that a backlog of them
+	// doesn't hold up the next poll.
+	maxAcksPerPoll = 50
+	// Times sending an acknowledgement is tried before it's dropped.
+	maxAckAttempts = 5
+)
+
+// PendingAck is an acknowledgement DM waiting to be sent. It's keyed by the
+// ID of the DM event that submitted the tweet, so queueing it twice is
+// harmless.
+type PendingAck struct {
+	// Bot account that sends it.
+	Account     string
+	RecipientID string `datastore:",noindex"`
+	Text        string `datastore:",noindex"`
+	Queued      time.Time
+	Attempts    int `datastore:",noindex"`
+}
+
+// queueAck queues an acknowledgement for the DM event that submitted a
+// tweet. Acknowledgements are queued rather than sent right away, so that
+// sending them never holds up saving tweets.
+func queueAck(ctx context.Context, ds *datastore.Client, eventID string, ack *PendingAck) error {
+	if ack.Queued.IsZero() {
+		ack.Queued = time.Now()
+	}
+	_, err := ds.Put(ctx, datastore.NameKey(pendingAckEntity, eventID, nil), ack)
+	return err
+}
+
+// sendPendingAcks sends the account's queued acknowledgements, oldest first.
+// It's meant to run after a poll has saved its tweets, so acknowledgements
+// never delay them, and a rate limit leaves the rest of the queue for the
+// next poll. Failures are only logged: acknowledgements must never fail a
+// poll.
+func sendPendingAcks(ctx context.Context, ds *datastore.Client, account string, twClient *twitter.Client) {
+	// Ordering by Queued in the query would need a composite index. Keys
+	// are DM event IDs, so the query already returns roughly the oldest.
+	q := datastore.NewQuery(pendingAckEntity).Filter("Account =", account).Limit(maxAcksPerPoll)
+	acks := []*PendingAck{}
+	keys, err := ds.GetAll(ctx, q, &acks)
+	if err != nil {
+		logWarning(logFields{"account": account}, "Failed to load pending acknowledgements: %s", err)
+		return
+	}
+	sortAcks(keys, acks)
+	done, retry := sendAcks(twClient, acks)
+	del := []*datastore.Key{}
+	for _, i := range done {
+		del = append(del, keys[i])
+	}
+	if len(del) > 0 {
+		if err := ds.DeleteMulti(ctx, del); err != nil {
+			logWarning(logFields{"account": account}, "Failed to remove sent acknowledgements: %s", err)
+		}
+	}
+	for _, i := range retry {
+		if _, err := ds.Put(ctx, keys[i], acks[i]); err != nil {
+			logWarning(logFields{"account": account}, "Failed to update acknowledgement: %s", err)
+		}
+	}
+}
+
+// sortAcks sorts the acknowledgements and their keys by the time they were
+// queued.
+func sortAcks(keys []*datastore.Key, acks []*PendingAck) {
+	sort.Sort(acksByQueued{keys, acks})
+}
+
+type acksByQueued struct {
+	keys []*datastore.Key
+	acks []*PendingAck
+}
+
+func (a acksByQueued) Len() int { return len(a.acks) }
+func (a acksByQueued) Less(i, j int) bool {
+	return a.acks[i].Queued.Before(a.acks[j].Queued)
+}
+func (a acksByQueued) Swap(i, j int) {
+	a.keys[i], a.keys[j] = a.keys[j], a.keys[i]
+	a.acks[i], a.acks[j] = a.acks[j], a.acks[i]
+}
+
+// sendAcks sends the acknowledgements in order, stopping at the first rate
+// limit. It returns the indexes of the ones that are done with, sent or
+// failed too often, and of the ones that failed and should be tried again.
+func sendAcks(twClient *twitter.Client, acks []*PendingAck) (done []int, retry []int) {
+	for i, ack := range acks {
+		_, httpResp, err := twClient.DirectMessages.EventsNew(&twitter.DirectMessageEventsNewParams{
+			Event: &twitter.DirectMessageEvent{
+				Type: "message_create",
+				Message: &twitter.DirectMessageEventMessage{
+					Target: &twitter.DirectMessageTarget{RecipientID: ack.RecipientID},
+					Data:   &twitter.DirectMessageData{Text: ack.Text},
+				},
+			},
+		})
+		if err == nil {
+			done = append(done, i)
+			continue
+		}
+		if isThrottled(err, httpResp) {
+			logInfo(logFields{"sender_id": ack.RecipientID}, "Rate limited sending acknowledgements, %d left for the next poll", len(acks)-i)
+			break
+		}
+		ack.Attempts++
+		if ack.Attempts >= maxAckAttempts {
+			logWarning(logFields{"sender_id": ack.RecipientID}, "Failed to send acknowledgement, giving up: %s", err)
+			done = append(done, i)
+			continue
+		}
+		logWarning(logFields{"sender_id": ack.RecipientID}, "Failed to send acknowledgement: %s", err)
+		retry = append(retry, i)
+	}
+	return done, retry
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// fakeDMSender accepts limit DMs, then answers like Twitter's rate limit.
+type fakeDMSender struct {
+	limit int
+	sent  []string
+}
+
+func (f *fakeDMSender) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path != "/1.1/direct_messages/events/new.json" {
+		return fakeResponse(http.StatusNotFound, nil), nil
+	}
+	if len(f.sent) >= f.limit {
+		return fakeResponse(http.StatusTooManyRequests, map[string]interface{}{
+			"errors": []interface{}{map[string]interface{}{"code": 88, "message": "Rate limit exceeded"}},
+		}), nil
+	}
+	body := struct {
+		Event twitter.DirectMessageEvent `json:"event"`
+	}{}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.sent = append(f.sent, body.Event.Message.Target.RecipientID+": "+body.Event.Message.Data.Text)
+	return fakeResponse(http.StatusOK, map[string]interface{}{"event": body.Event}), nil
+}
+
+func TestSendAcksStopsAtRateLimit(t *testing.T) {
+	tw := &fakeDMSender{limit: 2}
+	acks := []*PendingAck{
+		{RecipientID: "7", Text: "Saved https://twitter.com/i/status/100"},
+		{RecipientID: "8", Text: "Saved https://twitter.com/i/status/200"},
+		{RecipientID: "9", Text: "Saved https://twitter.com/i/status/300"},
+	}
+	done, retry := sendAcks(twitter.NewClient(&http.Client{Transport: tw}), acks)
+	if len(done) != 2 || done[0] != 0 || done[1] != 1 {
+		t.Errorf("done = %v, want [0 1]", done)
+	}
+	if len(retry) != 0 || acks[2].Attempts != 0 {
+		t.Errorf("rate limited ack counted as failed: retry = %v, attempts = %d", retry, acks[2].Attempts)
+	}
+	if want := "7: Saved https://twitter.com/i/status/100"; len(tw.sent) != 2 || tw.sent[0] != want {
+		t.Errorf("sent %q, want 2 DMs starting with %q", tw.sent, want)
+	}
+}
+
+func TestSortAcks(t *testing.T) {
+	now := time.Now()
+	keys := []*datastore.Key{
+		datastore.NameKey(pendingAckEntity, "1", nil),
+		datastore.NameKey(pendingAckEntity, "2", nil),
+		datastore.NameKey(pendingAckEntity, "3", nil),
+	}
+	acks := []*PendingAck{
+		{RecipientID: "7", Queued: now.Add(time.Minute)},
+		{RecipientID: "8", Queued: now.Add(-time.Minute)},
+		{RecipientID: "9", Queued: now},
+	}
+	sortAcks(keys, acks)
+	for i, want := range []string{"2", "3", "1"} {
+		if keys[i].Name != want {
+			t.Errorf("key %d = %s, want %s", i, keys[i].Name, want)
+		}
+	}
+	if acks[0].RecipientID != "8" || acks[2].RecipientID != "7" {
+		t.Errorf("acks not sorted with their keys: %+v", acks)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+const (
+	// maxConcurrentMediaArchives limits how many media items of a tweet are
+	// downloaded and uploaded at the same time.
+	maxConcurrentMediaArchives = 4
+	mediaDownloadTimeout       = 2 * time.Minute
+
+	defaultMediaArchiveMaxBytes = 100 << 20
+)
+
+var defaultMediaArchiveTypes = []string{"image/", "video/"}
+
+// mediaArchiver copies tweet media into a GCS bucket, so it survives the
+// tweet being deleted.
+type mediaArchiver struct {
+	bucket   string
+	storage  *storage.Service
+	client   *http.Client
+	maxBytes int64
+	types    []string
+}
+
+func newMediaArchiver(ctx context.Context, cfg *Config) (*mediaArchiver, error) {
+	s, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &mediaArchiver{
+		bucket:   cfg.MediaArchiveBucket,
+		storage:  s,
+		client:   &http.Client{Timeout: mediaDownloadTimeout},
+		maxBytes: cfg.MediaArchiveMaxBytes,
+		types:    cfg.MediaArchiveTypes,
+	}, nil
+}
+
+// archive uploads all media of the tweet to tweets/<id>/<index> and returns
+// the gs:// URIs of the items that were archived successfully, and why the
+// others weren't.
+func (a *mediaArchiver) archive(ctx context.Context, tweet *twitter.Tweet) (archived []string, failures []string) {
+	urls := mediaURLs(tweet)
+	uris := make([]string, len(urls))
+	errs := make([]error, len(urls))
+	sem := make(chan struct{}, maxConcurrentMediaArchives)
+	wg := sync.WaitGroup{}
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			name := fmt.Sprintf("tweets/%s/%d", tweet.IDStr, i)
+			if err := a.copy(ctx, originalMediaURL(u), name); err != nil {
+				logWarning(logFields{"tweet_id": tweet.IDStr}, "Failed to archive %s: %s", u, err)
+				errs[i] = fmt.Errorf("%s: %w", u, err)
+				return
+			}
+			uris[i] = fmt.Sprintf("gs://%s/%s", a.bucket, name)
+		}(i, u)
+	}
+	wg.Wait()
+
+	for i, uri := range uris {
+		if uri != "" {
+			archived = append(archived, uri)
+		}
+		if errs[i] != nil {
+			failures = append(failures, errs[i].Error())
+		}
+	}
+	return archived, failures
+}
+
+// copy streams the media at url into the bucket. Media that isn't of an
+// allowed type is skipped, and media larger than maxBytes is cut off as soon
+// as that's known, deleting whatever was uploaded of it.
+func (a *mediaArchiver) copy(ctx context.Context, url string, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !mediaTypeAllowed(contentType, a.types) {
+		return fmt.Errorf("media type %q is not archived", contentType)
+	}
+	if resp.ContentLength > a.maxBytes {
+		return fmt.Errorf("media is %d bytes, more than the limit of %d", resp.ContentLength, a.maxBytes)
+	}
+	body := &cappedReader{r: io.LimitReader(resp.Body, a.maxBytes+1), max: a.maxBytes}
+	_, err = a.storage.Objects.Insert(a.bucket, &storage.Object{Name: name}).
+		Media(body, googleapi.ContentType(contentType)).
+		Context(ctx).
+		Do()
+	if body.exceeded() {
+		// The upload was aborted, but a resumable one may have left part of
+		// the object behind.
+		if err := a.storage.Objects.Delete(a.bucket, name).Context(ctx).Do(); err != nil && !isNotFound(err) {
+			logWarning(logFields{"object": name}, "Failed to delete oversized media: %s", err)
+		}
+		return fmt.Errorf("media is more than the limit of %d bytes", a.maxBytes)
+	}
+	if err != nil {
+		return fmt.Errorf("uploading to gs://%s/%s: %w", a.bucket, name, err)
+	}
+	return nil
+}
+
+var errMediaTooLarge = errors.New("media too large")
+
+// cappedReader fails once more than max bytes are read from it.
+type cappedReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.exceeded() {
+		return n, errMediaTooLarge
+	}
+	return n, err
+}
+
+func (c *cappedReader) exceeded() bool {
+	return c.n > c.max
+}
+
+// mediaTypeAllowed reports whether the Content-Type is one of the allowed
+// media types, or a subtype of one ending in "/".
+func mediaTypeAllowed(contentType string, allowed []string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if t == a || (strings.HasSuffix(a, "/") && strings.HasPrefix(t, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// originalMediaURL returns the URL of the full-size version of a photo.
+// Other URLs are returned unchanged.
+func originalMediaURL(u string) string {
+	if strings.HasPrefix(u, "https://pbs.twimg.com/media/") && !strings.Contains(u, "?") {
+		return u + "?name=orig"
+	}
+	return u
+}
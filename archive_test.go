@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+// fakeGCS serves media under /media/ and stores uploads to any bucket.
+type fakeGCS struct {
+	mu      sync.Mutex
+	uploads []string
+	deletes []string
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/media/"):
+		kind := strings.TrimPrefix(r.URL.Path, "/media/")
+		switch kind {
+		case "photo":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("small photo"))
+		case "page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html></html>"))
+		case "video":
+			// Flushing first leaves out Content-Length, so the size is
+			// only known while streaming.
+			w.Header().Set("Content-Type", "video/mp4")
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("v", 1000)))
+		}
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		b, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.uploads = append(f.uploads, string(b))
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		f.deletes = append(f.deletes, r.URL.Path)
+		f.mu.Unlock()
+		http.Error(w, `{"error":{"code":404,"message":"Not Found"}}`, http.StatusNotFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestMediaArchiverLimits(t *testing.T) {
+	gcs := &fakeGCS{}
+	server := httptest.NewServer(gcs)
+	defer server.Close()
+	ctx := context.Background()
+	svc, err := storage.NewService(ctx, option.WithEndpoint(server.URL+"/storage/v1/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatalf("storage.NewService: %s", err)
+	}
+	a := &mediaArchiver{
+		bucket:   "bucket",
+		storage:  svc,
+		client:   server.Client(),
+		maxBytes: 100,
+		types:    defaultMediaArchiveTypes,
+	}
+
+	if err := a.copy(ctx, server.URL+"/media/photo", "photo"); err != nil {
+		t.Errorf("copying a photo: %s", err)
+	}
+
+	if err := a.copy(ctx, server.URL+"/media/page", "page"); err == nil || !strings.Contains(err.Error(), "text/html") {
+		t.Errorf("copying an HTML page = %v, want the type to be rejected", err)
+	}
+	if err := a.copy(ctx, server.URL+"/media/video", "video"); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("copying an oversized video = %v, want the size to be rejected", err)
+	}
+	uploaded := strings.Join(gcs.uploads, "")
+	if !strings.Contains(uploaded, "small photo") || strings.Contains(uploaded, "<html>") || strings.Contains(uploaded, "vvvvvvvvvv") {
+		t.Errorf("uploaded %q, want only the photo", gcs.uploads)
+	}
+	if len(gcs.deletes) != 1 || !strings.HasSuffix(gcs.deletes[0], "/video") {
+		t.Errorf("deleted %v, want the oversized video deleted", gcs.deletes)
+	}
+}
+
+func TestMediaArchiverRecordsFailures(t *testing.T) {
+	gcs := &fakeGCS{}
+	server := httptest.NewServer(gcs)
+	defer server.Close()
+	ctx := context.Background()
+	svc, err := storage.NewService(ctx, option.WithEndpoint(server.URL+"/storage/v1/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatalf("storage.NewService: %s", err)
+	}
+	a := &mediaArchiver{bucket: "bucket", storage: svc, client: server.Client(), maxBytes: 100, types: defaultMediaArchiveTypes}
+	tweet := testTweet("100", "50", "media")
+	tweet.ExtendedEntities = &twitter.ExtendedEntity{Media: []twitter.MediaEntity{
+		{Type: "photo", MediaURLHttps: server.URL + "/media/photo"},
+		{Type: "photo", MediaURLHttps: server.URL + "/media/page"},
+	}}
+	archived, failures := a.archive(ctx, tweet)
+	if len(archived) != 1 || archived[0] != "gs://bucket/tweets/100/0" {
+		t.Errorf("archived %q, want the photo", archived)
+	}
+	if len(failures) != 1 || !strings.Contains(failures[0], "/media/page") {
+		t.Errorf("failures %q, want the page", failures)
+	}
+}
+
+func TestMediaTypeAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		allowed     []string
+		want        bool
+	}{
+		{"image/png", defaultMediaArchiveTypes, true},
+		{"video/mp4; codecs=avc1", defaultMediaArchiveTypes, true},
+		{"application/octet-stream", defaultMediaArchiveTypes, false},
+		{"", defaultMediaArchiveTypes, false},
+		{"video/mp4", []string{"image/gif"}, false},
+		{"image/gif", []string{"image/gif"}, true},
+	} {
+		if got := mediaTypeAllowed(tc.contentType, tc.allowed); got != tc.want {
+			t.Errorf("mediaTypeAllowed(%q, %q) = %v, want %v", tc.contentType, tc.allowed, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// Prefix of the IDs given to groups started by media attached to a DM rather
+// than a linked tweet. They take the place of the tweet ID in the row, which
+// is how later polls find the row again to add notes or skip it.
+const dmAttachmentIDPrefix = "dm-"
+
+func dmAttachmentID(e twitter.DirectMessageEvent) string {
+	return dmAttachmentIDPrefix + e.ID
+}
+
+func isDMAttachmentID(id string) bool {
+	return strings.HasPrefix(id, dmAttachmentIDPrefix)
+}
+
+// dmMediaURL returns the URL of a photo, video or GIF uploaded into the DM
+// itself, or an empty string if there's none. Tweets shared as a card
+// attachment don't count, they are saved as tweets.
+func dmMediaURL(msg *twitter.DirectMessageEventMessage) string {
+	a := msg.Data.Attachment
+	if a == nil || a.Type != "media" || attachmentTweetID(msg) != "" {
+		return ""
+	}
+	return mediaEntityURL(a.Media)
+}
+
+// applyDMAttachment fills in the fields of a row for media attached to the
+// DMs of a group. There's no tweet, so only the ID standing in for it is
+// stored.
+func applyDMAttachment(data map[string]interface{}, id string, events []twitter.DirectMessageEvent) {
+	media := []string{}
+	for _, e := range events {
+		if u := dmMediaURL(e.Message); u != "" {
+			media = append(media, u)
+		}
+	}
+	data["status"] = statusDMAttachment
+	data["tweet"] = map[string]interface{}{"id_str": id}
+	updateFingerprint(data)
+	data["media"] = strings.Join(media, "\n")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const reauthMessage = "Twitter credentials are invalid or revoked — log in again at /"
+
+// Twitter error codes returned when the user token is no longer valid.
+var authErrorCodes = map[int]bool{
+	32: true, // Could not authenticate you.
+	89: true, // Invalid or expired token.
+}
+
+func isAuthError(err error) bool {
+	apiError, ok := err.(twitter.APIError)
+	if !ok {
+		return false
+	}
+	for _, e := range apiError.Errors {
+		if authErrorCodes[e.Code] {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyAccount checks the stored credentials of the bot account with
+// VerifyCredentials, and records in health whether the account needs to log
+// in again. Errors other than invalid credentials are only logged, as they
+// say nothing about the token.
+func verifyAccount(ctx context.Context, ds *datastore.Client, account string, primary bool, health *Health) {
+	userCreds, err := loadUserCredentials(ctx, ds, account, primary)
+	if err == datastore.ErrNoSuchEntity {
+		health.setReauthNeeded(account, "")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load the credentials of %s: %s", account, err)
+		return
+	}
+	appCreds, err := clients.appCredentials(ctx)
+	if err != nil {
+		log.Printf("Failed to get app credentials: %s", err)
+		return
+	}
+	_, twClient := clients.twitterClient(account, appCreds, *userCreds)
+	_, _, err = twClient.Accounts.VerifyCredentials(&twitter.AccountVerifyParams{SkipStatus: twitter.Bool(true)})
+	switch {
+	case err == nil:
+		health.clearReauthNeeded(account)
+	case isAuthError(err):
+		log.Printf("Credentials of %s are no longer valid: %s", account, err)
+		health.setReauthNeeded(account, userCreds.Token)
+	default:
+		log.Printf("Failed to verify the credentials of %s: %s", account, err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+// backfillHandler imports the tweets linked in the request body, one URL
+// per line, into the default spreadsheet. Requests are authenticated like
+// /tweet, and the tweets are fetched with the credentials they carry.
+func backfillHandler(botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_, twClient, ok := authenticateBot(w, r, botUserIDs)
+		if !ok {
+			return
+		}
+		urls := []string{}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if u := strings.TrimSpace(scanner.Text()); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, fmt.Sprintf("reading request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		imported, skipped, failed, err := backfill(r.Context(), twClient, urls)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "imported %d, skipped %d, failed %d\n", imported, skipped, failed)
+	})
+}
+
+// backfill appends a row for each linked tweet that isn't in the default
+// spreadsheet yet. The rows have no notes or sender, as they weren't
+// submitted over DM. URLs that aren't tweet URLs, and tweets that can't be
+// fetched, count as failed.
+func backfill(ctx context.Context, twClient *twitter.Client, urls []string) (imported int, skipped int, failed int, err error) {
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	vars := rcService.Projects.Configs.Variables
+	spreadsheetID, err := vars.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	cfg, err := loadConfig(vars)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("loading config: %w", err)
+	}
+	sheetName, err := loadSheetName(vars)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("loading sheet name: %w", err)
+	}
+
+	store, err := newStore(ctx, cfg, sheetName)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer store.Close()
+	ssID := spreadsheetID.Text
+	header, err := store.Header(ctx, ssID)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("getting spreadsheet header: %w", err)
+	}
+	stored := map[string]bool{}
+	if _, _, err := store.LastStored(ctx, ssID, header, map[string]string{}, stored); err != nil {
+		return 0, 0, 0, fmt.Errorf("reading stored tweet IDs: %w", err)
+	}
+
+	ids, skipped, failed := backfillTweetIDs(urls, stored)
+
+	now := time.Now()
+	done := 0
+	err = inLookupBatches(ids, func(batch []int64) error {
+		tweets, _, err := twClient.Statuses.Lookup(batch, &twitter.StatusLookupParams{IncludeEntities: twitter.Bool(true), TweetMode: "extended"})
+		if err != nil {
+			return fmt.Errorf("looking up tweets: %w", err)
+		}
+		found := map[int64]*twitter.Tweet{}
+		for i := range tweets {
+			found[tweets[i].ID] = &tweets[i]
+		}
+		for _, id := range batch {
+			tweet, ok := found[id]
+			if !ok {
+				// statuses/lookup silently leaves out tweets it can't
+				// return.
+				logWarning(logFields{"tweet_id": id}, "Backfill: tweet is deleted or protected")
+				failed++
+				continue
+			}
+			data := map[string]interface{}{
+				"instance_id":  instanceID(cfg),
+				"submitted_at": now.UTC().Format(time.RFC3339),
+				"archived_at":  archivedAt(now),
+			}
+			if age, err := ageAtSave(tweet, now); err != nil {
+				logWarning(logFields{"tweet_id": id}, "Failed to compute age of tweet: %s", err)
+			} else {
+				data["age_at_save"] = age
+			}
+			updateComputedFields(data, tweet)
+			data = applyTransform(ctx, cfg, data)
+			row, err := tweetToRow(data, header)
+			if err != nil {
+				logWarning(logFields{"tweet_id": id}, "Backfill: failed to convert data into a row: %s", err)
+				failed++
+				continue
+			}
+			// Rows are appended in the order of the URLs.
+			store.Append(ssID, twitter.DirectMessageEvent{ID: strconv.Itoa(imported)}, row)
+			imported++
+		}
+		done += len(batch)
+		return nil
+	})
+	if err != nil {
+		return imported, skipped, failed + len(ids) - done, err
+	}
+
+	if _, _, _, err := store.Flush(ctx); err != nil {
+		return 0, skipped, failed + imported, err
+	}
+	return imported, skipped, failed, nil
+}
+
+// backfillTweetIDs returns the IDs of the tweets linked in urls, in order,
+// leaving out the ones already stored and the ones listed more than once.
+// URLs that aren't tweet URLs count as failed.
+func backfillTweetIDs(urls []string, stored map[string]bool) (ids []int64, skipped int, failed int) {
+	seen := map[string]bool{}
+	for _, u := range urls {
+		m := tweetIDRe.FindStringSubmatch(u)
+		if m == nil {
+			logWarning(logFields{"url": u}, "Backfill: not a tweet URL")
+			failed++
+			continue
+		}
+		if stored[m[1]] || seen[m[1]] {
+			skipped++
+			continue
+		}
+		id, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			logWarning(logFields{"url": u}, "Backfill: failed to parse tweet ID: %s", err)
+			failed++
+			continue
+		}
+		seen[m[1]] = true
+		ids = append(ids, id)
+	}
+	return ids, skipped, failed
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBackfillTweetIDs(t *testing.T) {
+	urls := []string{
+		"https://twitter.com/a/status/100",
+		"https://x.com/b/status/200?s=20",
+		"https://twitter.com/a/status/100",
+		"https://twitter.com/c/status/300",
+		"https://example.com/not-a-tweet",
+	}
+	stored := map[string]bool{"300": true}
+	ids, skipped, failed := backfillTweetIDs(urls, stored)
+	if want := []int64{100, 200}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+	if skipped != 2 {
+		t.Errorf("skipped = %d, want 2", skipped)
+	}
+	if failed != 1 {
+		t.Errorf("failed = %d, want 1", failed)
+	}
+	if len(stored) != 1 {
+		t.Errorf("stored was modified: %v", stored)
+	}
+}
+
+func TestInLookupBatches(t *testing.T) {
+	ids := make([]int64, 2*statusLookupBatchSize+50)
+	for i := range ids {
+		ids[i] = int64(i)
+	}
+	sizes := []int{}
+	next := int64(0)
+	err := inLookupBatches(ids, func(batch []int64) error {
+		if batch[0] != next {
+			t.Errorf("batch starts at %d, want %d", batch[0], next)
+		}
+		next += int64(len(batch))
+		sizes = append(sizes, len(batch))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("inLookupBatches: %s", err)
+	}
+	if want := []int{statusLookupBatchSize, statusLookupBatchSize, 50}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("batch sizes = %v, want %v", sizes, want)
+	}
+
+	calls := 0
+	failure := errors.New("lookup failed")
+	err = inLookupBatches(ids, func(batch []int64) error {
+		calls++
+		return failure
+	})
+	if err != failure || calls != 1 {
+		t.Errorf("got %v after %d calls, want the first error after 1 call", err, calls)
+	}
+}
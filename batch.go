@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+type pendingAppend struct {
+	// First DM of the group, appended rows are ordered by it.
+	event twitter.DirectMessageEvent
+	row   []interface{}
+}
+
+// Number of rows added to a sheet that has run out of them.
+const gridExpandRows = 1000
+
+// sheetWrites collects the writes of a poll, so that each spreadsheet gets a
+// single batch update and a single append.
+type sheetWrites struct {
+	sheetName string
+	updates   map[string][]*sheets.ValueRange
+	appends   map[string][]pendingAppend
+	// autoExpand adds rows to the sheet when an append doesn't fit.
+	autoExpand bool
+}
+
+func newSheetWrites(sheetName string) *sheetWrites {
+	return &sheetWrites{
+		sheetName: sheetName,
+		updates:   map[string][]*sheets.ValueRange{},
+		appends:   map[string][]pendingAppend{},
+	}
+}
+
+func (w *sheetWrites) update(spreadsheetID string, rng string, row []interface{}) {
+	w.updates[spreadsheetID] = append(w.updates[spreadsheetID], &sheets.ValueRange{
+		Range:  rng,
+		Values: [][]interface{}{row},
+	})
+}
+
+func (w *sheetWrites) append(spreadsheetID string, first twitter.DirectMessageEvent, row []interface{}) {
+	w.appends[spreadsheetID] = append(w.appends[spreadsheetID], pendingAppend{event: first, row: row})
+}
+
+// flush writes everything collected so far and returns the number of rows
+// updated and appended. A failure for one spreadsheet doesn't stop the writes
+// to the others, the spreadsheets that failed are returned along with all
+// their errors. Appended rows are ordered by the time of the DM that
+// submitted them.
+func (w *sheetWrites) flush(ctx context.Context, sheetsService *sheets.Service) (updated int, appended int, failed map[string]bool, err error) {
+	failed = map[string]bool{}
+	errs := multiError{}
+	fail := func(spreadsheetID string, err error) {
+		failed[spreadsheetID] = true
+		errs.add(err)
+	}
+	for spreadsheetID, data := range w.updates {
+		err := retrySheetsWrite(ctx, logFields{"spreadsheet_id": spreadsheetID}, func() error {
+			_, err := sheetsService.Spreadsheets.Values.BatchUpdate(spreadsheetID, &sheets.BatchUpdateValuesRequest{
+				Data:             data,
+				ValueInputOption: "USER_ENTERED",
+			}).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			fail(spreadsheetID, fmt.Errorf("updating %d rows in %s: %w", len(data), spreadsheetID, err))
+			continue
+		}
+		log.Printf("Updated %d rows in %s", len(data), spreadsheetID)
+		updated += len(data)
+		delete(w.updates, spreadsheetID)
+	}
+
+	for spreadsheetID, pending := range w.appends {
+		if failed[spreadsheetID] {
+			// Appending would move the sender's last stored tweet past the
+			// row that failed to update.
+			continue
+		}
+		sortPendingAppends(pending)
+		rows := [][]interface{}{}
+		for _, p := range pending {
+			rows = append(rows, p.row)
+		}
+		appendRows := func() error {
+			return retrySheetsAppend(ctx, logFields{"spreadsheet_id": spreadsheetID}, func() error {
+				_, err := sheetsService.Spreadsheets.Values.Append(spreadsheetID, sheetRange(w.sheetName, "A1"), &sheets.ValueRange{
+					Values: rows,
+				}).ValueInputOption("USER_ENTERED").Context(ctx).Do()
+				return err
+			})
+		}
+		err := appendRows()
+		if err != nil && w.autoExpand && isGridLimitError(err) {
+			logWarning(logFields{"spreadsheet_id": spreadsheetID}, "Sheet %q is out of rows, adding %d", w.sheetName, gridExpandRows)
+			if expandErr := expandSheet(ctx, sheetsService, spreadsheetID, w.sheetName, gridExpandRows+len(rows)); expandErr != nil {
+				err = fmt.Errorf("%w (expanding the sheet failed: %s)", err, expandErr)
+			} else {
+				err = appendRows()
+			}
+		}
+		if err != nil {
+			fail(spreadsheetID, fmt.Errorf("appending %d rows to %s: %w", len(rows), spreadsheetID, err))
+			continue
+		}
+		log.Printf("Appended %d rows to %s", len(rows), spreadsheetID)
+		appended += len(rows)
+		delete(w.appends, spreadsheetID)
+	}
+	return updated, appended, failed, errs.err()
+}
+
+// sortPendingAppends orders rows by the time of the DM that submitted them.
+func sortPendingAppends(pending []pendingAppend) {
+	sort.SliceStable(pending, func(i, j int) bool {
+		a, b := pending[i].event, pending[j].event
+		if a.CreatedAt != b.CreatedAt {
+			return eventIDLess(a.CreatedAt, b.CreatedAt)
+		}
+		return eventIDLess(a.ID, b.ID)
+	})
+}
+
+// isGridLimitError reports whether a write failed because the sheet doesn't
+// have enough rows for it.
+func isGridLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == http.StatusBadRequest && strings.Contains(apiErr.Message, "exceeds grid limits")
+}
+
+// expandSheet adds n empty rows to the end of the sheet.
+func expandSheet(ctx context.Context, sheetsService *sheets.Service, spreadsheetID string, sheetName string, n int) error {
+	sheetID, err := sheetIDByTitle(sheetsService, spreadsheetID, sheetName)
+	if err != nil {
+		return err
+	}
+	_, err = sheetsService.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{{
+			AppendDimension: &sheets.AppendDimensionRequest{
+				SheetId:   sheetID,
+				Dimension: "ROWS",
+				Length:    int64(n),
+			},
+		}},
+	}).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// fullSheet is a spreadsheet whose sheet "Tweets" has no rows left until
+// it's expanded.
+type fullSheet struct {
+	appends  int
+	expanded []int64
+}
+
+func (f *fullSheet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, ":append"):
+		f.appends++
+		if len(f.expanded) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"code": 400, "message": "Range ('Tweets'!A1001) exceeds grid limits. Max rows: 1000, max columns: 26", "status": "INVALID_ARGUMENT"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(&sheets.AppendValuesResponse{})
+	case strings.HasSuffix(r.URL.Path, ":batchUpdate"):
+		req := &sheets.BatchUpdateSpreadsheetRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		for _, rq := range req.Requests {
+			if rq.AppendDimension != nil && rq.AppendDimension.SheetId == 5 {
+				f.expanded = append(f.expanded, rq.AppendDimension.Length)
+			}
+		}
+		json.NewEncoder(w).Encode(&sheets.BatchUpdateSpreadsheetResponse{})
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/spreadsheets/ss"):
+		json.NewEncoder(w).Encode(&sheets.Spreadsheet{Sheets: []*sheets.Sheet{
+			{Properties: &sheets.SheetProperties{Title: "Other", SheetId: 0}},
+			{Properties: &sheets.SheetProperties{Title: "Tweets", SheetId: 5}},
+		}})
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+	}
+}
+
+func TestAppendExpandsFullSheet(t *testing.T) {
+	for _, autoExpand := range []bool{true, false} {
+		f := &fullSheet{}
+		server := httptest.NewServer(f)
+		defer server.Close()
+		svc, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := newSheetWrites("Tweets")
+		w.autoExpand = autoExpand
+		w.append("ss", twitter.DirectMessageEvent{ID: "1", CreatedAt: "1000"}, []interface{}{"a"})
+		w.append("ss", twitter.DirectMessageEvent{ID: "2", CreatedAt: "2000"}, []interface{}{"b"})
+		_, appended, failed, err := w.flush(context.Background(), svc)
+
+		if !autoExpand {
+			if err == nil || !failed["ss"] || f.appends != 1 || len(f.expanded) != 0 {
+				t.Errorf("without autoExpand: error %v, failed %v, %d appends, expanded %v, want a single failed append", err, failed, f.appends, f.expanded)
+			}
+			continue
+		}
+		if err != nil || appended != 2 {
+			t.Fatalf("flush = %d appended, error %v, want 2 rows appended", appended, err)
+		}
+		if f.appends != 2 {
+			t.Errorf("made %d append requests, want 2", f.appends)
+		}
+		if len(f.expanded) != 1 || f.expanded[0] != gridExpandRows+2 {
+			t.Errorf("expanded the sheet by %v, want %d rows once", f.expanded, gridExpandRows+2)
+		}
+	}
+}
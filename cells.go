@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// cellTransformer turns the value of a field into the cell written for it,
+// given the value as decoded from the row's JSON.
+type cellTransformer func(v interface{}) interface{}
+
+// Transformers that column_formats can pick from.
+var cellTransformers = map[string]cellTransformer{
+	"hyperlink": hyperlinkCell,
+	"int":       intCell,
+}
+
+// columnTransformers maps fields to the transformer of their column, set
+// from column_formats at startup. Columns without one are written as text.
+var columnTransformers = map[string]cellTransformer{}
+
+// loadColumnTransformers parses column_formats, a comma-separated list of
+// <field>=<transformer> entries such as "url=hyperlink,favorite_count=int".
+// Invalid entries are logged and skipped.
+func loadColumnTransformers(entries []string) map[string]cellTransformer {
+	r := map[string]cellTransformer{}
+	for _, e := range entries {
+		i := strings.Index(e, "=")
+		if i < 0 {
+			logWarning(logFields{"column_formats": e}, "Invalid column_formats entry, expected <field>=<transformer>")
+			continue
+		}
+		field, name := strings.TrimSpace(e[:i]), strings.TrimSpace(e[i+1:])
+		t, ok := cellTransformers[name]
+		if !ok {
+			logWarning(logFields{"column_formats": e}, "Unknown column transformer %q", name)
+			continue
+		}
+		r[field] = t
+	}
+	return r
+}
+
+// hyperlinkCell makes a URL into a HYPERLINK formula.
+func hyperlinkCell(v interface{}) interface{} {
+	s, _ := v.(string)
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf(`=HYPERLINK("%s")`, strings.ReplaceAll(s, `"`, `""`))
+}
+
+// intCell writes numbers, and strings holding one, as integers. Anything
+// else is written as text.
+func intCell(v interface{}) interface{} {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return int64(n)
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64); err == nil {
+			return i
+		}
+		return n
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Sheets takes up to 50000 characters in a cell, and fails the whole write
+// if one has more.
+const defaultMaxCellLength = 49000
+
+// maxCellLength caps the length of cells, set from max_cell_length at
+// startup.
+var maxCellLength = defaultMaxCellLength
+
+const truncationMarker = "… [truncated]"
+
+// truncateCell cuts s down to maxCellLength characters, ending with
+// truncationMarker, if it's longer.
+func truncateCell(field string, s string) string {
+	n := utf8.RuneCountInString(s)
+	if n <= maxCellLength {
+		return s
+	}
+	logWarning(logFields{"field": field}, "Cell has %d characters, truncating it to %d", n, maxCellLength)
+	return cutText(s, n-maxCellLength)
+}
+
+// cutText removes the last n characters of s, and a few more to make room
+// for truncationMarker.
+func cutText(s string, n int) string {
+	runes := []rune(s)
+	keep := len(runes) - n - utf8.RuneCountInString(truncationMarker)
+	if keep < 0 {
+		keep = 0
+	}
+	return string(runes[:keep]) + truncationMarker
+}
+
+// truncatedJSON marshals data for the json column when it's too long for a
+// cell. The longest text fields are cut until it fits, and listed in
+// truncated_fields. If it still doesn't fit, it's returned as is and the
+// write will fail.
+func truncatedJSON(data map[string]interface{}, b []byte) []byte {
+	fields := []string{}
+	for f := range textColumns {
+		if _, ok := data[f].(string); ok {
+			fields = append(fields, f)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return len(data[fields[i]].(string)) > len(data[fields[j]].(string))
+	})
+	truncated := map[string]interface{}{}
+	for k, v := range data {
+		truncated[k] = v
+	}
+	cut := []string{}
+	for _, f := range fields {
+		if utf8.RuneCount(b) <= maxCellLength {
+			break
+		}
+		// Listing the field takes room too, so it's listed before working
+		// out how much to cut.
+		cut = append(cut, f)
+		truncated["truncated_fields"] = cut
+		listed, err := json.Marshal(truncated)
+		if err != nil {
+			break
+		}
+		truncated[f] = cutText(truncated[f].(string), utf8.RuneCount(listed)-maxCellLength)
+		next, err := json.Marshal(truncated)
+		if err != nil {
+			break
+		}
+		b = next
+	}
+	if n := utf8.RuneCount(b); n > maxCellLength {
+		logError(logFields{"fields": strings.Join(cut, ",")}, "JSON of the row has %d characters even with text fields cut, it won't fit in a cell", n)
+	} else if len(cut) > 0 {
+		logWarning(logFields{"fields": strings.Join(cut, ",")}, "JSON of the row is too long for a cell, truncated text fields")
+	}
+	return b
+}
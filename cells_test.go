@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestColumnTransformers(t *testing.T) {
+	defer func(c map[string]cellTransformer) { columnTransformers = c }(columnTransformers)
+	columnTransformers = loadColumnTransformers([]string{"url=hyperlink", " favorite_count = int ", "author", "text=bold"})
+	if len(columnTransformers) != 2 {
+		t.Fatalf("loaded %d transformers, want 2 with the invalid entries skipped", len(columnTransformers))
+	}
+
+	tweet := testTweet("100", "50", "text")
+	tweet.FavoriteCount = 1234
+	tweet.RetweetCount = 5
+	data := map[string]interface{}{}
+	updateComputedFields(data, tweet)
+	row, err := tweetToRow(data, []string{"url", "favorite_count", "retweet_count", "json"})
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	if row[0] != `=HYPERLINK("https://twitter.com/user50/status/100")` {
+		t.Errorf("url = %q", row[0])
+	}
+	if n, ok := row[1].(int64); !ok || n != 1234 {
+		t.Errorf("favorite_count = %#v, want the number 1234", row[1])
+	}
+	if row[2] != "5" {
+		t.Errorf("retweet_count = %#v, want text without a transformer", row[2])
+	}
+}
+
+func TestIntCell(t *testing.T) {
+	for _, c := range []struct {
+		in   interface{}
+		want interface{}
+	}{
+		{nil, ""},
+		{float64(42), int64(42)},
+		{" 17 ", int64(17)},
+		{"n/a", "n/a"},
+		{true, "true"},
+	} {
+		if got := intCell(c.in); got != c.want {
+			t.Errorf("intCell(%#v) = %#v, want %#v", c.in, got, c.want)
+		}
+	}
+	if got := hyperlinkCell(`https://example.com/?q="x"`); got != `=HYPERLINK("https://example.com/?q=""x""")` {
+		t.Errorf("hyperlinkCell quoted %q", got)
+	}
+}
+
+func TestOversizedNote(t *testing.T) {
+	defer func(n int) { maxCellLength = n }(maxCellLength)
+	maxCellLength = 5000
+
+	data := map[string]interface{}{"notes": strings.Repeat("ї", 7000)}
+	updateComputedFields(data, testTweet("100", "50", "short"))
+	row, err := tweetToRow(data, []string{"url", "text", "notes", "json"})
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	notes := strings.TrimPrefix(row[2].(string), "'")
+	if n := utf8.RuneCountInString(notes); n != maxCellLength || !strings.HasSuffix(notes, truncationMarker) {
+		t.Errorf("notes cell has %d characters ending in %q, want %d ending in the marker", n, string([]rune(notes)[n-20:]), maxCellLength)
+	}
+	if row[1] != "'short" {
+		t.Errorf("text = %q, want it untouched", row[1])
+	}
+
+	j := row[3].(string)
+	if n := utf8.RuneCountInString(j); n > maxCellLength {
+		t.Errorf("json cell has %d characters, want at most %d", n, maxCellLength)
+	}
+	stored := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(j), &stored); err != nil {
+		t.Fatalf("json cell doesn't parse: %s", err)
+	}
+	if fmt.Sprint(stored["truncated_fields"]) != "[notes]" || !strings.HasSuffix(stored["notes"].(string), truncationMarker) {
+		t.Errorf("json has truncated_fields %v, want [notes] with the notes cut", stored["truncated_fields"])
+	}
+	if stored["text"] != "short" {
+		t.Errorf("json text = %q, want it untouched", stored["text"])
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/sheets/v4"
+)
+
+// How long the app credentials are reused before being fetched again, which
+// is how a change to them gets picked up.
+const appCredsTTL = 10 * time.Minute
+
+// clientCache keeps the clients used by polls, so that only the first poll
+// after a cold start, or /_ah/warmup, pays for building them.
+type clientCache struct {
+	mu sync.Mutex
+
+	sheets *sheets.Service
+
+	appCreds        *TwitterCredentials
+	appCredsFetched time.Time
+
+	// By bot account ID.
+	twitter map[string]*cachedTwitterClient
+}
+
+// cachedTwitterClient is a client along with the credentials it was built
+// with. It is rebuilt once they change.
+type cachedTwitterClient struct {
+	appCreds   TwitterCredentials
+	userCreds  TwitterUserCredentials
+	httpClient *http.Client
+	client     *twitter.Client
+}
+
+var clients = &clientCache{twitter: map[string]*cachedTwitterClient{}}
+
+// sheetsService returns the shared Sheets service. It isn't tied to the
+// context of whoever builds it first, as that may be a request that's long
+// gone by the time the service refreshes its token.
+func (c *clientCache) sheetsService() (*sheets.Service, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sheets != nil {
+		return c.sheets, nil
+	}
+	svc, err := sheets.NewService(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c.sheets = svc
+	return svc, nil
+}
+
+// appCredentials returns the app credentials, fetching them again once
+// they are older than appCredsTTL.
+func (c *clientCache) appCredentials(ctx context.Context) (TwitterCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.appCreds != nil && time.Since(c.appCredsFetched) < appCredsTTL {
+		return *c.appCreds, nil
+	}
+	r, err := creds(ctx)
+	if err != nil {
+		return TwitterCredentials{}, err
+	}
+	c.appCreds = &r
+	c.appCredsFetched = time.Now()
+	return r, nil
+}
+
+// twitterClient returns the account's client, building a new one if there's
+// none yet or if it was built with other credentials.
+func (c *clientCache) twitterClient(account string, appCreds TwitterCredentials, userCreds TwitterUserCredentials) (*http.Client, *twitter.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := c.twitter[account]; t != nil && t.appCreds == appCreds && t.userCreds == userCreds {
+		return t.httpClient, t.client
+	}
+	httpClient := twitterHTTPClient(&appCreds, &userCreds)
+	t := &cachedTwitterClient{
+		appCreds:   appCreds,
+		userCreds:  userCreds,
+		httpClient: httpClient,
+		client:     twitter.NewClient(httpClient),
+	}
+	c.twitter[account] = t
+	return t.httpClient, t.client
+}
+
+// warm builds the clients of all bot accounts ahead of the first poll.
+// Accounts that aren't authorized yet are skipped.
+func (c *clientCache) warm(ctx context.Context, ds *datastore.Client, botUserIDs []string) error {
+	start := time.Now()
+	if _, err := c.sheetsService(); err != nil {
+		return fmt.Errorf("failed to create sheets service: %w", err)
+	}
+	appCreds, err := c.appCredentials(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get app credentials: %w", err)
+	}
+	for i, account := range botUserIDs {
+		userCreds, err := loadUserCredentials(ctx, ds, account, i == 0)
+		if err != nil {
+			log.Printf("Not warming the client of %s: %s", account, err)
+			continue
+		}
+		c.twitterClient(account, appCreds, *userCreds)
+	}
+	log.Printf("Warmed up clients in %s", time.Since(start))
+	return nil
+}
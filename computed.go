@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// ComputedField derives a field of the row data from the tweet. Compute
+// returns the value of the field, or nil to remove it, and false to leave
+// the field as it is.
+type ComputedField struct {
+	Name    string
+	Compute func(tweet *twitter.Tweet) (interface{}, bool)
+}
+
+// computedFields are set by updateComputedFields, in order, both when a
+// tweet is saved and when rows are rebuilt.
+var computedFields = []ComputedField{
+	{"text", func(tweet *twitter.Tweet) (interface{}, bool) {
+		text, _ := splitRetweetPrefix(expandedText(tweet))
+		text, _ = splitTweetText(text)
+		return text, true
+	}},
+	{"mentions", func(tweet *twitter.Tweet) (interface{}, bool) {
+		text, _ := splitRetweetPrefix(expandedText(tweet))
+		_, mentions := splitTweetText(text)
+		return mentions, true
+	}},
+	{"retweet_of", func(tweet *twitter.Tweet) (interface{}, bool) {
+		if _, retweetOf := splitRetweetPrefix(expandedText(tweet)); retweetOf != "" {
+			return retweetOf, true
+		}
+		return nil, true
+	}},
+	{"tweet", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweet, true
+	}},
+	{"url", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweetURL(tweet), true
+	}},
+	{"author", func(tweet *twitter.Tweet) (interface{}, bool) {
+		if tweet.User == nil {
+			return nil, false
+		}
+		return tweet.User.ScreenName, true
+	}},
+	{"author_id", func(tweet *twitter.Tweet) (interface{}, bool) {
+		if tweet.User == nil {
+			return nil, false
+		}
+		return tweet.User.IDStr, true
+	}},
+	{"quoted_tweet_id", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweet.QuotedStatusIDStr, tweet.QuotedStatusIDStr != ""
+	}},
+	// Replies get theirs from parentTweets.conversationID.
+	{"conversation_id", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweet.IDStr, tweet.InReplyToStatusIDStr == ""
+	}},
+	// The text of the parent needs an extra request, see applyInReplyTo.
+	{"in_reply_to_url", func(tweet *twitter.Tweet) (interface{}, bool) {
+		if tweet.InReplyToStatusIDStr == "" || tweet.InReplyToScreenName == "" {
+			return nil, false
+		}
+		return fmt.Sprintf("https://twitter.com/%s/status/%s", tweet.InReplyToScreenName, tweet.InReplyToStatusIDStr), true
+	}},
+	// statuses/show includes the quoted tweet for quote tweets without any
+	// extra parameters.
+	{"quoted_text", func(tweet *twitter.Tweet) (interface{}, bool) {
+		if tweet.QuotedStatus == nil {
+			return nil, false
+		}
+		text, _ := splitTweetText(expandedText(tweet.QuotedStatus))
+		return text, true
+	}},
+	{"quoted_url", func(tweet *twitter.Tweet) (interface{}, bool) {
+		if tweet.QuotedStatus == nil || tweet.QuotedStatus.User == nil {
+			return nil, false
+		}
+		return tweetURL(tweet.QuotedStatus), true
+	}},
+	{"quoted_author", func(tweet *twitter.Tweet) (interface{}, bool) {
+		if tweet.QuotedStatus == nil || tweet.QuotedStatus.User == nil {
+			return nil, false
+		}
+		return tweet.QuotedStatus.User.ScreenName, true
+	}},
+	{"media", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return strings.Join(mediaURLs(tweet), "\n"), true
+	}},
+	{"hashtags", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return strings.Join(hashtags(tweet), ", "), true
+	}},
+	{"lang", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweetLang(tweet), true
+	}},
+	{"favorite_count", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweet.FavoriteCount, true
+	}},
+	{"retweet_count", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweet.RetweetCount, true
+	}},
+	{"reply_count", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweet.ReplyCount, true
+	}},
+	{"source", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return tweetSource(tweet.Source), true
+	}},
+}
+
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// tweetSource returns the name of the client that posted the tweet, given
+// its source, an HTML link like
+// `<a href="http://twitter.com/download/iphone" rel="nofollow">Twitter for iPhone</a>`.
+// Sources without a link are returned as they are.
+func tweetSource(source string) string {
+	return strings.TrimSpace(html.UnescapeString(htmlTagRe.ReplaceAllString(source, "")))
+}
+
+// RegisterComputedField adds a field computed after the built-in ones, or
+// replaces the field with the same name. Deployments can call it from an
+// init function in a file of their own.
+func RegisterComputedField(f ComputedField) {
+	for i := range computedFields {
+		if computedFields[i].Name == f.Name {
+			computedFields[i] = f
+			return
+		}
+	}
+	computedFields = append(computedFields, f)
+}
+
+func updateComputedFields(data map[string]interface{}, tweet *twitter.Tweet) {
+	for _, f := range computedFields {
+		v, ok := f.Compute(tweet)
+		if !ok {
+			continue
+		}
+		if v == nil {
+			delete(data, f.Name)
+		} else {
+			data[f.Name] = v
+		}
+	}
+	updateFingerprint(data)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func TestQuotedTweetFields(t *testing.T) {
+	quoted := testTweet("100", "50", "@a @b Original claim https://t.co/q")
+	quoted.Entities = &twitter.Entities{Urls: []twitter.URLEntity{
+		{URL: "https://t.co/q", ExpandedURL: "https://example.com/source", Indices: twitter.Indices{21, 35}},
+	}}
+	tweet := testTweet("200", "60", "This is false")
+	tweet.QuotedStatusIDStr = "100"
+	tweet.QuotedStatus = quoted
+
+	data := map[string]interface{}{}
+	updateComputedFields(data, tweet)
+	for field, want := range map[string]interface{}{
+		"quoted_tweet_id": "100",
+		"quoted_text":     "Original claim https://example.com/source",
+		"quoted_url":      "https://twitter.com/user50/status/100",
+		"quoted_author":   "user50",
+		"text":            "This is false",
+	} {
+		if data[field] != want {
+			t.Errorf("%s = %q, want %q", field, data[field], want)
+		}
+	}
+
+	header := []string{"url", "text", "quoted_text", "quoted_url", "json"}
+	row, err := tweetToRow(data, header)
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	if row[3] != "https://twitter.com/user50/status/100" {
+		t.Errorf("quoted_url column = %q", row[3])
+	}
+
+	// Tweets that quote nothing leave the columns empty.
+	data = map[string]interface{}{}
+	updateComputedFields(data, testTweet("300", "60", "plain"))
+	for _, field := range []string{"quoted_tweet_id", "quoted_text", "quoted_url", "quoted_author"} {
+		if v, ok := data[field]; ok {
+			t.Errorf("%s = %q for a tweet quoting nothing", field, v)
+		}
+	}
+}
+
+func TestTextPrefersFullText(t *testing.T) {
+	// statuses/show with tweet_mode=extended returns full_text only.
+	extended := &twitter.Tweet{}
+	err := json.Unmarshal([]byte(`{
+		"id_str": "100",
+		"full_text": "A tweet longer than 140 characters, which compatibility mode would have cut off with an ellipsis and a link to the tweet itself.",
+		"user": {"id_str": "50", "screen_name": "someone"}
+	}`), extended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := testTweet("200", "50", "")
+	truncated.FullText = "Full text"
+	truncated.Text = "Full…"
+	compat := testTweet("300", "50", "")
+	compat.Text = "Only text"
+
+	for _, c := range []struct {
+		tweet *twitter.Tweet
+		want  string
+	}{
+		{extended, extended.FullText},
+		{truncated, "Full text"},
+		{compat, "Only text"},
+	} {
+		data := map[string]interface{}{}
+		updateComputedFields(data, c.tweet)
+		if data["text"] != c.want {
+			t.Errorf("text of %s = %q, want %q", c.tweet.IDStr, data["text"], c.want)
+		}
+	}
+}
+
+func TestRetweetAndMentionPrefixes(t *testing.T) {
+	for _, c := range []struct {
+		text, wantText, wantMentions, wantRetweetOf string
+	}{
+		{"RT @someone: @other Breaking news", "Breaking news", "@other", "someone"},
+		{"RT @some_one1: plain retweet", "plain retweet", "", "some_one1"},
+		{"@a @b_c @d Thanks for the thread", "Thanks for the thread", "@a @b_c @d", ""},
+		{"Reply to @a mid-sentence", "Reply to @a mid-sentence", "", ""},
+	} {
+		data := map[string]interface{}{}
+		updateComputedFields(data, testTweet("100", "50", c.text))
+		retweetOf, _ := data["retweet_of"].(string)
+		if data["text"] != c.wantText || data["mentions"] != c.wantMentions || retweetOf != c.wantRetweetOf {
+			t.Errorf("%q: text %q, mentions %q, retweet_of %q, want %q, %q, %q", c.text, data["text"], data["mentions"], retweetOf, c.wantText, c.wantMentions, c.wantRetweetOf)
+		}
+	}
+}
+
+func TestRegisterComputedField(t *testing.T) {
+	saved := append([]ComputedField{}, computedFields...)
+	defer func() { computedFields = saved }()
+	RegisterComputedField(ComputedField{"shouting", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return strings.ToUpper(tweet.FullText), true
+	}})
+	// Replacing a built-in keeps its place.
+	RegisterComputedField(ComputedField{"author", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return "@" + tweet.User.ScreenName, true
+	}})
+	if n := len(computedFields); n != len(saved)+1 {
+		t.Errorf("%d computed fields, want %d", n, len(saved)+1)
+	}
+
+	data := map[string]interface{}{}
+	updateComputedFields(data, testTweet("100", "50", "quiet"))
+	if data["shouting"] != "QUIET" || data["author"] != "@user50" {
+		t.Errorf("shouting = %q, author = %q, want QUIET and @user50", data["shouting"], data["author"])
+	}
+
+	// Rebuilt rows run the same fields, so a field registered after the
+	// row was saved is filled in.
+	header := []string{"shouting", "author", "json"}
+	computedFields = saved
+	row, err := tweetToRow(map[string]interface{}{"tweet": testTweet("100", "50", "later")}, header)
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	RegisterComputedField(ComputedField{"shouting", func(tweet *twitter.Tweet) (interface{}, bool) {
+		return strings.ToUpper(tweet.FullText), true
+	}})
+	rebuilt, err := rebuildRow(row[2], header)
+	if err != nil {
+		t.Fatalf("rebuildRow: %s", err)
+	}
+	if rebuilt[0] != "LATER" || rebuilt[1] != "user50" {
+		t.Errorf("rebuilt row = %q, want LATER by user50", rebuilt[:2])
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+// Config holds optional settings, read on every poll from runtime config and
+// a few environment variables.
+type Config struct {
+	// DryRun is set by the DRY_RUN environment variable. Instead of writing
+	// to the spreadsheet, polls log the rows they would write. Datastore
+	// writes that record progress or outcomes (the DM cursor and dead
+	// letters) are suppressed as well, so repeated dry runs see the same
+	// state. Recorded responses are still stored if enabled.
+	DryRun bool
+
+	// StorageBackend is set by the STORAGE_BACKEND environment variable,
+	// "sheets" (the default), "sqlite" or "notion". The SQLite database is
+	// at SQLITE_PATH, and its table gets the columns listed in the
+	// comma-separated SQLITE_COLUMNS. The Notion database is
+	// NOTION_DATABASE_ID, accessed with the integration token in
+	// NOTION_TOKEN. Only polls use the backend, other endpoints always work
+	// on the spreadsheet.
+	StorageBackend   string
+	SQLitePath       string
+	SQLiteColumns    []string
+	NotionToken      string
+	NotionDatabaseID string
+
+	// TwitterAPIVersion is set by the TWITTER_API_VERSION environment
+	// variable, "1.1" (the default) or "2". With "2", polls fetch the
+	// submitted tweets from the v2 API with the app's bearer token. Replies,
+	// quotes and threads are still looked up with v1.1.
+	TwitterAPIVersion string
+
+	// MediaArchiveBucket is set by the MEDIA_ARCHIVE_BUCKET environment
+	// variable. If set, media of new tweets is copied into the bucket.
+	// Items larger than MEDIA_ARCHIVE_MAX_BYTES, or whose type isn't in the
+	// comma-separated MEDIA_ARCHIVE_TYPES, are skipped. Types ending in "/"
+	// match all subtypes.
+	MediaArchiveBucket   string
+	MediaArchiveMaxBytes int64
+	MediaArchiveTypes    []string
+
+	// SaveWebhookURL is set by the SAVE_WEBHOOK_URL environment variable.
+	// If set, polls post a saveNotification there for each row they
+	// append, with a timeout of SAVE_WEBHOOK_TIMEOUT_SECONDS.
+	SaveWebhookURL     string
+	SaveWebhookTimeout time.Duration
+
+	TransformURL      string
+	TransformTimeout  time.Duration
+	InstanceID        string
+	PrioritySenders   map[string]bool
+	PriorityValue     string
+	DMv2Fallback      bool
+	KeywordAllowlist  []keyword
+	KeywordDenylist   []keyword
+	RecordResponses   bool
+	ExpandThreads     bool
+	DedupeGlobally    bool
+	ResolveShorteners bool
+	NotesBeforeLink   bool
+	// SaveDMAttachments saves photos and videos uploaded into a DM as rows
+	// of their own, with a blank tweet.
+	SaveDMAttachments bool
+	// FetchPolls fetches the card of each saved tweet, one more request per
+	// tweet, to store its poll.
+	FetchPolls bool
+	// MaxDMPages is read from max_dm_pages and caps the number of DM event
+	// pages fetched per poll. Zero or less means no cap.
+	MaxDMPages int
+	// MaxSavesPerSenderPerHour is read from max_saves_per_sender_per_hour.
+	// If above zero, senders can't save more tweets than that within an
+	// hour, counted in Datastore.
+	MaxSavesPerSenderPerHour int
+	// IgnoreSelfAuthored skips tweets by the bot account the DM was sent
+	// to.
+	IgnoreSelfAuthored bool
+	// UnrollKeyword is read from unroll_keyword. If the notes of a tweet
+	// have this word, the tweets it continues by the same author are saved
+	// with it, ahead of its text.
+	UnrollKeyword *keyword
+	// SenderWorkers is read from sender_workers, the number of senders
+	// processed in parallel.
+	SenderWorkers int
+	// CheckpointEvery is read from checkpoint_every. Polls write the rows
+	// and move the sender's DM cursor after that many new rows of a sender,
+	// so a restart doesn't start its backlog over. Zero or less only writes
+	// at the end of the poll.
+	CheckpointEvery int
+	// AutoExpandGrid is read from auto_expand_grid and defaults to true.
+	// If set, rows are added to the sheet when an append doesn't fit.
+	AutoExpandGrid bool
+	// AuthorWhitelist holds user IDs and lowercased screen names. If not
+	// empty, only tweets by these accounts are saved.
+	AuthorWhitelist map[string]bool
+}
+
+func variableName(name string) string {
+	return fmt.Sprintf("projects/%s/configs/prod/variables/%s", os.Getenv("GOOGLE_CLOUD_PROJECT"), name)
+}
+
+// optionalVariable returns the value of a runtime config variable, or an
+// empty string if it is not set.
+func optionalVariable(vars *runtimeconfig.ProjectsConfigsVariablesService, name string) (string, error) {
+	v, err := vars.Get(variableName(name)).Do()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("fetching %s: %w", name, err)
+	}
+	return v.Text, nil
+}
+
+func intVariable(vars *runtimeconfig.ProjectsConfigsVariablesService, name string, def int) (int, error) {
+	s, err := optionalVariable(vars, name)
+	if err != nil || s == "" {
+		return def, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return n, nil
+}
+
+func boolVariable(vars *runtimeconfig.ProjectsConfigsVariablesService, name string) (bool, error) {
+	return boolVariableDefault(vars, name, false)
+}
+
+func boolVariableDefault(vars *runtimeconfig.ProjectsConfigsVariablesService, name string, def bool) (bool, error) {
+	s, err := optionalVariable(vars, name)
+	if err != nil || s == "" {
+		return def, err
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		return false, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// listVariable returns the non-empty items of a comma-separated runtime
+// config variable.
+func listVariable(vars *runtimeconfig.ProjectsConfigsVariablesService, name string) ([]string, error) {
+	s, err := optionalVariable(vars, name)
+	if err != nil {
+		return nil, err
+	}
+	r := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			r = append(r, item)
+		}
+	}
+	return r, nil
+}
+
+const (
+	defaultSenderWorkers   = 4
+	defaultCheckpointEvery = 10
+)
+
+func loadConfig(vars *runtimeconfig.ProjectsConfigsVariablesService) (*Config, error) {
+	r := &Config{
+		DryRun:             os.Getenv("DRY_RUN") != "",
+		MediaArchiveBucket: os.Getenv("MEDIA_ARCHIVE_BUCKET"),
+		SaveWebhookURL:     os.Getenv("SAVE_WEBHOOK_URL"),
+		SaveWebhookTimeout: defaultSaveWebhookTimeout,
+		StorageBackend:     os.Getenv("STORAGE_BACKEND"),
+		SQLitePath:         os.Getenv("SQLITE_PATH"),
+		NotionToken:        os.Getenv("NOTION_TOKEN"),
+		NotionDatabaseID:   os.Getenv("NOTION_DATABASE_ID"),
+		TwitterAPIVersion:  os.Getenv("TWITTER_API_VERSION"),
+	}
+	switch r.TwitterAPIVersion {
+	case "", "1.1":
+		r.TwitterAPIVersion = "1.1"
+	case "2":
+	default:
+		return nil, fmt.Errorf("unknown TWITTER_API_VERSION %q", r.TwitterAPIVersion)
+	}
+	if s := os.Getenv("SAVE_WEBHOOK_TIMEOUT_SECONDS"); s != "" {
+		seconds, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("parsing SAVE_WEBHOOK_TIMEOUT_SECONDS: %w", err)
+		}
+		r.SaveWebhookTimeout = time.Duration(seconds) * time.Second
+	}
+	r.MediaArchiveMaxBytes = defaultMediaArchiveMaxBytes
+	if s := os.Getenv("MEDIA_ARCHIVE_MAX_BYTES"); s != "" {
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid MEDIA_ARCHIVE_MAX_BYTES %q", s)
+		}
+		r.MediaArchiveMaxBytes = n
+	}
+	for _, t := range strings.Split(os.Getenv("MEDIA_ARCHIVE_TYPES"), ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			r.MediaArchiveTypes = append(r.MediaArchiveTypes, t)
+		}
+	}
+	if len(r.MediaArchiveTypes) == 0 {
+		r.MediaArchiveTypes = defaultMediaArchiveTypes
+	}
+	if r.SQLitePath == "" {
+		r.SQLitePath = defaultSQLitePath
+	}
+	for _, c := range strings.Split(os.Getenv("SQLITE_COLUMNS"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			r.SQLiteColumns = append(r.SQLiteColumns, c)
+		}
+	}
+
+	var err error
+	if r.TransformURL, err = optionalVariable(vars, "transform_url"); err != nil {
+		return nil, err
+	}
+	timeout, err := intVariable(vars, "transform_timeout_seconds", 10)
+	if err != nil {
+		return nil, err
+	}
+	r.TransformTimeout = time.Duration(timeout) * time.Second
+	if r.InstanceID, err = optionalVariable(vars, "instance_id"); err != nil {
+		return nil, err
+	}
+	prioritySenders, err := listVariable(vars, "priority_senders")
+	if err != nil {
+		return nil, err
+	}
+	r.PrioritySenders = map[string]bool{}
+	for _, id := range prioritySenders {
+		r.PrioritySenders[id] = true
+	}
+	if r.PriorityValue, err = optionalVariable(vars, "priority_value"); err != nil {
+		return nil, err
+	}
+	if r.PriorityValue == "" {
+		r.PriorityValue = "high"
+	}
+	if r.DMv2Fallback, err = boolVariable(vars, "dm_v2_fallback"); err != nil {
+		return nil, err
+	}
+	allow, err := listVariable(vars, "keyword_allowlist")
+	if err != nil {
+		return nil, err
+	}
+	if r.KeywordAllowlist, err = compileKeywords(allow); err != nil {
+		return nil, err
+	}
+	deny, err := listVariable(vars, "keyword_denylist")
+	if err != nil {
+		return nil, err
+	}
+	if r.KeywordDenylist, err = compileKeywords(deny); err != nil {
+		return nil, err
+	}
+	if r.RecordResponses, err = boolVariable(vars, "record_responses"); err != nil {
+		return nil, err
+	}
+	if r.ExpandThreads, err = boolVariable(vars, "expand_threads"); err != nil {
+		return nil, err
+	}
+	if r.DedupeGlobally, err = boolVariable(vars, "dedupe_globally"); err != nil {
+		return nil, err
+	}
+	if r.ResolveShorteners, err = boolVariable(vars, "resolve_shorteners"); err != nil {
+		return nil, err
+	}
+	if r.NotesBeforeLink, err = boolVariable(vars, "notes_before_link"); err != nil {
+		return nil, err
+	}
+	if r.SaveDMAttachments, err = boolVariable(vars, "save_dm_attachments"); err != nil {
+		return nil, err
+	}
+	if r.FetchPolls, err = boolVariable(vars, "fetch_polls"); err != nil {
+		return nil, err
+	}
+	if r.MaxDMPages, err = intVariable(vars, "max_dm_pages", defaultMaxDMPages); err != nil {
+		return nil, err
+	}
+	if r.MaxSavesPerSenderPerHour, err = intVariable(vars, "max_saves_per_sender_per_hour", 0); err != nil {
+		return nil, err
+	}
+	if r.IgnoreSelfAuthored, err = boolVariable(vars, "ignore_self_authored"); err != nil {
+		return nil, err
+	}
+	unroll, err := optionalVariable(vars, "unroll_keyword")
+	if err != nil {
+		return nil, err
+	}
+	if unroll = strings.TrimSpace(unroll); unroll != "" {
+		k, err := newKeyword(unroll)
+		if err != nil {
+			return nil, fmt.Errorf("compiling unroll_keyword: %w", err)
+		}
+		r.UnrollKeyword = &k
+	}
+	if r.SenderWorkers, err = intVariable(vars, "sender_workers", defaultSenderWorkers); err != nil {
+		return nil, err
+	}
+	if r.CheckpointEvery, err = intVariable(vars, "checkpoint_every", defaultCheckpointEvery); err != nil {
+		return nil, err
+	}
+	if r.AutoExpandGrid, err = boolVariableDefault(vars, "auto_expand_grid", true); err != nil {
+		return nil, err
+	}
+	authors, err := listVariable(vars, "author_whitelist")
+	if err != nil {
+		return nil, err
+	}
+	r.AuthorWhitelist = map[string]bool{}
+	for _, a := range authors {
+		r.AuthorWhitelist[strings.ToLower(strings.TrimPrefix(a, "@"))] = true
+	}
+	return r, nil
+}
+
+// listVariables returns all runtime config variables under prefix, keyed by
+// the rest of their name.
+func listVariables(ctx context.Context, vars *runtimeconfig.ProjectsConfigsVariablesService, prefix string) (map[string]string, error) {
+	r := map[string]string{}
+	fullPrefix := variableName(prefix)
+	err := vars.List(fmt.Sprintf("projects/%s/configs/prod", os.Getenv("GOOGLE_CLOUD_PROJECT"))).
+		Filter(fullPrefix).
+		PageSize(1000).
+		ReturnValues(true).
+		Pages(ctx, func(resp *runtimeconfig.ListVariablesResponse) error {
+			for _, v := range resp.Variables {
+				if !strings.HasPrefix(v.Name, fullPrefix) {
+					continue
+				}
+				r[strings.TrimPrefix(v.Name, fullPrefix)] = v.Text
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+const defaultSheetName = "Tweets"
+
+// loadSheetName returns the name of the tab tweets are saved to, read from
+// sheet_name.
+func loadSheetName(vars *runtimeconfig.ProjectsConfigsVariablesService) (string, error) {
+	s, err := optionalVariable(vars, "sheet_name")
+	if err != nil {
+		return "", err
+	}
+	if s == "" {
+		return defaultSheetName, nil
+	}
+	return s, nil
+}
+
+const (
+	defaultPollInterval = 5 * time.Minute
+	minPollInterval     = 30 * time.Second
+	maxPollInterval     = time.Hour
+)
+
+// loadPollInterval reads poll_interval_seconds from runtime config, falling
+// back to the POLL_INTERVAL_SECONDS environment variable. Missing or invalid
+// values result in the default interval.
+func loadPollInterval(ctx context.Context) time.Duration {
+	s := ""
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err == nil {
+		s, err = optionalVariable(rcService.Projects.Configs.Variables, "poll_interval_seconds")
+	}
+	if err != nil {
+		log.Printf("Failed to read poll_interval_seconds: %s", err)
+	}
+	if s == "" {
+		s = os.Getenv("POLL_INTERVAL_SECONDS")
+	}
+	if s == "" {
+		return defaultPollInterval
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		log.Printf("Invalid poll interval %q, using %s", s, defaultPollInterval)
+		return defaultPollInterval
+	}
+	d := time.Duration(n) * time.Second
+	if d < minPollInterval || d > maxPollInterval {
+		log.Printf("Poll interval %s is outside of [%s, %s], using %s", d, minPollInterval, maxPollInterval, defaultPollInterval)
+		return defaultPollInterval
+	}
+	return d
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const dmCursorEntity = "DMCursor"
+const dmCursorID = dmCursorEntity
+
+// DMCursor records the newest DM event processed by a successful poll, so the
+// next poll can stop paging once it gets past it. There's one cursor per
+// sender, which only moves once that sender's rows are written, and a global
+// one that moves once all of a poll is written. Senders without a cursor of
+// their own use the global one.
+type DMCursor struct {
+	LastEventID string
+	Updated     time.Time
+}
+
+// eventIDLess compares numeric event IDs, or timestamps, without parsing
+// them.
+func eventIDLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// dmCursorKey returns the key of the sender's cursor, or of the global one if
+// senderID is empty, within the scope of a bot account (see cursorScope).
+func dmCursorKey(scope string, senderID string) *datastore.Key {
+	if senderID == "" {
+		return datastore.NameKey(dmCursorEntity, scope+dmCursorID, nil)
+	}
+	return datastore.NameKey(dmCursorEntity, scope+"sender/"+senderID, nil)
+}
+
+// loadDMCursor returns the stored global cursor, or an empty one if there's
+// none yet, in which case the whole DM list gets scanned.
+func loadDMCursor(ctx context.Context, ds *datastore.Client, scope string) (*DMCursor, error) {
+	c := &DMCursor{}
+	err := ds.Get(ctx, dmCursorKey(scope, ""), c)
+	if err == datastore.ErrNoSuchEntity {
+		return &DMCursor{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadSenderCursors returns the last processed event ID for each sender,
+// falling back to global for senders without a cursor of their own.
+func loadSenderCursors(ctx context.Context, ds *datastore.Client, scope string, senders map[string]string, global string) (map[string]string, error) {
+	ids := []string{}
+	keys := []*datastore.Key{}
+	for id := range senders {
+		ids = append(ids, id)
+		keys = append(keys, dmCursorKey(scope, id))
+	}
+	cursors := make([]DMCursor, len(keys))
+	err := ds.GetMulti(ctx, keys, cursors)
+	merr, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+	r := map[string]string{}
+	for i, id := range ids {
+		if isMulti && merr[i] != nil {
+			if merr[i] != datastore.ErrNoSuchEntity {
+				return nil, merr[i]
+			}
+			r[id] = global
+			continue
+		}
+		r[id] = cursors[i].LastEventID
+	}
+	return r, nil
+}
+
+// oldestCursor returns the oldest of the cursors, or an empty string if any
+// of them is empty, meaning the whole DM list has to be scanned.
+func oldestCursor(cursors map[string]string) string {
+	r := ""
+	for _, c := range cursors {
+		if c == "" {
+			return ""
+		}
+		if r == "" || eventIDLess(c, r) {
+			r = c
+		}
+	}
+	return r
+}
+
+// advanceDMCursor stores eventID as the newest processed event of the sender,
+// or globally if senderID is empty, unless the stored one is already newer.
+func advanceDMCursor(ctx context.Context, ds *datastore.Client, scope string, senderID string, eventID string) error {
+	if eventID == "" {
+		return nil
+	}
+	key := dmCursorKey(scope, senderID)
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		c := &DMCursor{}
+		if err := tx.Get(key, c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if !eventIDLess(c.LastEventID, eventID) {
+			return nil
+		}
+		c.LastEventID = eventID
+		c.Updated = time.Now()
+		_, err := tx.Put(key, c)
+		return err
+	})
+	return err
+}
@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"cloud.google.com/go/datastore"
 	"github.com/dghubble/go-twitter/twitter"
@@ -27,42 +31,195 @@ func stringify(v interface{}) string {
 	return string(b)
 }
 
-func PollDMs(ctx context.Context, ds *datastore.Client, rebuild <-chan struct{}) error {
-	t := time.NewTicker(5 * time.Minute)
+// sheetsMu keeps spreadsheet writers from interleaving. A rebuild rewrites
+// all rows by position, so a row appended or updated in the middle of it
+// could end up overwritten or shifted. Polls only hold it while reading the
+// stored rows and while writing, not while fetching from Twitter, see
+// lockedStore.
+var sheetsMu sync.Mutex
+
+// rowsMoved counts the writes that moved existing rows, such as deleting
+// some. Guarded by sheetsMu.
+var rowsMoved int
+
+// rebuildRequest asks PollDMs to rebuild the spreadsheet between polls. The
+// result is sent on done, which has to be buffered, or nil for callers that
+// don't wait.
+type rebuildRequest struct {
+	done chan rebuildResult
+}
+
+type rebuildResult struct {
+	rebuilt int
+	skipped int
+	err     error
+}
+
+// PollDMs polls for new DMs until ctx is cancelled. A poll that is in
+// progress when that happens gets up to shutdownGracePeriod to finish, after
+// which PollDMs returns nil.
+func PollDMs(ctx context.Context, ds *datastore.Client, botUserIDs []string, rebuild <-chan rebuildRequest, health *Health) error {
+	interval := loadPollInterval(ctx)
+	log.Printf("Polling every %s", interval)
+	health.setPollInterval(interval)
+	t := time.NewTicker(interval)
 	defer t.Stop()
-	if err := pollDMsOnce(ctx, ds); err != nil {
-		log.Printf("Failed to poll DMs: %s", err)
+	if err := applyValidationRules(ctx); err != nil {
+		log.Printf("Failed to apply validation rules: %s", err)
+	}
+	poll := func() {
+		pollCtx, cancel := withGracePeriod(ctx, shutdownGracePeriod)
+		defer cancel()
+		metrics := &pollMetrics{}
+		for i, account := range botUserIDs {
+			err := pollDMsOnce(pollCtx, ds, account, i == 0, health, metrics)
+			if err != nil {
+				log.Printf("Failed to poll DMs of %s: %s", account, err)
+				health.recordError(err)
+				metrics.Errors++
+			}
+		}
+		totals.add(metrics, time.Now())
+		metrics.export(pollCtx)
 	}
+	poll()
 	for {
 		select {
-		case <-rebuild:
+		case req := <-rebuild:
 			log.Printf("Rebuilding the spreadsheet...")
-			if err := rebuildSpreadsheet(ctx); err != nil {
+			// The header may have been edited, re-read it.
+			invalidateHeaderCache()
+			sheetsMu.Lock()
+			rebuilt, skipped, err := rebuildSpreadsheet(ctx)
+			sheetsMu.Unlock()
+			if err != nil {
 				log.Printf("Failed to rebuild the spreadsheet: %s", err)
 			} else {
-				log.Printf("Spreadsheet rebuilt successfully")
+				log.Printf("Spreadsheet rebuilt successfully, %d rows rebuilt, %d left as is", rebuilt, skipped)
 			}
-		case <-t.C:
-			if err := pollDMsOnce(ctx, ds); err != nil {
-				log.Printf("Failed to poll DMs: %s", err)
+			if req.done != nil {
+				req.done <- rebuildResult{rebuilt: rebuilt, skipped: skipped, err: err}
+			}
+			if err := applyValidationRules(ctx); err != nil {
+				log.Printf("Failed to apply validation rules: %s", err)
+			}
+			if d := loadPollInterval(ctx); d != interval {
+				log.Printf("Poll interval changed from %s to %s", interval, d)
+				interval = d
+				health.setPollInterval(interval)
+				t.Reset(interval)
 			}
+		case <-t.C:
+			poll()
 		case <-ctx.Done():
-			return ctx.Err()
+			log.Printf("Stopped polling DMs")
+			return nil
 		}
 	}
-	return nil
 }
 
-func twitterClient(appCreds *TwitterCredentials, userCreds *TwitterUserCredentials) *twitter.Client {
+// withGracePeriod returns a context that is cancelled grace after ctx is,
+// so that work started before ctx was cancelled has a chance to finish.
+func withGracePeriod(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	r, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-r.Done():
+			return
+		}
+		select {
+		case <-time.After(grace):
+			cancel()
+		case <-r.Done():
+		}
+	}()
+	return r, cancel
+}
+
+// maxConsecutiveEmptyPages bounds how many empty pages with a non-empty
+// cursor we're willing to fetch before giving up on the rest of the list.
+const maxConsecutiveEmptyPages = 3
+
+// Default for max_dm_pages, the number of DM event pages a poll fetches at
+// most.
+const defaultMaxDMPages = 100
+
+// dmPager decides when paging through DM events stops. Twitter has been seen
+// returning empty pages with a cursor, and cursors that lead back to a page
+// we already got, which would otherwise loop forever.
+type dmPager struct {
+	maxPages    int
+	pages       int
+	emptyPages  int
+	seenCursors map[string]bool
+	seenEvents  map[string]bool
+}
+
+// newDMPager returns a pager fetching at most maxPages pages, or any number
+// if it's 0.
+func newDMPager(maxPages int) *dmPager {
+	return &dmPager{maxPages: maxPages, seenCursors: map[string]bool{}, seenEvents: map[string]bool{}}
+}
+
+// canFetch reports whether the page at cursor may be fetched.
+func (p *dmPager) canFetch(cursor string) bool {
+	if p.maxPages > 0 && p.pages >= p.maxPages {
+		logWarning(logFields{"cursor": cursor}, "Fetched %d pages of DM events, stopping", p.pages)
+		return false
+	}
+	return true
+}
+
+// page records a fetched page. It returns the events of the page that
+// weren't on an earlier one, and whether the next page should be fetched.
+func (p *dmPager) page(resp *twitter.DirectMessageEvents) (events []twitter.DirectMessageEvent, more bool) {
+	p.pages++
+	for _, e := range resp.Events {
+		if !p.seenEvents[e.ID] {
+			p.seenEvents[e.ID] = true
+			events = append(events, e)
+		}
+	}
+	cursor := resp.NextCursor
+	if cursor == "" {
+		return events, false
+	}
+	if len(resp.Events) == 0 {
+		p.emptyPages++
+		if p.emptyPages >= maxConsecutiveEmptyPages {
+			log.Printf("Got %d empty pages in a row, stopping", p.emptyPages)
+			return events, false
+		}
+	} else {
+		p.emptyPages = 0
+	}
+	if p.seenCursors[cursor] {
+		logWarning(logFields{"cursor": cursor}, "Got a cursor that was already fetched, stopping")
+		return events, false
+	}
+	p.seenCursors[cursor] = true
+	if len(resp.Events) > 0 && len(events) == 0 {
+		logWarning(logFields{"cursor": cursor}, "Got a page with only events that were already fetched, stopping")
+		return events, false
+	}
+	return events, true
+}
+
+func twitterHTTPClient(appCreds *TwitterCredentials, userCreds *TwitterUserCredentials) *http.Client {
 	config := oauth1.NewConfig(appCreds.APIKey, appCreds.APIKeySecret)
 	token := oauth1.NewToken(userCreds.Token, userCreds.TokenSecret)
-	httpClient := config.Client(oauth1.NoContext, token)
+	return config.Client(oauth1.NoContext, token)
+}
 
-	return twitter.NewClient(httpClient)
+func twitterClient(appCreds *TwitterCredentials, userCreds *TwitterUserCredentials) *twitter.Client {
+	return twitter.NewClient(twitterHTTPClient(appCreds, userCreds))
 }
 
-func pollDMsOnce(ctx context.Context, ds *datastore.Client) error {
-	log.Printf("Polling DMs")
+// pollDMsOnce saves the tweets sent to one bot account. The primary account
+// is the first one, see parseBotUserIDs.
+func pollDMsOnce(ctx context.Context, ds *datastore.Client, account string, primary bool, health *Health, metrics *pollMetrics) error {
+	log.Printf("Polling DMs of %s", account)
 
 	rcService, err := runtimeconfig.NewService(ctx)
 	if err != nil {
@@ -73,75 +230,151 @@ func pollDMsOnce(ctx context.Context, ds *datastore.Client) error {
 	if err != nil {
 		return fmt.Errorf("fetching spreadsheet_id: %w", err)
 	}
-	senderWhitelist := map[string]string{}
-	err = vars.List(fmt.Sprintf("projects/%s/configs/prod", os.Getenv("GOOGLE_CLOUD_PROJECT"))).
-		Filter(fmt.Sprintf("projects/%s/configs/prod/variables/whitelist/", os.Getenv("GOOGLE_CLOUD_PROJECT"))).
-		PageSize(1000).
-		ReturnValues(true).
-		Pages(ctx, func(resp *runtimeconfig.ListVariablesResponse) error {
-			prefix := fmt.Sprintf("projects/%s/configs/prod/variables/whitelist/", os.Getenv("GOOGLE_CLOUD_PROJECT"))
-			for _, v := range resp.Variables {
-				if !strings.HasPrefix(v.Name, prefix) {
-					continue
-				}
-				senderWhitelist[v.Text] = strings.TrimPrefix(v.Name, prefix)
-			}
-			return nil
-		})
+	cfg, err := loadConfig(vars)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	sheetName, err := loadSheetName(vars)
+	if err != nil {
+		return fmt.Errorf("loading sheet name: %w", err)
+	}
+	senderWhitelist, senderSpreadsheets, err := loadWhitelist(ctx, ds, vars, spreadsheetID.Text)
 	if err != nil {
 		return fmt.Errorf("fetching whitelist: %w", err)
 	}
 
-	userCreds := &TwitterUserCredentials{}
-	if err := ds.Get(ctx, datastore.NameKey(credentialsEntity, credentialsID, nil), userCreds); err != nil {
+	userCreds, err := loadUserCredentials(ctx, ds, account, primary)
+	if err != nil {
 		return fmt.Errorf("failed to get user token: %w", err)
 	}
+	if health.dmPermissionMissing(userCreds.Token) || health.isReauthNeeded(account, userCreds.Token) {
+		// Already reported, wait for the bot account to be re-authorized.
+		return nil
+	}
 
-	appCreds, err := creds(ctx)
+	appCreds, err := clients.appCredentials(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get app credentials: %w", err)
 	}
 
-	twClient := twitterClient(&appCreds, userCreds)
+	httpClient, twClient := clients.twitterClient(account, appCreds, *userCreds)
 
-	sheetsService, err := sheets.NewService(ctx)
+	store, err := newStore(ctx, cfg, sheetName)
 	if err != nil {
-		return fmt.Errorf("failed to create sheets service: %w", err)
+		return err
+	}
+	defer store.Close()
+	locked := newLockedStore(store)
+	store = locked
+	if !cfg.DryRun {
+		store = newRecordingStore(store, recentEvents)
+		if cfg.SaveWebhookURL != "" {
+			store = newWebhookStore(store, cfg.SaveWebhookURL, cfg.SaveWebhookTimeout)
+		}
 	}
 
-	lastTweetID, err := lastStoredTweetIDPerUser(ctx, sheetsService, spreadsheetID.Text, senderWhitelist)
+	stored, err := locked.loadStoredState(ctx, cfg, senderWhitelist, senderSpreadsheets)
 	if err != nil {
-		return fmt.Errorf("getting last stored tweet ID: %w", err)
+		return err
 	}
+	lastTweetID := stored.lastTweetID
 
 	needLastTweet := map[string]bool{}
 	for id := range lastTweetID {
 		needLastTweet[id] = true
 	}
 
+	scope := cursorScope(account, primary)
+	dmCursor, err := loadDMCursor(ctx, ds, scope)
+	if err != nil {
+		return fmt.Errorf("loading DM cursor: %w", err)
+	}
+	senderCursors, err := loadSenderCursors(ctx, ds, scope, senderWhitelist, dmCursor.LastEventID)
+	if err != nil {
+		return fmt.Errorf("loading sender DM cursors: %w", err)
+	}
+	// Paging can stop once it's past the cursors of all senders.
+	stopAt := oldestCursor(senderCursors)
+	// Newest event seen in this poll, becomes the global cursor once
+	// everything is written.
+	newestEventID := ""
+	// Newest event of each sender, becomes their cursor once their rows are
+	// written.
+	newestBySender := map[string]string{}
+	// Senders with events newer than the cursor. We still need to page back
+	// to their last stored tweet so that notes sent after it land in its row.
+	newSenders := map[string]bool{}
+
+	var shorteners *shortenerResolver
+	if cfg.ResolveShorteners {
+		shorteners = newShortenerResolver()
+	}
+
 	events := []twitter.DirectMessageEvent{}
 	cursor := ""
-	for {
-		resp, httpResp, err := twClient.DirectMessages.EventsList(&twitter.DirectMessageEventsListParams{Cursor: cursor, Count: 50})
-		log.Printf("%s", stringify(httpResp))
-		log.Printf("%s", stringify(resp))
+	useV2 := false
+	pager := newDMPager(cfg.MaxDMPages)
+	for pager.canFetch(cursor) {
+		var resp *twitter.DirectMessageEvents
+		var httpResp *http.Response
+		if useV2 {
+			resp, httpResp, err = eventsListV2(httpClient, cursor)
+		} else {
+			resp, httpResp, err = twClient.DirectMessages.EventsList(&twitter.DirectMessageEventsListParams{Cursor: cursor, Count: 50})
+			if err != nil && cursor == "" && cfg.DMv2Fallback && isV1DMDeprecatedError(err) {
+				log.Printf("v1.1 DM events endpoint is unavailable (%s), falling back to the v2 endpoint", err)
+				useV2 = true
+				continue
+			}
+		}
+		logDebug(logFields{"cursor": cursor}, "DM events response: %s %s", stringify(httpResp), stringify(resp))
 		if err != nil {
-			if apiError, ok := err.(twitter.APIError); ok {
-				if len(apiError.Errors) > 0 && apiError.Errors[0].Code == 88 {
-					// Throttled
-					log.Printf("Throttled, sleeping for a bit")
-					time.Sleep(15 * time.Minute)
-					continue
+			if isThrottled(err, httpResp) {
+				metrics.Throttles++
+				wait := throttleWait(httpResp, time.Now())
+				log.Printf("Throttled (%s), sleeping for %s", err, wait)
+				if err := sleepContext(ctx, wait); err != nil {
+					return fmt.Errorf("waiting for the rate limit to reset: %w", err)
 				}
+				continue
+			}
+			if isAuthError(err) {
+				// Confirm with a request that needs nothing but valid
+				// credentials before asking for a new login.
+				verifyAccount(ctx, ds, account, primary, health)
+				return fmt.Errorf("failed to fetch DMs: %w", err)
+			}
+			if isDMPermissionError(err) {
+				health.setDMPermissionMissing(userCreds.Token)
+				return fmt.Errorf("%s: %w", dmPermissionMessage, err)
 			}
 			return fmt.Errorf("failed to fetch DMs: %w", err)
 		}
+		if resp == nil {
+			return fmt.Errorf("failed to fetch DMs: empty response")
+		}
+		if cfg.RecordResponses {
+			recordResponse(ctx, ds, recordedEventsList, fmt.Sprint(time.Now().UnixNano()), resp)
+		}
 		cursor = resp.NextCursor
+		metrics.EventsFetched += int64(len(resp.Events))
 
-		log.Printf("Got %d events", len(resp.Events))
+		if remaining, ok := rateLimitRemaining(httpResp); ok {
+			log.Printf("Got %d events, %d requests left in the rate limit window", len(resp.Events), remaining)
+		} else {
+			log.Printf("Got %d events", len(resp.Events))
+		}
+		newEvents, more := pager.page(resp)
 
-		for _, e := range resp.Events {
-			log.Printf("%s", e.ID)
+		crossedDMCursor := false
+		for _, e := range newEvents {
+			logDebug(logFields{"event_id": e.ID}, "Got DM event")
+			if eventIDLess(newestEventID, e.ID) {
+				newestEventID = e.ID
+			}
+			if stopAt != "" && !eventIDLess(stopAt, e.ID) {
+				crossedDMCursor = true
+			}
 			if e.Type != "message_create" {
 				continue
 			}
@@ -149,169 +382,352 @@ func pollDMsOnce(ctx context.Context, ds *datastore.Client) error {
 			if !ok {
 				continue
 			}
-			if lastTweetID[e.Message.SenderID].ID != "" && !needLastTweet[e.Message.SenderID] {
-				// Already reached the last recorded tweet for this sender
-				continue
+			senderCursor := senderCursors[e.Message.SenderID]
+			if senderCursor == "" || eventIDLess(senderCursor, e.ID) {
+				newSenders[e.Message.SenderID] = true
+			}
+			if eventIDLess(newestBySender[e.Message.SenderID], e.ID) {
+				newestBySender[e.Message.SenderID] = e.ID
+			}
+			if shorteners != nil {
+				shorteners.resolveMessageURLs(ctx, e.Message)
 			}
 			events = append(events, e)
 
-			tid := tweetIDFromDM(e.Message)
-			if tid != "" && tid == lastTweetID[e.Message.SenderID].ID {
-				delete(needLastTweet, e.Message.SenderID)
+			for _, tid := range tweetIDsFromDM(e.Message) {
+				if tid == lastTweetID[e.Message.SenderID].ID {
+					delete(needLastTweet, e.Message.SenderID)
+				}
 			}
 		}
 
-		if cursor == "" {
+		if !more {
+			break
+		}
+		// Events can come slightly out of order, so the rest of the page is
+		// still processed after crossing the cursor, and we only stop at a
+		// page boundary.
+		if crossedDMCursor && !needAnyLastTweet(newSenders, needLastTweet) {
+			log.Printf("Reached DM cursor %s, stopping", stopAt)
 			break
 		}
 	}
 	log.Printf("DMs fetched")
 
-	sort.Slice(events, func(i, j int) bool {
-		a := events[i].CreatedAt
-		b := events[j].CreatedAt
-		if len(a) != len(b) {
-			return len(a) < len(b)
+	// Fetching DMs can take a while, especially when throttled. Re-read the
+	// whitelist so that senders removed in the meantime aren't written.
+	currentWhitelist, _, err := loadWhitelist(ctx, ds, vars, spreadsheetID.Text)
+	if err != nil {
+		return fmt.Errorf("re-fetching whitelist: %w", err)
+	}
+	p, err := newEventProcessor(ctx, ds, account, cfg, httpClient, twClient, store, stored, metrics)
+	if err != nil {
+		return err
+	}
+	p.processed = recentEvents
+	p.senderCursors = senderCursors
+	p.advanceCursor = func(ctx context.Context, sender string, eventID string) error {
+		return advanceDMCursor(ctx, ds, scope, sender, eventID)
+	}
+	p.process(ctx, events, senderWhitelist, currentWhitelist, senderSpreadsheets)
+	updated, appended, failed, flushErr := store.Flush(ctx)
+	metrics.TweetsUpdated += int64(updated)
+	metrics.TweetsAppended += int64(appended)
+	// Failures are collected so that the other senders still get their
+	// cursors moved, and returned together at the end.
+	errs := multiError{}
+	errs.add(flushErr)
+	if !cfg.DryRun {
+		errs.add(advanceSenderCursors(ctx, newestBySender, p.retryFrom, senderSpreadsheets, failed, p.advanceCursor))
+	}
+	if err := errs.err(); err != nil {
+		// The global cursor stays behind the senders that failed.
+		return err
+	}
+	if !cfg.DryRun {
+		// Senders without a cursor of their own fall back to the global
+		// one, so it stays behind their tweets to retry too.
+		for _, eventID := range p.retryFrom {
+			newestEventID = capCursor(newestEventID, eventID)
+		}
+		if err := advanceDMCursor(ctx, ds, scope, "", newestEventID); err != nil {
+			return fmt.Errorf("updating DM cursor: %w", err)
 		}
-		return a < b
-	})
-	eventsBySender := map[string][]twitter.DirectMessageEvent{}
-	for _, e := range events {
-		eventsBySender[e.Message.SenderID] = append(eventsBySender[e.Message.SenderID], e)
 	}
+	health.recordSuccess(len(events))
+	health.clearReauthNeeded(account)
+	return nil
+}
 
-	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text)
-	if err != nil {
-		return fmt.Errorf("getting spreadsheet header: %w", err)
+// advanceSenderCursors moves the cursor of each sender to their newest
+// event, or to the one before their first group to retry (see
+// eventProcessor.retryFrom). Senders whose spreadsheet failed keep their
+// cursor, so their tweets are retried on the next poll without affecting
+// anyone else.
+func advanceSenderCursors(ctx context.Context, newestBySender map[string]string, retryFrom map[string]string, senderSpreadsheets map[string]string, failed map[string]bool, advance func(ctx context.Context, sender string, eventID string) error) error {
+	errs := multiError{}
+	for sender, eventID := range newestBySender {
+		if failed[senderSpreadsheets[sender]] {
+			continue
+		}
+		if eventID = capCursor(eventID, retryFrom[sender]); eventID == "" {
+			continue
+		}
+		if err := advance(ctx, sender, eventID); err != nil {
+			errs.add(fmt.Errorf("updating DM cursor of %s: %w", sender, err))
+		}
 	}
+	return errs.err()
+}
 
-	for sender, events := range eventsBySender {
-		for _, group := range groupDMsPerTweet(events) {
-			data := map[string]interface{}{
-				"sender_id":       sender,
-				"sender_username": senderWhitelist[sender],
-			}
-			if len(group) == 0 {
-				log.Printf("Error: empty group. Sender ID: %s, Events: %s", sender, stringify(events))
-				continue
-			}
-			tweetID := tweetIDFromDM(group[0].Message)
-			if tweetID == "" {
-				log.Printf("Error: missing tweetID in the first message. Sender ID: %s, Group: %s", sender, stringify(group))
-				continue
-			}
-			if tweetID == lastTweetID[sender].ID {
-				if err := json.Unmarshal([]byte(lastTweetID[sender].JSON), &data); err != nil {
-					log.Printf("Failed to parse JSON from the spreadsheet: %s\nJSON: %q\nRow number: %d", err, lastTweetID[sender].JSON, lastTweetID[sender].Row)
-					continue
-				}
-				data["notes"] = groupToNotes(group, tweetID)
-				row, err := tweetToRow(data, header)
-				if err != nil {
-					log.Printf("Failed to convert data for tweet %s into a row: %s", tweetID, err)
-					continue
-				}
-				_, err = sheetsService.Spreadsheets.Values.Update(spreadsheetID.Text, fmt.Sprintf("Tweets!R%dC1:R%d", lastTweetID[sender].Row, lastTweetID[sender].Row), &sheets.ValueRange{
-					Values: [][]interface{}{row},
-				}).ValueInputOption("USER_ENTERED").Do()
-				if err != nil {
-					return fmt.Errorf("updating row %d: %w", lastTweetID[sender].Row, err)
-				}
-				log.Printf("updated row %d", lastTweetID[sender].Row)
-				continue
-			}
-			id, err := strconv.ParseInt(tweetID, 10, 64)
-			if err != nil {
-				log.Printf("Failed to parse tweet ID %q as int64: %s", tweetID, err)
-				continue
-			}
+// hashtags returns the lowercased hashtags of the tweet without the leading
+// "#", in order of appearance and without duplicates.
+func hashtags(tweet *twitter.Tweet) []string {
+	r := []string{}
+	if tweet.Entities == nil {
+		return r
+	}
+	seen := map[string]bool{}
+	for _, h := range tweet.Entities.Hashtags {
+		t := strings.ToLower(h.Text)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		r = append(r, t)
+	}
+	return r
+}
 
-			tweet, _, err := twClient.Statuses.Show(id, &twitter.StatusShowParams{IncludeEntities: twitter.Bool(true), TweetMode: "extended"})
-			if err != nil {
-				log.Printf("Failed to fetch tweet %s: %s", tweetID, err)
-				continue
-			}
+// tweetText returns the text of the tweet. Tweets are fetched in extended
+// mode, where FullText holds the whole text and Text is usually empty, so
+// Text is only used if FullText is missing.
+func tweetText(tweet *twitter.Tweet) string {
+	if tweet.FullText != "" {
+		return tweet.FullText
+	}
+	if tweet.Text == "" {
+		logWarning(logFields{"tweet_id": tweet.IDStr}, "Tweet has no text")
+	}
+	return tweet.Text
+}
 
-			data["notes"] = groupToNotes(group, tweetID)
-			updateComputedFields(data, tweet)
+// expandedText returns the tweet text with t.co links replaced by the URLs
+// they point to.
+func expandedText(tweet *twitter.Tweet) string {
+	text := tweetText(tweet)
+	if tweet.Entities == nil {
+		return text
+	}
+	return expandURLs(text, tweet.Entities.Urls)
+}
 
-			row, err := tweetToRow(data, header)
-			if err != nil {
-				log.Printf("Failed to convert data for tweet %s into a row: %s", tweetID, err)
-				continue
-			}
-			_, err = sheetsService.Spreadsheets.Values.Append(spreadsheetID.Text, "Tweets", &sheets.ValueRange{
-				Values: [][]interface{}{row},
-			}).ValueInputOption("USER_ENTERED").Do()
-			if err != nil {
-				return fmt.Errorf("appending tweet %s: %w", tweetID, err)
+func tweetURL(tweet *twitter.Tweet) string {
+	if tweet.User == nil {
+		return fmt.Sprintf("https://twitter.com/i/status/%s", tweet.IDStr)
+	}
+	return fmt.Sprintf("https://twitter.com/%s/status/%s", tweet.User.ScreenName, tweet.IDStr)
+}
+
+// mediaURLs returns the URLs of the photos, videos and GIFs attached to the
+// tweet. For videos and GIFs it picks the highest-bitrate MP4 variant.
+func mediaURLs(tweet *twitter.Tweet) []string {
+	// extended_entities lists all attached media, entities only the first
+	// photo, so prefer the former when present.
+	var media []twitter.MediaEntity
+	if tweet.ExtendedEntities != nil && len(tweet.ExtendedEntities.Media) > 0 {
+		media = tweet.ExtendedEntities.Media
+	} else if tweet.Entities != nil {
+		media = tweet.Entities.Media
+	}
+
+	r := []string{}
+	seen := map[string]bool{}
+	for _, m := range media {
+		u := mediaEntityURL(m)
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		r = append(r, u)
+	}
+	return r
+}
+
+// mediaEntityURL returns the URL of a photo, or of the highest bitrate MP4
+// variant of a video or GIF.
+func mediaEntityURL(m twitter.MediaEntity) string {
+	u := m.MediaURLHttps
+	switch m.Type {
+	case "video", "animated_gif":
+		best := -1
+		for _, v := range m.VideoInfo.Variants {
+			if v.ContentType == "video/mp4" && v.Bitrate > best {
+				best = v.Bitrate
+				u = v.URL
 			}
 		}
 	}
-	return nil
+	return u
 }
 
-func updateComputedFields(data map[string]interface{}, tweet *twitter.Tweet) {
-	text := tweet.Text
-	if text == "" {
-		text = tweet.FullText
+func needAnyLastTweet(senders map[string]bool, needLastTweet map[string]bool) bool {
+	for sender := range senders {
+		if needLastTweet[sender] {
+			return true
+		}
 	}
-	data["text"], data["mentions"] = splitTweetText(expandURLs(text, tweet.Entities.Urls))
-	data["tweet"] = tweet
-	data["url"] = fmt.Sprintf("https://twitter.com/%s/status/%s", tweet.User.ScreenName, tweet.IDStr)
+	return false
 }
 
-func getSheetHeader(ctx context.Context, sheetsService *sheets.Service, spreadsheetID string) ([]string, error) {
-	sheet, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID, "Tweets!1:1").MajorDimension("ROWS").Do()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get the values from spreadsheet: %w", err)
+// instanceID identifies the instance writing a row. It's recorded only when
+// the row is appended, so rebuilds keep the original value.
+func instanceID(cfg *Config) string {
+	if cfg.InstanceID != "" {
+		return cfg.InstanceID
 	}
+	return strings.Trim(os.Getenv("GAE_VERSION")+"/"+os.Getenv("GAE_INSTANCE"), "/")
+}
 
-	if len(sheet.Values) < 1 {
-		return nil, fmt.Errorf("header row in the spreadsheet is empty")
+// archivedAt is the time a row is queued for writing, for the archived_at
+// field. Like instance_id it's only set on append, so rebuilds and notes
+// updates keep the original value.
+func archivedAt(now time.Time) string {
+	return now.UTC().Format(time.RFC3339)
+}
+
+// ageAtSave returns how old the tweet is at time now in a compact form like
+// "2h" or "3d". Since it's relative to the moment of saving, it's only set on
+// append and never recomputed during rebuild.
+func ageAtSave(tweet *twitter.Tweet, now time.Time) (string, error) {
+	createdAt, err := tweet.CreatedAtTime()
+	if err != nil {
+		return "", err
+	}
+	age := now.Sub(createdAt)
+	if age < 0 {
+		// Clock skew between us and Twitter.
+		age = 0
+	}
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%ds", int(age/time.Second)), nil
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age/time.Minute)), nil
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(age/time.Hour)), nil
+	default:
+		return fmt.Sprintf("%dd", int(age/(24*time.Hour))), nil
 	}
+}
 
-	header := []string{}
-	for _, v := range sheet.Values[0] {
-		header = append(header, fmt.Sprint(v))
+// updateSubmittedAt sets submitted_at from the creation time of the first DM
+// in the group, stored in dm_created_at. Rows saved before dm_created_at was
+// recorded are left alone.
+func updateSubmittedAt(data map[string]interface{}) {
+	createdAt, ok := data["dm_created_at"].(string)
+	if !ok || createdAt == "" {
+		return
+	}
+	ms, err := strconv.ParseInt(createdAt, 10, 64)
+	if err != nil {
+		log.Printf("Failed to parse DM timestamp %q: %s", createdAt, err)
+		delete(data, "submitted_at")
+		return
 	}
-	return header, nil
+	data["submitted_at"] = time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
 }
 
-type storedTweetInfo struct {
-	ID   string
-	Row  int
-	JSON string
+// sortEventsByTime sorts events oldest first. DMs sent within the same
+// millisecond are ordered by their IDs, which increase over time, so that a
+// note stays after the link it belongs to.
+func sortEventsByTime(events []twitter.DirectMessageEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.CreatedAt != b.CreatedAt {
+			return eventIDLess(a.CreatedAt, b.CreatedAt)
+		}
+		return eventIDLess(a.ID, b.ID)
+	})
 }
 
-func lastStoredTweetIDPerUser(ctx context.Context, sheetsService *sheets.Service, spreadsheetID string, senderWhitelist map[string]string) (map[string]storedTweetInfo, error) {
-	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID)
+// loadWhitelistVariables reads the whitelist from runtime config variables
+// named whitelist/<username>, which hold the sender ID, optionally followed
+// by "|<spreadsheet ID>".
+func loadWhitelistVariables(ctx context.Context, vars *runtimeconfig.ProjectsConfigsVariablesService, defaultSpreadsheetID string) (map[string]string, map[string]string, error) {
+	entries, err := listVariables(ctx, vars, "whitelist/")
 	if err != nil {
-		return nil, fmt.Errorf("getting sheet header: %w", err)
+		return nil, nil, err
 	}
+	usernames := map[string]string{}
+	spreadsheets := map[string]string{}
+	for username, v := range entries {
+		id, ssID := v, ""
+		if i := strings.Index(v, "|"); i >= 0 {
+			id, ssID = v[:i], v[i+1:]
+		}
+		id, ssID = strings.TrimSpace(id), strings.TrimSpace(ssID)
+		if ssID == "" {
+			ssID = defaultSpreadsheetID
+		}
+		usernames[id] = username
+		spreadsheets[id] = ssID
+	}
+	return usernames, spreadsheets, nil
+}
 
-	jsonColumnNumber := -1
-	for i, h := range header {
-		if h == "json" {
-			jsonColumnNumber = i
+// sendersBySpreadsheet splits the whitelist by target spreadsheet.
+func sendersBySpreadsheet(senderWhitelist map[string]string, senderSpreadsheets map[string]string) map[string]map[string]string {
+	r := map[string]map[string]string{}
+	for id, username := range senderWhitelist {
+		ssID := senderSpreadsheets[id]
+		if r[ssID] == nil {
+			r[ssID] = map[string]string{}
 		}
+		r[ssID][id] = username
 	}
+	return r
+}
+
+type storedTweetInfo struct {
+	ID   string
+	Row  int
+	JSON string
+}
+
+// lastStoredTweetIDPerUser returns the last tweet stored in the sheet for
+// each whitelisted sender, and the IDs of all tweets stored for each of them.
+// If allIDs is not nil, it is also filled with the IDs of all tweets in the
+// sheet.
+func lastStoredTweetIDPerUser(ctx context.Context, sheetsService *sheets.Service, spreadsheetID string, sheetName string, header []string, senderWhitelist map[string]string, allIDs map[string]bool) (map[string]storedTweetInfo, map[string]map[string]bool, error) {
+	jsonColumnNumber := jsonColumn(header)
 	if jsonColumnNumber < 0 {
-		return nil, fmt.Errorf("missing \"json\" column in the spreadsheet")
+		return nil, nil, fmt.Errorf("missing \"json\" column in the spreadsheet")
 	}
 
-	jsonValues, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID, fmt.Sprintf("Tweets!R2C%d:C%d", jsonColumnNumber+1, jsonColumnNumber+1)).MajorDimension("COLUMNS").Do()
+	jsonValues, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID, sheetRange(sheetName, fmt.Sprintf("R2C%d:C%d", jsonColumnNumber+1, jsonColumnNumber+1))).MajorDimension("COLUMNS").Do()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get \"json\" column from spreadsheet: %w", err)
+		return nil, nil, fmt.Errorf("failed to get \"json\" column from spreadsheet: %w", err)
 	}
 
 	if len(jsonValues.Values) <= 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
+	rows := []storedTweetInfo{}
+	for i, v := range jsonValues.Values[0] {
+		rows = append(rows, storedTweetInfo{Row: i + 2, JSON: fmt.Sprint(v)})
+	}
+	return lastStoredTweets(rows, senderWhitelist, allIDs)
+}
+
+// lastStoredTweets does the work of lastStoredTweetIDPerUser given the json
+// column of all rows, in order. Only Row and JSON of rows need to be set.
+func lastStoredTweets(rows []storedTweetInfo, senderWhitelist map[string]string, allIDs map[string]bool) (map[string]storedTweetInfo, map[string]map[string]bool, error) {
 	r := map[string]storedTweetInfo{}
+	senderIDs := map[string]map[string]bool{}
 
-	for i := len(jsonValues.Values[0]) - 1; i >= 0; i-- {
-		s := fmt.Sprint(jsonValues.Values[0][i])
+	for i := len(rows) - 1; i >= 0; i-- {
+		s := rows[i].JSON
 		j := struct {
 			SenderID string `json:"sender_id"`
 			Tweet    struct {
@@ -319,61 +735,180 @@ func lastStoredTweetIDPerUser(ctx context.Context, sheetsService *sheets.Service
 			} `json:"tweet"`
 		}{}
 		if err := json.Unmarshal([]byte(s), &j); err != nil {
-			return nil, fmt.Errorf("unmarshaling last stored tweet: %w", err)
+			if len(r) == len(senderWhitelist) {
+				// Only collecting IDs at this point, skip the broken row.
+				continue
+			}
+			return nil, nil, fmt.Errorf("unmarshaling last stored tweet: %w", err)
 		}
-		if r[j.SenderID].ID != "" {
-			continue
+		if allIDs != nil && j.Tweet.ID != "" {
+			allIDs[j.Tweet.ID] = true
 		}
 		if _, ok := senderWhitelist[j.SenderID]; !ok {
 			continue
 		}
-
-		r[j.SenderID] = storedTweetInfo{ID: j.Tweet.ID, Row: i + 2, JSON: s}
-
-		if len(r) == len(senderWhitelist) {
-			break
+		if senderIDs[j.SenderID] == nil {
+			senderIDs[j.SenderID] = map[string]bool{}
 		}
+		senderIDs[j.SenderID][j.Tweet.ID] = true
+		if r[j.SenderID].ID != "" {
+			continue
+		}
+
+		r[j.SenderID] = storedTweetInfo{ID: j.Tweet.ID, Row: rows[i].Row, JSON: s}
 	}
-	return r, nil
+	return r, senderIDs, nil
 }
 
-var tweetIDRe = regexp.MustCompile("^https://twitter.com/[^/]+/status/([0-9]+)([^0-9].*)?$")
+// tweetIDRe matches tweet URLs on twitter.com and x.com, including their www.
+// and mobile. subdomains.
+var tweetIDRe = regexp.MustCompile(`^https://(?:(?:www|mobile)\.)?(?:twitter|x)\.com/[^/]+/status/([0-9]+)([^0-9].*)?$`)
 
+// tweetIDFromDM returns the first tweet ID linked in the message.
 func tweetIDFromDM(msg *twitter.DirectMessageEventMessage) string {
-	for _, u := range msg.Data.Entities.Urls {
+	ids := tweetIDsFromDM(msg)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+// tweetIDsFromDM returns the IDs of all tweets linked in the message, in the
+// order they appear, without duplicates.
+func tweetIDsFromDM(msg *twitter.DirectMessageEventMessage) []string {
+	r := []string{}
+	seen := map[string]bool{}
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			r = append(r, id)
+		}
+	}
+	for _, u := range messageURLs(msg) {
 		m := tweetIDRe.FindStringSubmatch(u.ExpandedURL)
 		if m == nil {
 			continue
 		}
+		add(m[1])
+	}
+	if len(messageURLs(msg)) == 0 {
+		for _, m := range textTweetURLRe.FindAllStringSubmatch(msg.Data.Text, -1) {
+			add(m[1])
+		}
+	}
+	add(attachmentTweetID(msg))
+	for _, cta := range msg.Data.CTAs {
+		if m := tweetIDRe.FindStringSubmatch(cta.URL); m != nil {
+			add(m[1])
+		}
+	}
+	return r
+}
+
+// textTweetURLRe finds tweet URLs in message text, for messages where
+// Twitter didn't populate the URL entities.
+var textTweetURLRe = regexp.MustCompile(`https://(?:(?:www|mobile)\.)?(?:twitter|x)\.com/[^/\s]+/status/([0-9]+)[^\s]*`)
+
+func messageURLs(msg *twitter.DirectMessageEventMessage) []twitter.URLEntity {
+	if msg.Data.Entities == nil {
+		return nil
+	}
+	return msg.Data.Entities.Urls
+}
+
+// attachmentTweetID returns the ID of the tweet shared as a card attachment,
+// which is how the Twitter app sends a tweet shared into a DM, rather than
+// as a typed-out URL.
+func attachmentTweetID(msg *twitter.DirectMessageEventMessage) string {
+	a := msg.Data.Attachment
+	if a == nil {
+		return ""
+	}
+	if m := tweetIDRe.FindStringSubmatch(a.Media.ExpandedURL); m != nil {
 		return m[1]
 	}
-	return ""
+	return a.Media.SourceStatusIDStr
+}
+
+type dmGroup struct {
+	TweetID string
+	Events  []twitter.DirectMessageEvent
+}
+
+// linkEventID returns the ID of the DM that links the group's tweet. Unlike
+// the first DM of the group, it doesn't depend on how many of the DMs
+// before it were fetched.
+func (g dmGroup) linkEventID() string {
+	for _, e := range g.Events {
+		for _, id := range tweetIDsFromDM(e.Message) {
+			if id == g.TweetID {
+				return e.ID
+			}
+		}
+	}
+	return g.Events[0].ID
 }
 
-func groupDMsPerTweet(ms []twitter.DirectMessageEvent) [][]twitter.DirectMessageEvent {
-	r := [][]twitter.DirectMessageEvent{}
-	group := []twitter.DirectMessageEvent{}
+// groupDMsPerTweet splits messages into groups, one per linked tweet. A
+// message linking several tweets starts a group for each of them, messages
+// without links are added to the preceding group. Messages before the first
+// link end up in a group with an empty TweetID.
+//
+// With NotesBeforeLink, messages without links are added to the following
+// group instead, ahead of the link. Messages after the last link still go to
+// the preceding group, as there's nothing else to attach them to.
+//
+// With SaveDMAttachments, a message with media attached to it natively
+// starts a group of its own, as if it linked a tweet (see dmAttachmentID).
+func groupDMsPerTweet(ms []twitter.DirectMessageEvent, cfg *Config) []dmGroup {
+	r := []dmGroup{}
+	pending := []twitter.DirectMessageEvent{}
 	for _, e := range ms {
-		if tweetIDFromDM(e.Message) != "" {
-			if len(group) > 0 {
-				r = append(r, group)
+		ids := tweetIDsFromDM(e.Message)
+		if len(ids) == 0 && cfg.SaveDMAttachments && dmMediaURL(e.Message) != "" {
+			ids = []string{dmAttachmentID(e)}
+		}
+		if len(ids) == 0 {
+			if cfg.NotesBeforeLink {
+				pending = append(pending, e)
+				continue
 			}
-			group = []twitter.DirectMessageEvent{e}
-		} else {
-			group = append(group, e)
+			if len(r) == 0 {
+				r = append(r, dmGroup{})
+			}
+			r[len(r)-1].Events = append(r[len(r)-1].Events, e)
+			continue
+		}
+		for i, id := range ids {
+			g := dmGroup{TweetID: id}
+			if i == 0 {
+				g.Events = append(pending, e)
+				pending = []twitter.DirectMessageEvent{}
+			} else {
+				g.Events = []twitter.DirectMessageEvent{e}
+			}
+			r = append(r, g)
 		}
 	}
-	if len(group) > 0 {
-		r = append(r, group)
+	if len(pending) > 0 {
+		if len(r) == 0 {
+			r = append(r, dmGroup{})
+		}
+		r[len(r)-1].Events = append(r[len(r)-1].Events, pending...)
 	}
 	return r
 }
 
+// groupToNotes joins the text of the DMs in the group, without the link to
+// the tweet. DMs left empty, such as the one with just the link, are dropped,
+// and so is a DM that repeats the one before it. Blank lines within a DM are
+// kept.
 func groupToNotes(group []twitter.DirectMessageEvent, tweetID string) string {
 	lines := []string{}
 	for _, e := range group {
 		line := e.Message.Data.Text
-		for _, u := range e.Message.Data.Entities.Urls {
+		urls := messageURLs(e.Message)
+		for _, u := range urls {
 			replacement := u.ExpandedURL
 			m := tweetIDRe.FindStringSubmatch(u.ExpandedURL)
 			if m != nil && m[1] == tweetID {
@@ -381,11 +916,46 @@ func groupToNotes(group []twitter.DirectMessageEvent, tweetID string) string {
 			}
 			line = strings.ReplaceAll(line, u.URL, replacement)
 		}
+		if len(urls) == 0 {
+			line = textTweetURLRe.ReplaceAllStringFunc(line, func(u string) string {
+				if textTweetURLRe.FindStringSubmatch(u)[1] == tweetID {
+					return ""
+				}
+				return u
+			})
+		}
+		if a := e.Message.Data.Attachment; a != nil && a.Media.URL != "" && (attachmentTweetID(e.Message) == tweetID || dmAttachmentID(e) == tweetID) {
+			line = strings.ReplaceAll(line, a.Media.URL, "")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || (len(lines) > 0 && lines[len(lines)-1] == line) {
+			continue
+		}
 		lines = append(lines, line)
 	}
 	return strings.Join(lines, "\n")
 }
 
+// textColumns hold free-form, often multiline text. Rows are written with
+// USER_ENTERED so that URLs become links, which would also turn text starting
+// with "=", "+" or "-" into a formula or a number. Prefixing these columns
+// with an apostrophe makes Sheets store them as is, newlines included,
+// without showing the apostrophe.
+var textColumns = map[string]bool{
+	"text":             true,
+	"notes":            true,
+	"quoted_text":      true,
+	"in_reply_to_text": true,
+}
+
+// literalText prepares s to be written to a text column.
+func literalText(s string) string {
+	if s == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "\r\n", "\n")
+}
+
 func tweetToRow(data map[string]interface{}, header []string) ([]interface{}, error) {
 	b, err := json.Marshal(data)
 	if err != nil {
@@ -395,97 +965,147 @@ func tweetToRow(data map[string]interface{}, header []string) ([]interface{}, er
 	if err := json.Unmarshal(b, &converted); err != nil {
 		return nil, fmt.Errorf("unmarshaling data: %s", err)
 	}
+	jsonCell := string(b)
+	if utf8.RuneCount(b) > maxCellLength {
+		jsonCell = string(truncatedJSON(data, b))
+	}
 
-	lookup := func(field string) string {
+	value := func(field string) interface{} {
 		var cur interface{} = converted
 		parts := strings.Split(field, ".")
 		for _, part := range parts {
 			m, ok := cur.(map[string]interface{})
 			if !ok {
-				return ""
+				return nil
 			}
 			cur = m[part]
 		}
-		if cur == nil {
+		return cur
+	}
+	lookup := func(field string) string {
+		v := value(field)
+		if v == nil {
 			return ""
 		}
-		return fmt.Sprint(cur)
+		return fmt.Sprint(v)
 	}
 
 	r := []interface{}{}
 	for _, field := range header {
 		if field == "json" {
-			r = append(r, string(b))
+			r = append(r, jsonCell)
 			continue
 		}
-		r = append(r, lookup(field))
+		if t, ok := columnTransformers[field]; ok {
+			r = append(r, t(value(field)))
+			continue
+		}
+		if textColumns[field] {
+			r = append(r, literalText(truncateCell(field, lookup(field))))
+			continue
+		}
+		if displayLocation != time.UTC && isTimestampColumn(field) {
+			r = append(r, localTimestamp(lookup(field), displayLocation))
+			continue
+		}
+		r = append(r, truncateCell(field, lookup(field)))
 	}
 	return r, nil
 }
 
+var retweetPrefixRe = regexp.MustCompile(`^RT @([A-Za-z0-9_]+): `)
+
+// splitRetweetPrefix splits the "RT @user: " that starts the text of a
+// retweet from the retweeted text, returning the text and the user.
+func splitRetweetPrefix(s string) (string, string) {
+	m := retweetPrefixRe.FindStringSubmatch(s)
+	if m == nil {
+		return s, ""
+	}
+	return s[len(m[0]):], m[1]
+}
+
 func splitTweetText(s string) (string, string) {
 	re := regexp.MustCompile("^(@[^ ]+ )+")
 	mentions := re.FindString(s)
 	return strings.TrimPrefix(s, mentions), strings.TrimSpace(mentions)
 }
 
-func rebuildSpreadsheet(ctx context.Context) error {
+// rebuildSpreadsheet recomputes all rows of the default spreadsheet from
+// their json column. Rows that fail to rebuild are written back unchanged and
+// counted as skipped.
+func rebuildSpreadsheet(ctx context.Context) (rebuilt int, skipped int, err error) {
 	rcService, err := runtimeconfig.NewService(ctx)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	vars := rcService.Projects.Configs.Variables
 	spreadsheetID, err := vars.Get(fmt.Sprintf("projects/%s/configs/prod/variables/%s", os.Getenv("GOOGLE_CLOUD_PROJECT"), "spreadsheet_id")).Do()
 	if err != nil {
-		return fmt.Errorf("fetching spreadsheet_id: %w", err)
+		return 0, 0, fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	sheetName, err := loadSheetName(vars)
+	if err != nil {
+		return 0, 0, fmt.Errorf("loading sheet name: %w", err)
 	}
 	sheetsService, err := sheets.NewService(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create sheets service: %w", err)
+		return 0, 0, fmt.Errorf("failed to create sheets service: %w", err)
 	}
 
-	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text)
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
 	if err != nil {
-		return fmt.Errorf("getting spreadsheet header: %w", err)
+		return 0, 0, fmt.Errorf("getting spreadsheet header: %w", err)
 	}
 
-	rows, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID.Text, fmt.Sprintf("Tweets!R2C1:C%d", len(header))).MajorDimension("ROWS").Do()
+	rows, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID.Text, sheetRange(sheetName, fmt.Sprintf("R2C1:C%d", len(header)))).MajorDimension("ROWS").Do()
 	if err != nil {
-		return fmt.Errorf("failed to get spreadsheet data: %w", err)
+		return 0, 0, fmt.Errorf("failed to get spreadsheet data: %w", err)
 	}
 
-	jsonColumnNumber := -1
-	for i, h := range header {
-		if h == "json" {
-			jsonColumnNumber = i
-		}
-	}
+	jsonColumnNumber := jsonColumn(header)
 	if jsonColumnNumber < 0 {
-		return fmt.Errorf("missing \"json\" column in the spreadsheet")
+		return 0, 0, fmt.Errorf("missing \"json\" column in the spreadsheet")
 	}
 
-	data := [][]interface{}{}
-	for i, row := range rows.Values {
-		updated, err := rebuildRow(row[jsonColumnNumber], header)
-		if err != nil {
-			log.Printf("Failed to rebuild row %d: %s", i+2, err)
-			data = append(data, row)
-			continue
-		}
-		data = append(data, updated)
-	}
+	data, rebuilt, skipped := rebuildRows(rows.Values, header)
 	if len(data) != len(rows.Values) {
-		return fmt.Errorf("something went wrong, len(data) != len(rows.Values): %d vs %d", len(data), len(rows.Values))
+		return 0, 0, fmt.Errorf("something went wrong, len(data) != len(rows.Values): %d vs %d", len(data), len(rows.Values))
 	}
 
-	_, err = sheetsService.Spreadsheets.Values.Update(spreadsheetID.Text, fmt.Sprintf("Tweets!R2C1:R%dC%d", len(data)+2, len(header)+1), &sheets.ValueRange{
+	_, err = sheetsService.Spreadsheets.Values.Update(spreadsheetID.Text, sheetRange(sheetName, fmt.Sprintf("R2C1:R%dC%d", len(data)+2, len(header)+1)), &sheets.ValueRange{
 		Values: data,
 	}).ValueInputOption("USER_ENTERED").Do()
 	if err != nil {
-		return fmt.Errorf("failed to update values in the spreadsheet: %s", err)
+		return 0, 0, fmt.Errorf("failed to update values in the spreadsheet: %s", err)
 	}
 
-	return nil
+	return rebuilt, skipped, nil
+}
+
+// rebuildRows rebuilds rows read from the sheet, starting at row 2. Rows
+// that can't be rebuilt are returned unchanged, and counted as skipped.
+func rebuildRows(rows [][]interface{}, header []string) (data [][]interface{}, rebuilt int, skipped int) {
+	jsonColumnNumber := jsonColumn(header)
+	for i, row := range rows {
+		if jsonColumnNumber >= len(row) || row[jsonColumnNumber] == "" {
+			// A blank row inserted by hand, or one with nothing in the json
+			// column. Sheets leaves out trailing empty cells.
+			data = append(data, row)
+			skipped++
+			continue
+		}
+		updated, err := rebuildRow(row[jsonColumnNumber], header)
+		if err != nil {
+			log.Printf("Failed to rebuild row %d: %s", i+2, err)
+			data = append(data, row)
+			skipped++
+			continue
+		}
+		data = append(data, updated)
+		rebuilt++
+	}
+	return data, rebuilt, skipped
 }
 
 func rebuildRow(v interface{}, header []string) ([]interface{}, error) {
@@ -497,6 +1117,12 @@ func rebuildRow(v interface{}, header []string) ([]interface{}, error) {
 	if err := json.Unmarshal([]byte(s), &data); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal the value: %w", err)
 	}
+	updateSubmittedAt(data)
+	updateFingerprint(data)
+	if isUnavailable(data) {
+		// Nothing else to recompute without the tweet.
+		return tweetToRow(data, header)
+	}
 	b, err := json.Marshal(data["tweet"])
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal tweet: %w", err)
@@ -506,6 +1132,21 @@ func rebuildRow(v interface{}, header []string) ([]interface{}, error) {
 		return nil, fmt.Errorf("failed to unmarshal tweet: %w", err)
 	}
 	updateComputedFields(data, tweet)
+	parent, err := storedInReplyTo(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal parent tweet: %w", err)
+	}
+	applyInReplyTo(data, parent)
+	ancestors, err := storedThreadField(data, "unrolled")
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal unrolled thread: %w", err)
+	}
+	applyUnrolled(data, ancestors)
+	thread, err := storedThread(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal thread: %w", err)
+	}
+	applyThread(data, thread)
 	return tweetToRow(data, header)
 }
 
@@ -515,23 +1156,26 @@ type replacement struct {
 	text  string
 }
 
+// applyReplacements replaces ranges of s. Offsets are in UTF-16 code units,
+// which is how Twitter counts entity indices, so characters outside of the
+// BMP like emoji count as two.
 func applyReplacements(s string, rs []replacement) string {
 	var r strings.Builder
 	sort.Slice(rs, func(i, j int) bool {
 		return rs[i].start < rs[j].start
 	})
-	ss := strings.Split(s, "")
+	units := utf16.Encode([]rune(s))
 	prev := 0
 	for _, repl := range rs {
-		if repl.start < prev {
+		if repl.start < prev || repl.start > repl.end || repl.end > len(units) {
 			// Either a duplicate or some bug
 			continue
 		}
-		r.WriteString(strings.Join(ss[prev:repl.start], ""))
+		r.WriteString(string(utf16.Decode(units[prev:repl.start])))
 		r.WriteString(repl.text)
 		prev = repl.end
 	}
-	r.WriteString(strings.Join(ss[prev:], ""))
+	r.WriteString(string(utf16.Decode(units[prev:])))
 	return r.String()
 }
 
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// fetchPages pages through the responses like pollDMsOnce, and returns the
+// number of pages fetched and the IDs of the events kept.
+func fetchPages(pager *dmPager, pages map[string]*twitter.DirectMessageEvents) (int, []string) {
+	fetched := 0
+	ids := []string{}
+	cursor := ""
+	for pager.canFetch(cursor) {
+		resp := pages[cursor]
+		fetched++
+		events, more := pager.page(resp)
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		cursor = resp.NextCursor
+		if !more {
+			break
+		}
+	}
+	return fetched, ids
+}
+
+func TestDMPagerStopsAfterEmptyPages(t *testing.T) {
+	pages := map[string]*twitter.DirectMessageEvents{
+		"":  {Events: []twitter.DirectMessageEvent{{ID: "3"}}, NextCursor: "a"},
+		"a": {NextCursor: "b"},
+		"b": {Events: []twitter.DirectMessageEvent{}, NextCursor: "c"},
+		"c": {NextCursor: "d"},
+		"d": {Events: []twitter.DirectMessageEvent{{ID: "1"}}},
+	}
+	fetched, ids := fetchPages(newDMPager(0), pages)
+	if fetched != 1+maxConsecutiveEmptyPages {
+		t.Errorf("fetched %d pages, want %d", fetched, 1+maxConsecutiveEmptyPages)
+	}
+	if len(ids) != 1 || ids[0] != "3" {
+		t.Errorf("got events %v, want [3]", ids)
+	}
+}
+
+func TestDMPagerResetsEmptyPagesOnEvents(t *testing.T) {
+	pages := map[string]*twitter.DirectMessageEvents{
+		"":  {NextCursor: "a"},
+		"a": {NextCursor: "b"},
+		"b": {Events: []twitter.DirectMessageEvent{{ID: "2"}}, NextCursor: "c"},
+		"c": {NextCursor: "d"},
+		"d": {Events: []twitter.DirectMessageEvent{{ID: "1"}}},
+	}
+	fetched, ids := fetchPages(newDMPager(0), pages)
+	if fetched != 5 || len(ids) != 2 {
+		t.Errorf("fetched %d pages and events %v, want 5 pages and [2 1]", fetched, ids)
+	}
+}
+
+func TestDMPagerStopsAtRepeatedCursor(t *testing.T) {
+	pages := map[string]*twitter.DirectMessageEvents{
+		"":  {Events: []twitter.DirectMessageEvent{{ID: "4"}}, NextCursor: "a"},
+		"a": {Events: []twitter.DirectMessageEvent{{ID: "3"}}, NextCursor: "b"},
+		"b": {Events: []twitter.DirectMessageEvent{{ID: "2"}}, NextCursor: "a"},
+	}
+	fetched, ids := fetchPages(newDMPager(0), pages)
+	if fetched != 3 || len(ids) != 3 {
+		t.Errorf("fetched %d pages and events %v, want 3 pages and [4 3 2]", fetched, ids)
+	}
+}
+
+func TestDMPagerStopsAtRepeatedEvents(t *testing.T) {
+	page := []twitter.DirectMessageEvent{{ID: "2"}, {ID: "1"}}
+	pages := map[string]*twitter.DirectMessageEvents{
+		"":  {Events: page, NextCursor: "a"},
+		"a": {Events: page, NextCursor: "b"},
+		"b": {Events: []twitter.DirectMessageEvent{{ID: "0"}}},
+	}
+	fetched, ids := fetchPages(newDMPager(0), pages)
+	if fetched != 2 || len(ids) != 2 {
+		t.Errorf("fetched %d pages and events %v, want 2 pages and [2 1]", fetched, ids)
+	}
+}
+
+func TestDMPagerCapsPages(t *testing.T) {
+	pages := map[string]*twitter.DirectMessageEvents{}
+	cursor := ""
+	for i := 0; i < 10; i++ {
+		next := string(rune('a' + i))
+		pages[cursor] = &twitter.DirectMessageEvents{Events: []twitter.DirectMessageEvent{{ID: next}}, NextCursor: next}
+		cursor = next
+	}
+	if fetched, _ := fetchPages(newDMPager(4), pages); fetched != 4 {
+		t.Errorf("fetched %d pages, want 4", fetched)
+	}
+}
+
+// sharedTweetDM is a tweet shared into a DM from the Twitter app: the tweet
+// comes as a card attachment, with only its t.co link in the text.
+const sharedTweetDM = `{
+	"sender_id": "7",
+	"message_data": {
+		"text": "look at this https://t.co/abc",
+		"entities": {"urls": []},
+		"attachment": {
+			"type": "media",
+			"media": {
+				"url": "https://t.co/abc",
+				"expanded_url": "https://twitter.com/someone/status/1500000000000000001/photo/1",
+				"source_status_id_str": "1500000000000000001"
+			}
+		}
+	}
+}`
+
+func TestTweetIDFromSharedTweet(t *testing.T) {
+	msg := &twitter.DirectMessageEventMessage{}
+	if err := json.Unmarshal([]byte(sharedTweetDM), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := tweetIDFromDM(msg); got != "1500000000000000001" {
+		t.Errorf("tweetIDFromDM = %q, want 1500000000000000001", got)
+	}
+	e := twitter.DirectMessageEvent{ID: "1", Message: msg}
+	if got := groupToNotes([]twitter.DirectMessageEvent{e}, "1500000000000000001"); got != "look at this" {
+		t.Errorf("notes = %q, want the card link stripped", got)
+	}
+
+	// Cards without an expanded tweet URL still carry the source tweet.
+	msg.Data.Attachment.Media.ExpandedURL = "https://pbs.twimg.com/media/x.jpg"
+	if got := tweetIDFromDM(msg); got != "1500000000000000001" {
+		t.Errorf("tweetIDFromDM without expanded URL = %q, want 1500000000000000001", got)
+	}
+}
+
+func TestTweetIDFromCTA(t *testing.T) {
+	msg := &twitter.DirectMessageEventMessage{Data: &twitter.DirectMessageData{
+		Text: "",
+		CTAs: []twitter.DirectMessageCTA{
+			{Type: "web_url", Label: "Site", URL: "https://example.com/"},
+			{Type: "web_url", Label: "View tweet", URL: "https://twitter.com/someone/status/42"},
+		},
+	}}
+	if got := tweetIDsFromDM(msg); len(got) != 1 || got[0] != "42" {
+		t.Errorf("tweetIDsFromDM = %v, want [42]", got)
+	}
+}
+
+func TestTweetIDFromURLVariants(t *testing.T) {
+	for _, u := range []string{
+		"https://twitter.com/someone/status/42",
+		"https://www.twitter.com/someone/status/42",
+		"https://mobile.twitter.com/someone/status/42?s=20",
+		"https://x.com/someone/status/42",
+		"https://www.x.com/someone/status/42/photo/1",
+		"https://mobile.x.com/someone/status/42",
+	} {
+		e := dmEvent("1", 1000, "7", "note", "")
+		e.Message.Data.Text = "note https://t.co/x"
+		e.Message.Data.Entities.Urls = []twitter.URLEntity{{URL: "https://t.co/x", ExpandedURL: u}}
+		if got := tweetIDFromDM(e.Message); got != "42" {
+			t.Errorf("tweetIDFromDM(%s) = %q, want 42", u, got)
+		}
+		if got := groupToNotes([]twitter.DirectMessageEvent{e}, "42"); got != "note" {
+			t.Errorf("notes for %s = %q, want the link stripped", u, got)
+		}
+
+		// Without URL entities, links are found in the text.
+		e.Message.Data.Text = "note " + u
+		e.Message.Data.Entities.Urls = nil
+		if got := tweetIDFromDM(e.Message); got != "42" {
+			t.Errorf("tweetIDFromDM(%s) from text = %q, want 42", u, got)
+		}
+		if got := groupToNotes([]twitter.DirectMessageEvent{e}, "42"); got != "note" {
+			t.Errorf("notes for %s in text = %q, want the link stripped", u, got)
+		}
+	}
+	for _, u := range []string{
+		"https://xx.com/someone/status/42",
+		"https://twitter.com.evil.com/someone/status/42",
+		"http://x.com/someone/status/42",
+	} {
+		if m := tweetIDRe.FindStringSubmatch(u); m != nil {
+			t.Errorf("tweetIDRe matched %s", u)
+		}
+	}
+}
+
+func TestExpandURLsAfterEmoji(t *testing.T) {
+	// 👍 is two UTF-16 code units, so the link starts at 9, not 8.
+	text := "Good 👍 https://t.co/x and 🇺🇦 https://t.co/y!"
+	urls := []twitter.URLEntity{
+		{URL: "https://t.co/x", ExpandedURL: "https://example.com/a", Indices: twitter.Indices{8, 22}},
+		{URL: "https://t.co/y", ExpandedURL: "https://example.com/b", Indices: twitter.Indices{32, 46}},
+	}
+	want := "Good 👍 https://example.com/a and 🇺🇦 https://example.com/b!"
+	if got := expandURLs(text, urls); got != want {
+		t.Errorf("expandURLs = %q, want %q", got, want)
+	}
+
+	tweet := testTweet("100", "50", text)
+	tweet.Entities = &twitter.Entities{Urls: urls}
+	if got := expandedText(tweet); got != want {
+		t.Errorf("expandedText = %q, want %q", got, want)
+	}
+}
+
+func TestApplyReplacementsSkipsBadIndices(t *testing.T) {
+	got := applyReplacements("abc", []replacement{{1, 2, "X"}, {1, 2, "Y"}, {2, 9, "Z"}})
+	if got != "aXc" {
+		t.Errorf("applyReplacements = %q, want %q", got, "aXc")
+	}
+}
+
+func TestTweetIDFromTextWithoutEntities(t *testing.T) {
+	for _, entities := range []*twitter.Entities{nil, {}} {
+		msg := &twitter.DirectMessageEventMessage{SenderID: "7", Data: &twitter.DirectMessageData{
+			Text:     "see https://twitter.com/a/status/42?s=20 and https://twitter.com/b/status/43\nvia https://example.com",
+			Entities: entities,
+		}}
+		if got := tweetIDsFromDM(msg); len(got) != 2 || got[0] != "42" || got[1] != "43" {
+			t.Errorf("tweetIDsFromDM = %v, want [42 43]", got)
+		}
+		e := twitter.DirectMessageEvent{ID: "1", Message: msg}
+		want := "see  and https://twitter.com/b/status/43\nvia https://example.com"
+		if got := groupToNotes([]twitter.DirectMessageEvent{e}, "42"); got != want {
+			t.Errorf("notes = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestTweetToRowKeepsNewlines(t *testing.T) {
+	header := []string{"url", "text", "notes", "json"}
+	data := map[string]interface{}{"notes": "first note\r\nsecond note"}
+	updateComputedFields(data, testTweet("100", "50", "Line one\nLine two"))
+	row, err := tweetToRow(data, header)
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	if row[1] != "'Line one\nLine two" {
+		t.Errorf("text = %q, want both lines behind an apostrophe", row[1])
+	}
+	if row[2] != "'first note\nsecond note" {
+		t.Errorf("notes = %q, want both lines behind an apostrophe", row[2])
+	}
+
+	// Rebuilding the row from its json column gives the same row.
+	rebuilt, err := rebuildRow(row[3], header)
+	if err != nil {
+		t.Fatalf("rebuildRow: %s", err)
+	}
+	for i := range header[:3] {
+		if rebuilt[i] != row[i] {
+			t.Errorf("rebuilt %s = %q, want %q", header[i], rebuilt[i], row[i])
+		}
+	}
+}
+
+func TestSortEventsByTimeBreaksTies(t *testing.T) {
+	// The note and the link were sent in the same millisecond, and the link
+	// comes first in the list. IDs are compared as numbers, not strings.
+	events := []twitter.DirectMessageEvent{
+		dmEvent("10", 2000, "7", "", "300"),
+		dmEvent("9", 2000, "7", "note for 100", ""),
+		dmEvent("8", 1000, "7", "", "100"),
+	}
+	sortEventsByTime(events)
+	ids := []string{}
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	if fmt.Sprint(ids) != "[8 9 10]" {
+		t.Fatalf("sorted events %v, want [8 9 10]", ids)
+	}
+	groups := groupDMsPerTweet(events, &Config{})
+	if len(groups) != 2 || groups[0].TweetID != "100" || len(groups[0].Events) != 2 {
+		t.Errorf("groups = %+v, want the note grouped with tweet 100", groups)
+	}
+}
+
+// groupSummary renders groups as "tweet: event IDs" for comparison.
+func groupSummary(groups []dmGroup) string {
+	r := []string{}
+	for _, g := range groups {
+		ids := []string{}
+		for _, e := range g.Events {
+			ids = append(ids, e.ID)
+		}
+		r = append(r, fmt.Sprintf("%s:%v", g.TweetID, ids))
+	}
+	return fmt.Sprint(r)
+}
+
+func TestGroupNotesDirection(t *testing.T) {
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "before anything", ""),
+		dmEvent("2", 2000, "7", "", "100"),
+		dmEvent("3", 3000, "7", "between", ""),
+		dmEvent("4", 4000, "7", "another", ""),
+		dmEvent("5", 5000, "7", "", "200"),
+		dmEvent("6", 6000, "7", "after the last link", ""),
+	}
+	for _, c := range []struct {
+		notesBeforeLink bool
+		want            string
+	}{
+		{false, "[:[1] 100:[2 3 4] 200:[5 6]]"},
+		{true, "[100:[1 2] 200:[3 4 5 6]]"},
+	} {
+		groups := groupDMsPerTweet(events, &Config{NotesBeforeLink: c.notesBeforeLink})
+		if got := groupSummary(groups); got != c.want {
+			t.Errorf("with NotesBeforeLink %v, groups %s, want %s", c.notesBeforeLink, got, c.want)
+		}
+	}
+
+	// Notes without any link are kept either way.
+	notes := events[:1]
+	for _, before := range []bool{false, true} {
+		if got := groupSummary(groupDMsPerTweet(notes, &Config{NotesBeforeLink: before})); got != "[:[1]]" {
+			t.Errorf("with NotesBeforeLink %v, groups of a lone note %s, want [:[1]]", before, got)
+		}
+	}
+}
+
+func TestRebuildRowsKeepsBlankRows(t *testing.T) {
+	header := []string{"url", "text", "json"}
+	data := map[string]interface{}{"notes": ""}
+	updateComputedFields(data, testTweet("100", "50", "text"))
+	row, err := tweetToRow(data, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first row has an outdated url, which rebuilding fixes.
+	stale := []interface{}{"https://example.com/", row[1], row[2]}
+	rows := [][]interface{}{
+		stale,
+		{},
+		{"by hand", "", ""},
+		{"broken", "", "{not json"},
+		row,
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	got, rebuilt, skipped := rebuildRows(rows, header)
+	if rebuilt != 2 || skipped != 3 {
+		t.Errorf("rebuilt %d and skipped %d rows, want 2 and 3", rebuilt, skipped)
+	}
+	if len(got) != len(rows) || fmt.Sprint(got[0]) != fmt.Sprint(row) || len(got[1]) != 0 || got[2][0] != "by hand" || got[3][0] != "broken" {
+		t.Errorf("rebuilt rows %q", got)
+	}
+	if n := strings.Count(logs.String(), "Failed to rebuild"); n != 1 || !strings.Contains(logs.String(), "row 5") {
+		t.Errorf("logged %q, want a single failure for row 5", logs.String())
+	}
+}
+
+func TestGroupToNotesDropsRepeatsAndEmptyDMs(t *testing.T) {
+	group := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "42"),
+		dmEvent("2", 2000, "7", "first", "42"),
+		dmEvent("3", 3000, "7", "   ", ""),
+		dmEvent("4", 4000, "7", "first", ""),
+		dmEvent("5", 5000, "7", "second\n\nwith a gap", ""),
+		dmEvent("6", 6000, "7", "first", ""),
+	}
+	want := "first\nsecond\n\nwith a gap\nfirst"
+	if got := groupToNotes(group, "42"); got != want {
+		t.Errorf("notes = %q, want %q", got, want)
+	}
+}
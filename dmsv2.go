@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// v1DMDeprecatedCode is the error code Twitter returns when the app no longer
+// has access to the v1.1 endpoint it called.
+const v1DMDeprecatedCode = 453
+
+func isV1DMDeprecatedError(err error) bool {
+	apiError, ok := err.(twitter.APIError)
+	if !ok {
+		return false
+	}
+	for _, e := range apiError.Errors {
+		if e.Code == v1DMDeprecatedCode {
+			return true
+		}
+	}
+	return false
+}
+
+type dmEventV2 struct {
+	ID               string `json:"id"`
+	EventType        string `json:"event_type"`
+	Text             string `json:"text"`
+	CreatedAt        string `json:"created_at"`
+	SenderID         string `json:"sender_id"`
+	ReferencedTweets []struct {
+		ID string `json:"id"`
+	} `json:"referenced_tweets"`
+	Entities struct {
+		URLs []struct {
+			Start       int    `json:"start"`
+			End         int    `json:"end"`
+			URL         string `json:"url"`
+			ExpandedURL string `json:"expanded_url"`
+			DisplayURL  string `json:"display_url"`
+		} `json:"urls"`
+	} `json:"entities"`
+}
+
+type dmEventsV2Response struct {
+	Data []dmEventV2 `json:"data"`
+	Meta struct {
+		NextToken string `json:"next_token"`
+	} `json:"meta"`
+	Errors []struct {
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	} `json:"errors"`
+}
+
+// eventsListV2 fetches a page of DM events from the v2 API and maps them
+// into the v1.1 shape that the rest of the processing expects.
+func eventsListV2(httpClient *http.Client, cursor string) (*twitter.DirectMessageEvents, *http.Response, error) {
+	params := url.Values{}
+	params.Set("event_types", "MessageCreate")
+	params.Set("max_results", "100")
+	params.Set("dm_event.fields", "id,event_type,text,created_at,sender_id,referenced_tweets,entities")
+	if cursor != "" {
+		params.Set("pagination_token", cursor)
+	}
+	httpResp, err := httpClient.Get("https://api.twitter.com/2/dm_events?" + params.Encode())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	v2 := &dmEventsV2Response{}
+	if err := json.NewDecoder(httpResp.Body).Decode(v2); err != nil {
+		return nil, httpResp, fmt.Errorf("decoding v2 DM events (status %q): %w", httpResp.Status, err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		if len(v2.Errors) > 0 {
+			return nil, httpResp, fmt.Errorf("v2 DM events: %s: %s", v2.Errors[0].Title, v2.Errors[0].Detail)
+		}
+		return nil, httpResp, fmt.Errorf("v2 DM events: unexpected status %q", httpResp.Status)
+	}
+
+	r := &twitter.DirectMessageEvents{NextCursor: v2.Meta.NextToken}
+	for _, e := range v2.Data {
+		if e.EventType != "MessageCreate" {
+			continue
+		}
+		data := &twitter.DirectMessageData{
+			Text:     e.Text,
+			Entities: &twitter.Entities{},
+		}
+		for _, u := range e.Entities.URLs {
+			data.Entities.Urls = append(data.Entities.Urls, twitter.URLEntity{
+				Indices:     twitter.Indices{u.Start, u.End},
+				URL:         u.URL,
+				ExpandedURL: u.ExpandedURL,
+				DisplayURL:  u.DisplayURL,
+			})
+		}
+		// Tweets shared into the conversation show up as referenced tweets
+		// rather than URLs, expose them the same way tweetIDFromDM finds
+		// shared tweet cards.
+		for _, t := range e.ReferencedTweets {
+			data.CTAs = append(data.CTAs, twitter.DirectMessageCTA{
+				Type: "web_url",
+				URL:  fmt.Sprintf("https://twitter.com/i/status/%s", t.ID),
+			})
+		}
+
+		// v1.1 timestamps are milliseconds since epoch, which the sorting in
+		// pollDMsOnce relies on.
+		createdAt := ""
+		if t, err := time.Parse(time.RFC3339, e.CreatedAt); err == nil {
+			createdAt = strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+		}
+		r.Events = append(r.Events, twitter.DirectMessageEvent{
+			ID:        e.ID,
+			Type:      "message_create",
+			CreatedAt: createdAt,
+			Message: &twitter.DirectMessageEventMessage{
+				SenderID: e.SenderID,
+				Data:     data,
+			},
+		})
+	}
+	return r, httpResp, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+// exportPageSize is the number of rows read from the spreadsheet at a time.
+const exportPageSize = 1000
+
+var numericRe = regexp.MustCompile(`^[0-9]+$`)
+
+// exportHandler streams the json column of every row as newline-delimited
+// JSON. With ?since=<tweetID> only rows for newer tweets are included.
+// Requests are authenticated like /tweet.
+func exportHandler(botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := authenticateBot(w, r, botUserIDs); !ok {
+			return
+		}
+		exportTweets(w, r)
+	})
+}
+
+func exportTweets(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since := r.URL.Query().Get("since")
+	if since != "" && !numericRe.MatchString(since) {
+		http.Error(w, fmt.Sprintf("invalid tweet ID %q", since), http.StatusBadRequest)
+		return
+	}
+
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	spreadsheetID, err := rcService.Projects.Configs.Variables.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("fetching spreadsheet_id: %s", err), http.StatusInternalServerError)
+		return
+	}
+	sheetName, err := loadSheetName(rcService.Projects.Configs.Variables)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("loading sheet name: %s", err), http.StatusInternalServerError)
+		return
+	}
+	sheetsService, err := clients.sheetsService()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create sheets service: %s", err), http.StatusInternalServerError)
+		return
+	}
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("getting spreadsheet header: %s", err), http.StatusInternalServerError)
+		return
+	}
+	jsonColumnNumber := jsonColumn(header)
+	if jsonColumnNumber < 0 {
+		http.Error(w, "missing \"json\" column in the spreadsheet", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="tweets.ndjson"`)
+	for start := 2; ; start += exportPageSize {
+		rng := sheetRange(sheetName, fmt.Sprintf("R%dC%d:R%dC%d", start, jsonColumnNumber+1, start+exportPageSize-1, jsonColumnNumber+1))
+		values, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID.Text, rng).MajorDimension("COLUMNS").Context(ctx).Do()
+		if err != nil {
+			// Headers are already sent, all we can do is stop.
+			log.Printf("Export failed to read %s: %s", rng, err)
+			return
+		}
+		if len(values.Values) <= 0 {
+			return
+		}
+		for i, v := range values.Values[0] {
+			s := fmt.Sprint(v)
+			if s == "" {
+				continue
+			}
+			if since != "" {
+				j := struct {
+					Tweet struct {
+						ID string `json:"id_str"`
+					} `json:"tweet"`
+				}{}
+				if err := json.Unmarshal([]byte(s), &j); err != nil || !eventIDLess(since, j.Tweet.ID) {
+					continue
+				}
+			}
+			// Stored JSON may be indented, which would break the format.
+			b := &bytes.Buffer{}
+			if err := json.Compact(b, []byte(s)); err != nil {
+				log.Printf("Skipping row %d in export, invalid JSON: %s", start+i, err)
+				continue
+			}
+			b.WriteByte('\n')
+			if _, err := w.Write(b.Bytes()); err != nil {
+				return
+			}
+		}
+		if len(values.Values[0]) < exportPageSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// fingerprint identifies a row by who submitted which tweet, for tools that
+// sync the rows elsewhere. The fields are hashed in a fixed order, with a
+// separator that can't occur in IDs, so the value never changes.
+func fingerprint(senderID string, tweetID string) string {
+	h := sha256.Sum256([]byte("sender_id=" + senderID + "\ntweet_id=" + tweetID))
+	return hex.EncodeToString(h[:])
+}
+
+// updateFingerprint sets the fingerprint field from the sender and tweet
+// of the row, whether the tweet is a fetched one or was read back from the
+// json column.
+func updateFingerprint(data map[string]interface{}) {
+	senderID, _ := data["sender_id"].(string)
+	tweetID := ""
+	switch t := data["tweet"].(type) {
+	case *twitter.Tweet:
+		tweetID = t.IDStr
+	case map[string]interface{}:
+		tweetID, _ = t["id_str"].(string)
+	}
+	if tweetID == "" {
+		return
+	}
+	data["fingerprint"] = fingerprint(senderID, tweetID)
+}
@@ -7,6 +7,7 @@ require (
 	github.com/dghubble/gologin v2.1.0+incompatible
 	github.com/dghubble/gologin/v2 v2.3.0
 	github.com/dghubble/oauth1 v0.7.1
+	github.com/mattn/go-sqlite3 v1.14.15
 	google.golang.org/api v0.99.0
 	google.golang.org/appengine/v2 v2.0.2
 )
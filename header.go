@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+	"google.golang.org/api/sheets/v4"
+)
+
+// headerCacheTTL is how long the spreadsheet header is reused before it is
+// read again.
+const headerCacheTTL = 10 * time.Minute
+
+// expectedColumns should be present in the header. Sheets can do without
+// them, so a missing one is only logged.
+var expectedColumns = []string{"url", "text", "notes"}
+
+type cachedHeader struct {
+	header  []string
+	fetched time.Time
+}
+
+// headerCache holds the headers of the sheets, keyed by spreadsheet ID and
+// sheet name.
+var headerCache = struct {
+	mu      sync.Mutex
+	headers map[string]cachedHeader
+}{headers: map[string]cachedHeader{}}
+
+// invalidateHeaderCache makes the next getSheetHeader calls read the headers
+// from the spreadsheets.
+func invalidateHeaderCache() {
+	headerCache.mu.Lock()
+	defer headerCache.mu.Unlock()
+	headerCache.headers = map[string]cachedHeader{}
+}
+
+// getSheetHeader returns the field path of each column of the sheet, cached
+// for headerCacheTTL. That's the column title, unless column_mapping maps the
+// title to another path.
+func getSheetHeader(ctx context.Context, sheetsService *sheets.Service, spreadsheetID string, sheetName string) ([]string, error) {
+	key := spreadsheetID + "/" + sheetName
+	headerCache.mu.Lock()
+	defer headerCache.mu.Unlock()
+	if c, ok := headerCache.headers[key]; ok && time.Since(c.fetched) < headerCacheTTL {
+		return c.header, nil
+	}
+
+	header, err := fetchSheetHeader(ctx, sheetsService, spreadsheetID, sheetName)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := loadColumnMapping(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading column mapping: %w", err)
+	}
+	applyColumnMapping(header, mapping)
+	if err := validateHeader(header); err != nil {
+		return nil, err
+	}
+	warnMissingColumns(spreadsheetID, header)
+	warnDuplicateColumns(spreadsheetID, header)
+	headerCache.headers[key] = cachedHeader{header: header, fetched: time.Now()}
+	return header, nil
+}
+
+func fetchSheetHeader(ctx context.Context, sheetsService *sheets.Service, spreadsheetID string, sheetName string) ([]string, error) {
+	sheet, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID, sheetRange(sheetName, "1:1")).MajorDimension("ROWS").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the values from spreadsheet: %w", err)
+	}
+
+	if len(sheet.Values) < 1 {
+		return nil, fmt.Errorf("header row in the spreadsheet is empty")
+	}
+
+	header := []string{}
+	for _, v := range sheet.Values[0] {
+		header = append(header, fmt.Sprint(v))
+	}
+	return header, nil
+}
+
+// loadColumnMapping reads column_mapping from runtime config. It holds one
+// "<column title>=<field path>" pair per line, e.g. "Link=url".
+func loadColumnMapping(ctx context.Context) (map[string]string, error) {
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := optionalVariable(rcService.Projects.Configs.Variables, "column_mapping")
+	if err != nil {
+		return nil, err
+	}
+	return parseColumnMapping(s)
+}
+
+func parseColumnMapping(s string) (map[string]string, error) {
+	r := map[string]string{}
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.LastIndex(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid mapping %q, expected <column title>=<field path>", line)
+		}
+		r[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return r, nil
+}
+
+// applyColumnMapping replaces the titles of mapped columns with their field
+// paths.
+func applyColumnMapping(header []string, mapping map[string]string) {
+	for i, title := range header {
+		if path, ok := mapping[title]; ok {
+			header[i] = path
+		}
+	}
+}
+
+// validateHeader checks for the json column, which rows are read back from.
+func validateHeader(header []string) error {
+	if jsonColumn(header) < 0 {
+		return fmt.Errorf("no column for \"json\" in the spreadsheet header")
+	}
+	if n := columnCount(header, "json"); n > 1 {
+		return fmt.Errorf("%d columns for \"json\" in the spreadsheet header, there must be only one", n)
+	}
+	return nil
+}
+
+// warnMissingColumns logs the expectedColumns the header doesn't have, as
+// saved rows would leave them out.
+func warnMissingColumns(spreadsheetID string, header []string) {
+	for _, c := range expectedColumns {
+		if columnCount(header, c) == 0 {
+			logWarning(logFields{"spreadsheet_id": spreadsheetID, "field": c}, "No column for %q in the spreadsheet header", c)
+		}
+	}
+}
+
+func columnCount(header []string, field string) int {
+	n := 0
+	for _, h := range header {
+		if h == field {
+			n++
+		}
+	}
+	return n
+}
+
+// jsonColumn returns the index of the json column, or -1 if there's none.
+func jsonColumn(header []string) int {
+	for i, h := range header {
+		if h == "json" {
+			return i
+		}
+	}
+	return -1
+}
+
+// warnDuplicateColumns logs the fields that have more than one column, and
+// returns their column numbers. They all get the same value, which is likely
+// not what was meant. Blank titles are left out.
+func warnDuplicateColumns(spreadsheetID string, header []string) map[string][]int {
+	columns := map[string][]int{}
+	fields := []string{}
+	for i, h := range header {
+		if h == "" {
+			continue
+		}
+		if len(columns[h]) == 0 {
+			fields = append(fields, h)
+		}
+		columns[h] = append(columns[h], i+1)
+	}
+	duplicates := map[string][]int{}
+	for _, f := range fields {
+		if len(columns[f]) > 1 {
+			logWarning(logFields{"spreadsheet_id": spreadsheetID, "field": f}, "Field %q has more than one column in the header, columns %v", f, columns[f])
+			duplicates[f] = columns[f]
+		}
+	}
+	return duplicates
+}
+
+var plainSheetNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// sheetRange returns an A1 range on the named sheet, quoting the name if it
+// contains spaces or other special characters.
+func sheetRange(sheetName string, rng string) string {
+	if !plainSheetNameRe.MatchString(sheetName) {
+		sheetName = "'" + strings.ReplaceAll(sheetName, "'", "''") + "'"
+	}
+	return sheetName + "!" + rng
+}
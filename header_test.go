@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestValidateHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header []string
+		ok     bool
+	}{
+		{[]string{"url", "text", "notes", "json"}, true},
+		// Only json is required, the others are just logged.
+		{[]string{"json"}, true},
+		{[]string{"url", "text", "notes"}, false},
+		{[]string{"json", "url", "json"}, false},
+	} {
+		if err := validateHeader(tc.header); (err == nil) != tc.ok {
+			t.Errorf("validateHeader(%q) = %v, want ok %v", tc.header, err, tc.ok)
+		}
+	}
+}
+
+func TestSheetRange(t *testing.T) {
+	for name, want := range map[string]string{
+		"Tweets":       "Tweets!1:1",
+		"Saved Tweets": "'Saved Tweets'!1:1",
+		"Kyiv's":       "'Kyiv''s'!1:1",
+		"Твіти":        "'Твіти'!1:1",
+	} {
+		if got := sheetRange(name, "1:1"); got != want {
+			t.Errorf("sheetRange(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// fakeSheets serves the values of a single sheet, and records the ranges
+// read.
+type fakeSheets struct {
+	mu     sync.Mutex
+	values map[string][][]interface{}
+	ranges []string
+}
+
+func (f *fakeSheets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := strings.Index(r.URL.Path, "/values/")
+	if r.Method != http.MethodGet || i < 0 {
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+		return
+	}
+	rng := r.URL.Path[i+len("/values/"):]
+	f.ranges = append(f.ranges, rng)
+	values, ok := f.values[rng]
+	if !ok {
+		http.Error(w, `{"error": {"code": 400, "message": "Unable to parse range"}}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(&sheets.ValueRange{Range: rng, Values: values})
+}
+
+func newFakeSheetsService(t *testing.T, f *fakeSheets) *sheets.Service {
+	t.Helper()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	svc, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestSheetNameWithSpaces(t *testing.T) {
+	f := &fakeSheets{values: map[string][][]interface{}{
+		"'Saved Tweets'!1:1": {{"url", "text", "notes", "sender_username", "json"}},
+		"'Saved Tweets'!R2C5:C5": {{
+			`{"sender_id": "7", "tweet": {"id_str": "100"}}`,
+			`{"sender_id": "7", "tweet": {"id_str": "200"}}`,
+		}},
+	}}
+	svc := newFakeSheetsService(t, f)
+	ctx := context.Background()
+
+	header, err := fetchSheetHeader(ctx, svc, "ss", "Saved Tweets")
+	if err != nil {
+		t.Fatalf("fetchSheetHeader: %s", err)
+	}
+	if jsonColumn(header) != 4 {
+		t.Fatalf("header = %q, want json in column 5", header)
+	}
+	last, _, err := lastStoredTweetIDPerUser(ctx, svc, "ss", "Saved Tweets", header, map[string]string{"7": "seven"}, nil)
+	if err != nil {
+		t.Fatalf("lastStoredTweetIDPerUser: %s", err)
+	}
+	if last["7"].ID != "200" || last["7"].Row != 3 {
+		t.Errorf("last stored tweet = %+v, want 200 in row 3", last["7"])
+	}
+}
+
+func TestColumnMapping(t *testing.T) {
+	data := map[string]interface{}{"notes": "a note"}
+	updateComputedFields(data, testTweet("100", "50", "text"))
+
+	mapping, err := parseColumnMapping("Link=url\n\n Posted by = author \nTweet.Text=text\n")
+	if err != nil {
+		t.Fatalf("parseColumnMapping: %s", err)
+	}
+	for _, c := range []struct {
+		mapping map[string]string
+		header  []string
+		want    []interface{}
+	}{
+		// Without a mapping titles are paths.
+		{nil, []string{"url", "author", "tweet.id_str", "Link"}, []interface{}{"https://twitter.com/user50/status/100", "user50", "100", ""}},
+		{mapping, []string{"Link", "Posted by", "Tweet.Text", "tweet.id_str"}, []interface{}{"https://twitter.com/user50/status/100", "user50", "'text", "100"}},
+	} {
+		header := append([]string{}, c.header...)
+		applyColumnMapping(header, c.mapping)
+		row, err := tweetToRow(data, header)
+		if err != nil {
+			t.Fatalf("tweetToRow: %s", err)
+		}
+		if fmt.Sprint(row) != fmt.Sprint(c.want) {
+			t.Errorf("row for %q = %q, want %q", c.header, row, c.want)
+		}
+	}
+
+	if _, err := parseColumnMapping("Link"); err == nil {
+		t.Errorf("parseColumnMapping accepted a line without =")
+	}
+}
+
+func TestDuplicateColumns(t *testing.T) {
+	f := &fakeSheets{values: map[string][][]interface{}{
+		"Tweets!1:1": {{"url", "text", "url", "", "", "sender_username", "json", "text"}},
+		"Tweets!R2C7:C7": {{
+			`{"sender_id": "7", "tweet": {"id_str": "100"}}`,
+			`{"sender_id": "7", "tweet": {"id_str": "200"}}`,
+		}},
+	}}
+	svc := newFakeSheetsService(t, f)
+	ctx := context.Background()
+
+	header, err := fetchSheetHeader(ctx, svc, "ss", "Tweets")
+	if err != nil {
+		t.Fatalf("fetchSheetHeader: %s", err)
+	}
+	if err := validateHeader(header); err != nil {
+		t.Fatalf("validateHeader: %s", err)
+	}
+	if got, want := warnDuplicateColumns("ss", header), map[string][]int{"url": {1, 3}, "text": {2, 8}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("duplicate columns = %v, want %v", got, want)
+	}
+	last, _, err := lastStoredTweetIDPerUser(ctx, svc, "ss", "Tweets", header, map[string]string{"7": "seven"}, nil)
+	if err != nil {
+		t.Fatalf("lastStoredTweetIDPerUser: %s", err)
+	}
+	if last["7"].ID != "200" {
+		t.Errorf("last stored tweet = %+v, want 200", last["7"])
+	}
+
+	// Both columns of a field get its value.
+	data := map[string]interface{}{}
+	updateComputedFields(data, testTweet("100", "50", "text"))
+	row, err := tweetToRow(data, header)
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	if row[0] != row[2] || row[1] != row[7] {
+		t.Errorf("row = %q, want duplicated columns to match", row)
+	}
+
+	if got := jsonColumn([]string{"url", "json", "json"}); got != 1 {
+		t.Errorf("jsonColumn = %d, want the first one", got)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const dmPermissionMessage = "DM read permission missing — re-authorize with DM scope"
+
+// Twitter error codes returned when the app or the user token isn't allowed
+// to read direct messages.
+var dmPermissionErrorCodes = map[int]bool{
+	93:  true, // This application is not allowed to access or delete your direct messages.
+	220: true, // Your credentials do not allow access to this resource.
+}
+
+func isDMPermissionError(err error) bool {
+	apiError, ok := err.(twitter.APIError)
+	if !ok {
+		return false
+	}
+	for _, e := range apiError.Errors {
+		if dmPermissionErrorCodes[e.Code] {
+			return true
+		}
+	}
+	return false
+}
+
+// Health tracks the progress of the poll loop and problems that need
+// operator attention, and reports them on /health and /healthz.
+type Health struct {
+	mu sync.Mutex
+	// Token of the stored user credentials that lacked DM permissions.
+	dmPermissionMissingToken string
+	// Bot accounts whose credentials were rejected, mapped to the rejected
+	// token. Empty if the account has no credentials at all.
+	reauthNeeded map[string]string
+
+	started         time.Time
+	pollInterval    time.Duration
+	lastSuccess     time.Time
+	lastError       string
+	eventsProcessed int
+}
+
+func (h *Health) setDMPermissionMissing(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dmPermissionMissingToken = token
+}
+
+// dmPermissionMissing reports whether token is already known to lack DM
+// permissions.
+func (h *Health) dmPermissionMissing(token string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dmPermissionMissingToken != "" && h.dmPermissionMissingToken == token
+}
+
+func (h *Health) setReauthNeeded(account string, token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reauthNeeded == nil {
+		h.reauthNeeded = map[string]string{}
+	}
+	h.reauthNeeded[account] = token
+}
+
+func (h *Health) clearReauthNeeded(account string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.reauthNeeded, account)
+}
+
+// isReauthNeeded reports whether token was already rejected for the
+// account. Credentials stored by a new login have another token.
+func (h *Health) isReauthNeeded(account string, token string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rejected, ok := h.reauthNeeded[account]
+	return ok && rejected == token
+}
+
+func (h *Health) setPollInterval(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pollInterval = d
+}
+
+// recordSuccess is called at the end of a successful poll that processed the
+// given number of DM events.
+func (h *Health) recordSuccess(events int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dmPermissionMissingToken = ""
+	h.lastSuccess = time.Now()
+	h.lastError = ""
+	h.eventsProcessed = events
+}
+
+func (h *Health) recordError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err.Error()
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.dmPermissionMissingToken != "" {
+		http.Error(w, dmPermissionMessage, http.StatusServiceUnavailable)
+		return
+	}
+	if len(h.reauthNeeded) > 0 {
+		http.Error(w, reauthMessage, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+type healthzResponse struct {
+	LastSuccess     *time.Time `json:"last_success"`
+	LastError       string     `json:"last_error,omitempty"`
+	EventsProcessed int        `json:"events_processed"`
+	Problem         string     `json:"problem,omitempty"`
+	// Bot accounts that have to log in again, at LoginURL.
+	ReauthNeeded []string `json:"reauth_needed,omitempty"`
+	LoginURL     string   `json:"login_url,omitempty"`
+}
+
+// ServeHealthz reports the state of the poll loop as JSON. It fails with 500
+// if there hasn't been a successful poll in the last three polling
+// intervals, so that uptime checks can alert on a wedged loop.
+func (h *Health) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	resp := healthzResponse{
+		LastError:       h.lastError,
+		EventsProcessed: h.eventsProcessed,
+	}
+	since := h.started
+	if !h.lastSuccess.IsZero() {
+		t := h.lastSuccess
+		resp.LastSuccess = &t
+		since = t
+	}
+	if len(h.reauthNeeded) > 0 {
+		resp.Problem = reauthMessage
+		resp.LoginURL = "/"
+		for account := range h.reauthNeeded {
+			resp.ReauthNeeded = append(resp.ReauthNeeded, account)
+		}
+		sort.Strings(resp.ReauthNeeded)
+	}
+	if h.dmPermissionMissingToken != "" {
+		resp.Problem = dmPermissionMessage
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if time.Since(since) > 3*h.pollInterval {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
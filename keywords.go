@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const deadLetterEntity = "DeadLetter"
+
+// DeadLetter records a tweet that was submitted but deliberately not saved.
+// It's keyed by the DM event that linked the tweet, see deadLetterName, so
+// that polls going over the event again skip it.
+type DeadLetter struct {
+	TweetID  string
+	SenderID string
+	EventID  string
+	Reason   string
+	Keyword  string
+	Notes    string `datastore:",noindex"`
+	Created  time.Time
+}
+
+type keyword struct {
+	text string
+	re   *regexp.Regexp
+}
+
+// newKeyword returns a case-insensitive matcher for s that only matches whole
+// words. \b is ASCII-only in Go regexps, so word boundaries are spelled out to
+// also work for Cyrillic.
+func newKeyword(s string) (keyword, error) {
+	re, err := regexp.Compile(`(?i)(^|[^\p{L}\p{N}_])` + regexp.QuoteMeta(s) + `($|[^\p{L}\p{N}_])`)
+	if err != nil {
+		return keyword{}, err
+	}
+	return keyword{text: s, re: re}, nil
+}
+
+func compileKeywords(list []string) ([]keyword, error) {
+	r := []keyword{}
+	for _, s := range list {
+		k, err := newKeyword(s)
+		if err != nil {
+			return nil, fmt.Errorf("compiling keyword %q: %w", s, err)
+		}
+		r = append(r, k)
+	}
+	return r, nil
+}
+
+// rejectByKeywords returns the reason and the keyword for rejecting a tweet
+// with the given text, or an empty reason if it passes both lists.
+func rejectByKeywords(cfg *Config, text string) (string, string) {
+	for _, k := range cfg.KeywordDenylist {
+		if k.re.MatchString(text) {
+			return "denied keyword", k.text
+		}
+	}
+	if len(cfg.KeywordAllowlist) == 0 {
+		return "", ""
+	}
+	for _, k := range cfg.KeywordAllowlist {
+		if k.re.MatchString(text) {
+			return "", ""
+		}
+	}
+	return "no allowed keyword", ""
+}
+
+// rejectByAuthor returns the reason and the author's screen name for
+// rejecting a tweet whose author isn't in author_whitelist, or an empty
+// reason if the whitelist is empty or includes the author. The screen name
+// gets recorded in place of the keyword.
+func rejectByAuthor(cfg *Config, tweet *twitter.Tweet) (string, string) {
+	if len(cfg.AuthorWhitelist) == 0 {
+		return "", ""
+	}
+	if tweet.User == nil {
+		return "unknown author", ""
+	}
+	if cfg.AuthorWhitelist[tweet.User.IDStr] || cfg.AuthorWhitelist[strings.ToLower(tweet.User.ScreenName)] {
+		return "", ""
+	}
+	return "author not allowed", tweet.User.ScreenName
+}
+
+// deadLetterName is the key name of the dead letter for a tweet linked in a
+// DM event. A DM can link several tweets.
+func deadLetterName(eventID string, tweetID string) string {
+	return eventID + "/" + tweetID
+}
+
+func deadLetter(ctx context.Context, ds *datastore.Client, dl *DeadLetter) error {
+	dl.Created = time.Now()
+	_, err := ds.Put(ctx, datastore.NameKey(deadLetterEntity, deadLetterName(dl.EventID, dl.TweetID), nil), dl)
+	return err
+}
+
+// findDeadLetters returns which of the named dead letters exist.
+func findDeadLetters(ctx context.Context, ds *datastore.Client, names []string) (map[string]bool, error) {
+	r := map[string]bool{}
+	// GetMulti takes up to 1000 keys.
+	for start := 0; start < len(names); start += 1000 {
+		end := start + 1000
+		if end > len(names) {
+			end = len(names)
+		}
+		keys := []*datastore.Key{}
+		for _, name := range names[start:end] {
+			keys = append(keys, datastore.NameKey(deadLetterEntity, name, nil))
+		}
+		dls := make([]DeadLetter, len(keys))
+		err := ds.GetMulti(ctx, keys, dls)
+		merr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return nil, err
+		}
+		for i, name := range names[start:end] {
+			if isMulti && merr[i] != nil {
+				if merr[i] != datastore.ErrNoSuchEntity {
+					return nil, merr[i]
+				}
+				continue
+			}
+			r[name] = true
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func mustKeywords(t *testing.T, list ...string) []keyword {
+	t.Helper()
+	r, err := compileKeywords(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRejectByKeywords(t *testing.T) {
+	cfg := &Config{
+		KeywordAllowlist: mustKeywords(t, "Kyiv", "Київ"),
+		KeywordDenylist:  mustKeywords(t, "crypto", "c++"),
+	}
+	for _, c := range []struct {
+		text    string
+		reason  string
+		keyword string
+	}{
+		{"Shelling in KYIV tonight", "", ""},
+		{"Обстріл у Київ, 3 вибухи", "", ""},
+		{"Free CRYPTO in Kyiv", "denied keyword", "crypto"},
+		{"Learn C++ in Kyiv", "denied keyword", "c++"},
+		// Keywords only match whole words.
+		{"Kyivan cryptography", "no allowed keyword", ""},
+		{"Київська область", "no allowed keyword", ""},
+		{"", "no allowed keyword", ""},
+	} {
+		reason, kw := rejectByKeywords(cfg, c.text)
+		if reason != c.reason || kw != c.keyword {
+			t.Errorf("rejectByKeywords(%q) = %q, %q, want %q, %q", c.text, reason, kw, c.reason, c.keyword)
+		}
+	}
+
+	if reason, _ := rejectByKeywords(&Config{}, "anything at all"); reason != "" {
+		t.Errorf("rejected with no lists set: %s", reason)
+	}
+}
+
+func TestProcessSkipsDeniedKeywords(t *testing.T) {
+	tw := newFakeTwitter(testTweet("100", "50", "Buy crypto now"), testTweet("200", "50", "News from Kharkiv"))
+	store := newMemoryStore()
+	cfg := &Config{SenderWorkers: 1, DryRun: true, KeywordDenylist: mustKeywords(t, "Crypto")}
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+	}
+	processEvents(t, cfg, tw, store, events, nil)
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"200"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+}
+
+func TestRejectByAuthor(t *testing.T) {
+	cfg := &Config{AuthorWhitelist: map[string]bool{"50": true, "official": true}}
+	byName := testTweet("200", "60", "b")
+	byName.User.ScreenName = "Official"
+	noUser := testTweet("400", "", "d")
+	noUser.User = nil
+	for _, c := range []struct {
+		tweet  *twitter.Tweet
+		reason string
+	}{
+		{testTweet("100", "50", "a"), ""},
+		{byName, ""},
+		{testTweet("300", "70", "c"), "author not allowed"},
+		{noUser, "unknown author"},
+	} {
+		if reason, _ := rejectByAuthor(cfg, c.tweet); reason != c.reason {
+			t.Errorf("rejectByAuthor(%s) = %q, want %q", c.tweet.IDStr, reason, c.reason)
+		}
+	}
+	if reason, _ := rejectByAuthor(&Config{}, testTweet("300", "70", "c")); reason != "" {
+		t.Errorf("rejected with an empty whitelist: %s", reason)
+	}
+}
+
+func TestProcessSkipsAuthorsNotAllowed(t *testing.T) {
+	tw := newFakeTwitter(testTweet("100", "50", "official"), testTweet("200", "60", "other"))
+	store := newMemoryStore()
+	cfg := &Config{SenderWorkers: 1, DryRun: true, AuthorWhitelist: map[string]bool{"50": true}}
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+	}
+	processEvents(t, cfg, tw, store, events, nil)
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"100"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+}
+
+func TestProcessSkipsDeadLetteredEvents(t *testing.T) {
+	tw := newFakeTwitter(testTweet("100", "50", "official"), testTweet("200", "60", "other"))
+	cfg := &Config{SenderWorkers: 1, AuthorWhitelist: map[string]bool{"50": true}}
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "see this", ""),
+		dmEvent("3", 3000, "7", "", "200"),
+	}
+	recorded := map[string]*DeadLetter{}
+	deadLetters := func(p *eventProcessor) {
+		p.deadLetter = func(ctx context.Context, dl *DeadLetter) error {
+			recorded[deadLetterName(dl.EventID, dl.TweetID)] = dl
+			return nil
+		}
+		p.findDeadLetters = func(ctx context.Context, names []string) (map[string]bool, error) {
+			r := map[string]bool{}
+			for _, n := range names {
+				r[n] = recorded[n] != nil
+			}
+			return r, nil
+		}
+	}
+	store := newMemoryStore()
+	processEvents(t, cfg, tw, store, events, deadLetters)
+	if dl := recorded["3/200"]; len(recorded) != 1 || dl == nil || dl.SenderID != "7" || dl.Reason != "author not allowed" {
+		t.Fatalf("dead letters %v, want one for 200 linked in event 3", recorded)
+	}
+
+	// The next poll goes over the events again, without the first one.
+	processEvents(t, cfg, tw, store, events[1:], deadLetters)
+	if n := tw.count("/1.1/statuses/show.json"); n != 2 {
+		t.Errorf("fetched %d tweets, want the rejected one fetched only once", n)
+	}
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"100"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// Share of letters that have to be in one script for guessLang to pick a
+// language.
+const langScriptRatio = 0.8
+
+// tweetLang returns the language Twitter detected for the tweet, falling back
+// to guessLang if Twitter couldn't tell.
+func tweetLang(tweet *twitter.Tweet) string {
+	if tweet.Lang != "" && tweet.Lang != "und" {
+		return tweet.Lang
+	}
+	return guessLang(expandedText(tweet))
+}
+
+// guessLang tells apart the languages we mostly save (Ukrainian, Russian and
+// English) by the script of the letters in the text, ignoring links,
+// mentions and hashtags. Returns "und" if it can't tell.
+func guessLang(text string) string {
+	cyrillic, latin := 0, 0
+	uk, ru := 0, 0
+	for _, word := range strings.Fields(text) {
+		if strings.HasPrefix(word, "http") || strings.HasPrefix(word, "@") || strings.HasPrefix(word, "#") {
+			continue
+		}
+		for _, r := range word {
+			switch {
+			case unicode.Is(unicode.Cyrillic, r):
+				cyrillic++
+				switch unicode.ToLower(r) {
+				case 'і', 'ї', 'є', 'ґ':
+					uk++
+				case 'ы', 'э', 'ъ', 'ё':
+					ru++
+				}
+			case unicode.Is(unicode.Latin, r):
+				latin++
+			}
+		}
+	}
+	total := cyrillic + latin
+	if total == 0 {
+		return "und"
+	}
+	switch {
+	case float64(cyrillic) >= langScriptRatio*float64(total):
+		if uk > ru {
+			return "uk"
+		}
+		if ru > uk {
+			return "ru"
+		}
+	case float64(latin) >= langScriptRatio*float64(total):
+		return "en"
+	}
+	return "und"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFields are extra fields attached to a structured log entry, e.g.
+// tweet_id, sender_id or event_id.
+type logFields map[string]interface{}
+
+const (
+	severityDebug   = "DEBUG"
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// debugLogging enables debug entries. Set with the DEBUG environment variable.
+var debugLogging = os.Getenv("DEBUG") != ""
+
+var logMu sync.Mutex
+
+// logEntry writes a single JSON line in the format understood by Cloud
+// Logging.
+func logEntry(severity string, fields logFields, format string, args ...interface{}) {
+	if severity == severityDebug && !debugLogging {
+		return
+	}
+	entry := map[string]interface{}{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["severity"] = severity
+	entry["message"] = fmt.Sprintf(format, args...)
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{
+			"severity": severity,
+			"message":  fmt.Sprintf(format, args...),
+		})
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	os.Stderr.Write(append(b, '\n'))
+}
+
+func logDebug(fields logFields, format string, args ...interface{}) {
+	logEntry(severityDebug, fields, format, args...)
+}
+
+func logInfo(fields logFields, format string, args ...interface{}) {
+	logEntry(severityInfo, fields, format, args...)
+}
+
+func logWarning(fields logFields, format string, args ...interface{}) {
+	logEntry(severityWarning, fields, format, args...)
+}
+
+func logError(fields logFields, format string, args ...interface{}) {
+	logEntry(severityError, fields, format, args...)
+}
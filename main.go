@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	oauth1Login "github.com/dghubble/gologin/v2/oauth1"
@@ -14,18 +21,22 @@ import (
 	"github.com/dghubble/oauth1"
 	twitterOAuth1 "github.com/dghubble/oauth1/twitter"
 	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+	secretmanager "google.golang.org/api/secretmanager/v1"
 	"google.golang.org/appengine/v2"
 )
 
 const credentialsEntity = "Credentials"
+
+// credentialsID names the credentials stored before they were keyed by bot
+// account, see loadUserCredentials.
 const credentialsID = credentialsEntity
 
 type TwitterCredentials struct {
-	APIKey       string
-	APIKeySecret string
-	BearerToken  string
-	ClientID     string
-	ClientSecret string
+	APIKey       string `json:"api_key"`
+	APIKeySecret string `json:"api_key_secret"`
+	BearerToken  string `json:"bearer_token"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
 }
 
 type TwitterUserCredentials struct {
@@ -60,6 +71,69 @@ func credsFromRuntimeConfig(ctx context.Context) (TwitterCredentials, error) {
 	return r, nil
 }
 
+// credsFromSecretManager reads the credentials from Secret Manager. Each
+// field has its own secret, named by an environment variable or by default
+// twitter-api-key and so on. Names without a "projects/" prefix are secrets
+// of the current project, and their latest version is read.
+func credsFromSecretManager(ctx context.Context) (TwitterCredentials, error) {
+	smService, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return TwitterCredentials{}, err
+	}
+	return credsFromSecrets(ctx, &secretManagerAccessor{smService})
+}
+
+// secretAccessor returns the payload of a secret version.
+type secretAccessor interface {
+	access(ctx context.Context, name string) ([]byte, error)
+}
+
+type secretManagerAccessor struct {
+	service *secretmanager.Service
+}
+
+func (a *secretManagerAccessor) access(ctx context.Context, name string) ([]byte, error) {
+	v, err := a.service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if v.Payload == nil {
+		return nil, fmt.Errorf("no payload")
+	}
+	return base64.StdEncoding.DecodeString(v.Payload.Data)
+}
+
+func credsFromSecrets(ctx context.Context, secrets secretAccessor) (TwitterCredentials, error) {
+	r := TwitterCredentials{}
+	fields := []struct {
+		env  string
+		name string
+		dest *string
+	}{
+		{"SECRET_TWITTER_API_KEY", "twitter-api-key", &r.APIKey},
+		{"SECRET_TWITTER_API_KEY_SECRET", "twitter-api-key-secret", &r.APIKeySecret},
+		{"SECRET_TWITTER_BEARER_TOKEN", "twitter-bearer-token", &r.BearerToken},
+		{"SECRET_TWITTER_CLIENT_ID", "twitter-client-id", &r.ClientID},
+		{"SECRET_TWITTER_CLIENT_SECRET", "twitter-client-secret", &r.ClientSecret},
+	}
+	for _, f := range fields {
+		name := f.name
+		if v := os.Getenv(f.env); v != "" {
+			name = v
+		}
+		if !strings.HasPrefix(name, "projects/") {
+			name = fmt.Sprintf("projects/%s/secrets/%s/versions/latest", os.Getenv("GOOGLE_CLOUD_PROJECT"), name)
+		}
+		b, err := secrets.access(ctx, name)
+		if err != nil {
+			return TwitterCredentials{}, fmt.Errorf("accessing secret %q: %w", name, err)
+		}
+		// Secrets made with echo end with a newline.
+		*f.dest = strings.TrimSpace(string(b))
+	}
+	return r, nil
+}
+
 func credsFromEnv() TwitterCredentials {
 	r := TwitterCredentials{}
 	vars := []struct {
@@ -78,11 +152,43 @@ func credsFromEnv() TwitterCredentials {
 	return r
 }
 
+// credsFromFile reads the credentials from a JSON file with the same field
+// names as the runtime config variables, for local development.
+func credsFromFile(path string) (TwitterCredentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TwitterCredentials{}, err
+	}
+	r := TwitterCredentials{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return TwitterCredentials{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// creds reads the app credentials from where CREDS_SOURCE says:
+// "secretmanager", "runtimeconfig" or "env". If it's not set, they're read
+// from TWITTER_CREDS_FILE if set, from runtime config on App Engine, and from
+// the environment otherwise. clients.appCredentials caches them.
 func creds(ctx context.Context) (TwitterCredentials, error) {
-	if appengine.IsAppEngine() {
+	switch source := os.Getenv("CREDS_SOURCE"); source {
+	case "":
+	case "secretmanager":
+		return credsFromSecretManager(ctx)
+	case "runtimeconfig":
 		return credsFromRuntimeConfig(ctx)
+	case "env":
+		return credsFromEnv(), nil
+	default:
+		return TwitterCredentials{}, fmt.Errorf("unknown CREDS_SOURCE %q", source)
 	}
-	return credsFromEnv(), nil
+	if path := os.Getenv("TWITTER_CREDS_FILE"); path != "" {
+		return credsFromFile(path)
+	}
+	if !appengine.IsAppEngine() {
+		return credsFromEnv(), nil
+	}
+	return credsFromRuntimeConfig(ctx)
 }
 
 func datastoreClient(ctx context.Context) (*datastore.Client, error) {
@@ -92,16 +198,48 @@ func datastoreClient(ctx context.Context) (*datastore.Client, error) {
 	return datastore.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
 }
 
+const defaultOAuthCallbackBase = "https://ukd-tweet-saver.nw.r.appspot.com"
+
+// oauthCallbackURL returns the OAuth callback URL under the base URL set in
+// OAUTH_CALLBACK_BASE, e.g. http://localhost:8080 for local development.
+func oauthCallbackURL() (string, error) {
+	base := os.Getenv("OAUTH_CALLBACK_BASE")
+	if base == "" {
+		base = defaultOAuthCallbackBase
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("parsing OAUTH_CALLBACK_BASE %q: %w", base, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return "", fmt.Errorf("OAUTH_CALLBACK_BASE %q is not an absolute URL", base)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/oauth_callback"
+	return u.String(), nil
+}
+
+// shutdownGracePeriod is how long an in-progress poll and open HTTP requests
+// get to finish on shutdown. App Engine allows 30 seconds after SIGTERM.
+const shutdownGracePeriod = 25 * time.Second
+
+// rebuildTimeout bounds both the wait for a poll to finish and the rebuild
+// itself in /rebuild, staying under App Engine's 10 minute request limit.
+const rebuildTimeout = 4 * time.Minute
+
 func main() {
 	ctx := context.Background()
-	creds, err := creds(ctx)
+	creds, err := clients.appCredentials(ctx)
 	if err != nil {
 		log.Fatalf("Failed to get credentials: %s", err)
 	}
+	callbackURL, err := oauthCallbackURL()
+	if err != nil {
+		log.Fatalf("Invalid OAuth callback URL: %s", err)
+	}
 	oauth1Config := &oauth1.Config{
 		ConsumerKey:    creds.APIKey,
 		ConsumerSecret: creds.APIKeySecret,
-		CallbackURL:    "https://ukd-tweet-saver.nw.r.appspot.com/oauth_callback",
+		CallbackURL:    callbackURL,
 		Endpoint:       twitterOAuth1.AuthorizeEndpoint,
 	}
 	ds, err := datastoreClient(ctx)
@@ -113,19 +251,123 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialise runtimeconfig client: %s", err)
 	}
-	botUserID, err := rcService.Projects.Configs.Variables.Get(fmt.Sprintf("projects/%s/configs/prod/variables/%s", os.Getenv("GOOGLE_CLOUD_PROJECT"), url.PathEscape("twitter/bot_user_id"))).Do()
+	botUserIDVar, err := rcService.Projects.Configs.Variables.Get(fmt.Sprintf("projects/%s/configs/prod/variables/%s", os.Getenv("GOOGLE_CLOUD_PROJECT"), url.PathEscape("twitter/bot_user_id"))).Do()
 	if err != nil {
 		log.Fatalf("Failed to get bot user ID: %s", err)
 	}
+	botUserIDs := parseBotUserIDs(botUserIDVar.Text)
+	if len(botUserIDs) == 0 {
+		log.Fatalf("No bot user ID in twitter/bot_user_id")
+	}
+	tz, err := optionalVariable(rcService.Projects.Configs.Variables, "display_timezone")
+	if err != nil {
+		log.Fatalf("Failed to get display_timezone: %s", err)
+	}
+	displayLocation = loadDisplayLocation(tz)
+	formats, err := listVariable(rcService.Projects.Configs.Variables, "column_formats")
+	if err != nil {
+		log.Fatalf("Failed to get column_formats: %s", err)
+	}
+	columnTransformers = loadColumnTransformers(formats)
+	throttleCodes, err := listVariable(rcService.Projects.Configs.Variables, "throttle_error_codes")
+	if err != nil {
+		log.Fatalf("Failed to get throttle_error_codes: %s", err)
+	}
+	throttleErrorCodes = loadThrottleErrorCodes(throttleCodes)
+	if maxCellLength, err = intVariable(rcService.Projects.Configs.Variables, "max_cell_length", defaultMaxCellLength); err != nil {
+		log.Fatalf("Failed to get max_cell_length: %s", err)
+	}
+	if maxCellLength <= 0 {
+		maxCellLength = defaultMaxCellLength
+	}
+
+	// runCtx is cancelled to shut down.
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Got %s, shutting down", sig)
+			stop()
+		case <-runCtx.Done():
+		}
+	}()
 
-	rebuild := make(chan struct{})
+	rebuild := make(chan rebuildRequest)
+	health := &Health{started: time.Now(), pollInterval: defaultPollInterval}
+	go func() {
+		for i, account := range botUserIDs {
+			verifyAccount(runCtx, ds, account, i == 0, health)
+		}
+	}()
 	http.Handle("/", twitterlogin.LoginHandler(oauth1Config, nil))
-	http.Handle("/oauth_callback", twitterlogin.CallbackHandler(oauth1Config, loginHandler(ds, botUserID.Text), nil))
+	http.Handle("/oauth_callback", twitterlogin.CallbackHandler(oauth1Config, loginHandler(ds, botUserIDs), nil))
 	http.HandleFunc("/rebuild", func(w http.ResponseWriter, r *http.Request) {
-		rebuild <- struct{}{}
-		fmt.Fprintln(w, "ok")
+		if r.URL.Query().Get("async") == "true" {
+			// Queued behind a poll in progress, nobody waits for the
+			// result.
+			go func() {
+				select {
+				case rebuild <- rebuildRequest{}:
+				case <-runCtx.Done():
+				}
+			}()
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "rebuild queued")
+			return
+		}
+		// Waits for a poll in progress to finish first.
+		req := rebuildRequest{done: make(chan rebuildResult, 1)}
+		select {
+		case rebuild <- req:
+		case <-runCtx.Done():
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		case <-time.After(rebuildTimeout):
+			http.Error(w, "timed out waiting for the poll to finish", http.StatusGatewayTimeout)
+			return
+		}
+		select {
+		case res := <-req.done:
+			if res.err != nil {
+				http.Error(w, fmt.Sprintf("rebuild failed: %s", res.err), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "rebuilt %d rows, %d left as is\n", res.rebuilt, res.skipped)
+		case <-time.After(rebuildTimeout):
+			http.Error(w, "rebuild is still running", http.StatusGatewayTimeout)
+		}
 	})
+
+	http.Handle("/quote_groups", quoteGroupsHandler(botUserIDs))
+	http.Handle("/export", exportHandler(botUserIDs))
+	http.Handle("/refresh_metrics", refreshMetricsHandler(botUserIDs))
+	http.Handle("/backfill", backfillHandler(botUserIDs))
+	http.Handle("/tweet", saveTweetHandler(botUserIDs))
+	http.Handle("/redact", redactHandler(botUserIDs))
+	http.Handle("/selftest", selftestHandler(ds, botUserIDs))
+	http.Handle("/whitelist/add", whitelistHandler(ds, botUserIDs, false))
+	http.Handle("/whitelist/remove", whitelistHandler(ds, botUserIDs, true))
+	http.Handle("/health", health)
+	http.HandleFunc("/healthz", health.ServeHealthz)
+	http.Handle("/metrics", totals)
+	if debugLogging {
+		http.Handle("/debug/processed_events", recentEvents)
+		http.Handle("/replay_response", replayHandler(ds, botUserIDs))
+		http.Handle("/replay", replayEventsHandler(ds, botUserIDs))
+	}
 	http.HandleFunc("/_ah/warmup", func(w http.ResponseWriter, r *http.Request) {
+		if err := clients.warm(r.Context(), ds, botUserIDs); err != nil {
+			// The first poll builds whatever is missing.
+			log.Printf("Warmup failed: %s", err)
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	http.HandleFunc("/_ah/stop", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Got /_ah/stop, shutting down")
+		stop()
 		fmt.Fprintln(w, "ok")
 	})
 
@@ -135,19 +377,37 @@ func main() {
 		log.Printf("Defaulting to port %s", port)
 	}
 
+	pollDone := make(chan struct{})
 	go func() {
-		if err := PollDMs(ctx, ds, rebuild); err != nil {
+		defer close(pollDone)
+		if err := PollDMs(runCtx, ds, botUserIDs, rebuild, health); err != nil {
 			log.Fatal(err)
 		}
 	}()
 
+	srv := &http.Server{Addr: ":" + port}
+	go func() {
+		<-runCtx.Done()
+		shutdownCtx, cancel := context.WithTimeout(ctx, shutdownGracePeriod)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down the HTTP server: %s", err)
+		}
+	}()
+
 	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+
+	select {
+	case <-pollDone:
+	case <-time.After(shutdownGracePeriod):
+		log.Printf("Timed out waiting for the poll to finish")
+	}
 }
 
-func loginHandler(ds *datastore.Client, botUserID string) http.Handler {
+func loginHandler(ds *datastore.Client, botUserIDs []string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 
@@ -157,7 +417,7 @@ func loginHandler(ds *datastore.Client, botUserID string) http.Handler {
 			return
 		}
 
-		if twitterUser.IDStr != botUserID {
+		if !isBotUser(botUserIDs, twitterUser.IDStr) {
 			http.Error(w, fmt.Sprintf("Unauthorized user %s", twitterUser.IDStr), http.StatusUnauthorized)
 			return
 		}
@@ -170,7 +430,7 @@ func loginHandler(ds *datastore.Client, botUserID string) http.Handler {
 			Token:       accessToken,
 			TokenSecret: accessSecret,
 		}
-		if _, err := ds.Put(ctx, datastore.NameKey(credentialsEntity, credentialsID, nil), creds); err != nil {
+		if _, err := ds.Put(ctx, credentialsKey(twitterUser.IDStr), creds); err != nil {
 			http.Error(w, fmt.Sprintf("Failed to store credentials: %s", err), http.StatusInternalServerError)
 			return
 		}
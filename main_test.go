@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSecrets maps secret version names to payloads.
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) access(ctx context.Context, name string) ([]byte, error) {
+	v, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("secret %s not found", name)
+	}
+	return []byte(v), nil
+}
+
+func TestCredsFromSecrets(t *testing.T) {
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "project")
+	os.Setenv("SECRET_TWITTER_CLIENT_SECRET", "projects/other/secrets/client/versions/2")
+	defer os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+	defer os.Unsetenv("SECRET_TWITTER_CLIENT_SECRET")
+
+	secrets := fakeSecrets{
+		"projects/project/secrets/twitter-api-key/versions/latest":        "key\n",
+		"projects/project/secrets/twitter-api-key-secret/versions/latest": "key secret",
+		"projects/project/secrets/twitter-bearer-token/versions/latest":   "bearer",
+		"projects/project/secrets/twitter-client-id/versions/latest":      "client",
+		"projects/other/secrets/client/versions/2":                        "client secret",
+	}
+	got, err := credsFromSecrets(context.Background(), secrets)
+	if err != nil {
+		t.Fatalf("credsFromSecrets: %s", err)
+	}
+	want := TwitterCredentials{APIKey: "key", APIKeySecret: "key secret", BearerToken: "bearer", ClientID: "client", ClientSecret: "client secret"}
+	if got != want {
+		t.Errorf("credsFromSecrets = %+v, want %+v", got, want)
+	}
+
+	delete(secrets, "projects/project/secrets/twitter-bearer-token/versions/latest")
+	if _, err := credsFromSecrets(context.Background(), secrets); err == nil {
+		t.Errorf("credsFromSecrets succeeded with a missing secret")
+	}
+}
+
+func TestCredsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"api_key": "key",
+		"api_key_secret": "key secret",
+		"bearer_token": "bearer",
+		"client_id": "client",
+		"client_secret": "client secret"
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TWITTER_CREDS_FILE", path)
+	os.Setenv("TWITTER_API_KEY", "from env")
+	defer os.Unsetenv("TWITTER_CREDS_FILE")
+	defer os.Unsetenv("TWITTER_API_KEY")
+
+	// The file takes precedence over the environment.
+	got, err := creds(context.Background())
+	if err != nil {
+		t.Fatalf("creds: %s", err)
+	}
+	want := TwitterCredentials{APIKey: "key", APIKeySecret: "key secret", BearerToken: "bearer", ClientID: "client", ClientSecret: "client secret"}
+	if got != want {
+		t.Errorf("creds = %+v, want %+v", got, want)
+	}
+
+	os.Setenv("TWITTER_CREDS_FILE", filepath.Join(filepath.Dir(path), "missing.json"))
+	if _, err := creds(context.Background()); err == nil {
+		t.Errorf("creds succeeded with a missing file")
+	}
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	os.Setenv("TWITTER_CREDS_FILE", path)
+	if _, err := creds(context.Background()); err == nil {
+		t.Errorf("creds succeeded with invalid JSON")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+	"google.golang.org/api/sheets/v4"
+)
+
+// updatedRowRe extracts the first row number from an A1 range like
+// "Tweets!A10:Z10" or "'Saved Tweets'!A10:Z10".
+var updatedRowRe = regexp.MustCompile(`![A-Z]+([0-9]+)`)
+
+// saveTweetHandler saves the tweet linked in the url form field, bypassing
+// the DM flow. Requests have to use HTTP basic auth with the OAuth token and
+// token secret of the bot account as username and password.
+func saveTweetHandler(botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+
+		user, twClient, ok := authenticateBot(w, r, botUserIDs)
+		if !ok {
+			return
+		}
+
+		m := tweetIDRe.FindStringSubmatch(r.FormValue("url"))
+		if m == nil {
+			http.Error(w, fmt.Sprintf("Not a tweet URL: %q", r.FormValue("url")), http.StatusBadRequest)
+			return
+		}
+		row, err := saveTweet(ctx, twClient, m[1], user.IDStr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, row)
+	})
+}
+
+// saveTweet fetches the tweet and appends it to the default spreadsheet,
+// returning the number of the row it was written to. sheetsMu is only held
+// for reading the header and appending, not while the tweet is fetched.
+func saveTweet(ctx context.Context, twClient *twitter.Client, tweetID string, senderID string) (int, error) {
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return 0, err
+	}
+	vars := rcService.Projects.Configs.Variables
+	spreadsheetID, err := vars.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		return 0, fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	cfg, err := loadConfig(vars)
+	if err != nil {
+		return 0, fmt.Errorf("loading config: %w", err)
+	}
+	sheetName, err := loadSheetName(vars)
+	if err != nil {
+		return 0, fmt.Errorf("loading sheet name: %w", err)
+	}
+	sheetsService, err := sheets.NewService(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create sheets service: %w", err)
+	}
+	id, err := strconv.ParseInt(tweetID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing tweet ID %q: %w", tweetID, err)
+	}
+	tweet, _, err := twClient.Statuses.Show(id, &twitter.StatusShowParams{IncludeEntities: twitter.Bool(true), TweetMode: "extended"})
+	if err != nil {
+		return 0, fmt.Errorf("fetching tweet %s: %w", tweetID, err)
+	}
+
+	now := time.Now()
+	data := map[string]interface{}{
+		"sender_id":    senderID,
+		"instance_id":  instanceID(cfg),
+		"submitted_at": now.UTC().Format(time.RFC3339),
+		"archived_at":  archivedAt(now),
+	}
+	if age, err := ageAtSave(tweet, now); err != nil {
+		logWarning(logFields{"tweet_id": tweetID}, "Failed to compute age of tweet: %s", err)
+	} else {
+		data["age_at_save"] = age
+	}
+	updateComputedFields(data, tweet)
+	data = applyTransform(ctx, cfg, data)
+
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		return 0, fmt.Errorf("getting spreadsheet header: %w", err)
+	}
+	row, err := tweetToRow(data, header)
+	if err != nil {
+		return 0, fmt.Errorf("converting tweet %s into a row: %w", tweetID, err)
+	}
+
+	var resp *sheets.AppendValuesResponse
+	appendRow := func() error {
+		return retrySheetsAppend(ctx, logFields{"tweet_id": tweetID}, func() error {
+			var err error
+			resp, err = sheetsService.Spreadsheets.Values.Append(spreadsheetID.Text, sheetRange(sheetName, "A1"), &sheets.ValueRange{
+				Values: [][]interface{}{row},
+			}).ValueInputOption("USER_ENTERED").Do()
+			return err
+		})
+	}
+	err = appendRow()
+	if err != nil && cfg.AutoExpandGrid && isGridLimitError(err) {
+		if err := expandSheet(ctx, sheetsService, spreadsheetID.Text, sheetName, gridExpandRows); err != nil {
+			return 0, fmt.Errorf("expanding sheet %q: %w", sheetName, err)
+		}
+		err = appendRow()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("appending tweet %s: %w", tweetID, err)
+	}
+	if resp.Updates == nil {
+		return 0, fmt.Errorf("appending tweet %s: no updated range in the response", tweetID)
+	}
+	m := updatedRowRe.FindStringSubmatch(resp.Updates.UpdatedRange)
+	if m == nil {
+		return 0, fmt.Errorf("unexpected updated range %q", resp.Updates.UpdatedRange)
+	}
+	return strconv.Atoi(m[1])
+}
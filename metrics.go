@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+const defaultMetricsPrefix = "tweet_saver"
+
+// pollMetrics counts what happened during a single poll.
+type pollMetrics struct {
+	EventsFetched  int64
+	TweetsAppended int64
+	TweetsUpdated  int64
+	Errors         int64
+	Throttles      int64
+}
+
+func (m *pollMetrics) add(o *pollMetrics) {
+	m.EventsFetched += o.EventsFetched
+	m.TweetsAppended += o.TweetsAppended
+	m.TweetsUpdated += o.TweetsUpdated
+	m.Errors += o.Errors
+	m.Throttles += o.Throttles
+}
+
+// metricTotals adds up the metrics of all polls since the process started,
+// for /metrics.
+type metricTotals struct {
+	mu            sync.Mutex
+	tweetsSaved   int64
+	tweetsUpdated int64
+	pollErrors    int64
+	throttles     int64
+	lastPoll      time.Time
+	// Rows written by the last metric refresh.
+	refreshUpdated int64
+	lastRefresh    time.Time
+}
+
+var totals = &metricTotals{}
+
+func (t *metricTotals) add(m *pollMetrics, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tweetsSaved += m.TweetsAppended
+	t.tweetsUpdated += m.TweetsUpdated
+	t.pollErrors += m.Errors
+	t.throttles += m.Throttles
+	t.lastPoll = at
+}
+
+func (t *metricTotals) addRefresh(updated int, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshUpdated = int64(updated)
+	t.lastRefresh = at
+}
+
+// ServeHTTP writes the totals in the Prometheus text format.
+func (t *metricTotals) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name  string
+		kind  string
+		help  string
+		value int64
+	}{
+		{"tweets_saved_total", "counter", "Rows appended for newly saved tweets.", t.tweetsSaved},
+		{"tweets_updated_total", "counter", "Rows updated with new notes.", t.tweetsUpdated},
+		{"poll_errors_total", "counter", "Errors during polls.", t.pollErrors},
+		{"throttles_total", "counter", "Times a poll waited for the Twitter rate limit.", t.throttles},
+		{"last_poll_timestamp", "gauge", "Unix time of the end of the last poll.", t.lastPoll.Unix()},
+		{"refresh_rows_updated", "gauge", "Rows whose counts changed in the last metric refresh.", t.refreshUpdated},
+	} {
+		if m.name == "last_poll_timestamp" && t.lastPoll.IsZero() {
+			continue
+		}
+		if m.name == "refresh_rows_updated" && t.lastRefresh.IsZero() {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// export writes the counters to Cloud Monitoring as custom gauge metrics
+// named custom.googleapis.com/<prefix>/<counter>, with the prefix taken from
+// METRICS_PREFIX. Outside of GCP it does nothing.
+func (m *pollMetrics) export(ctx context.Context) {
+	project := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if project == "" {
+		return
+	}
+	prefix := os.Getenv("METRICS_PREFIX")
+	if prefix == "" {
+		prefix = defaultMetricsPrefix
+	}
+
+	svc, err := monitoring.NewService(ctx)
+	if err != nil {
+		log.Printf("Failed to create monitoring client: %s", err)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	series := []*monitoring.TimeSeries{}
+	for _, c := range []struct {
+		name  string
+		value int64
+	}{
+		{"events_fetched", m.EventsFetched},
+		{"tweets_appended", m.TweetsAppended},
+		{"tweets_updated", m.TweetsUpdated},
+		{"errors", m.Errors},
+		{"throttles", m.Throttles},
+	} {
+		value := c.value
+		series = append(series, &monitoring.TimeSeries{
+			Metric: &monitoring.Metric{Type: fmt.Sprintf("custom.googleapis.com/%s/%s", prefix, c.name)},
+			Resource: &monitoring.MonitoredResource{
+				Type:   "global",
+				Labels: map[string]string{"project_id": project},
+			},
+			MetricKind: "GAUGE",
+			ValueType:  "INT64",
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{EndTime: now},
+				Value:    &monitoring.TypedValue{Int64Value: &value},
+			}},
+		})
+	}
+	_, err = svc.Projects.TimeSeries.Create("projects/"+project, &monitoring.CreateTimeSeriesRequest{TimeSeries: series}).Context(ctx).Do()
+	if err != nil {
+		log.Printf("Failed to export poll metrics: %s", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// multiError collects the errors of independent writes, so that one failing
+// doesn't hide or stop the others.
+type multiError []error
+
+// add appends err, flattening it if it's a multiError itself.
+func (m *multiError) add(err error) {
+	if err == nil {
+		return
+	}
+	if o, ok := err.(multiError); ok {
+		*m = append(*m, o...)
+		return
+	}
+	*m = append(*m, err)
+}
+
+func (m multiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+	s := []string{}
+	for _, err := range m {
+		s = append(s, err.Error())
+	}
+	return fmt.Sprintf("%d errors: %s", len(m), strings.Join(s, "; "))
+}
+
+// err returns nil if there are no errors, or the only one if there's one.
+func (m multiError) err() error {
+	switch len(m) {
+	case 0:
+		return nil
+	case 1:
+		return m[0]
+	default:
+		return m
+	}
+}
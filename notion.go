@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const (
+	notionAPI     = "https://api.notion.com/v1"
+	notionVersion = "2022-06-28"
+
+	maxNotionRetries   = 5
+	initialNotionDelay = time.Second
+
+	// Notion takes at most 2000 characters per piece of rich text, and 100
+	// pieces per property.
+	notionTextLimit  = 2000
+	notionTextPieces = 100
+)
+
+// notionProperty is a property of the Notion database and the field saved
+// in it.
+type notionProperty struct {
+	field string
+	name  string
+	kind  string
+}
+
+// notionProperties are the properties the database must have, with these
+// names and types. Target holds the spreadsheet ID the sender is mapped to,
+// so the whitelist works the same as with the other backends.
+var notionProperties = []notionProperty{
+	{"text", "Text", "title"},
+	{"url", "URL", "url"},
+	{"author", "Author", "rich_text"},
+	{"notes", "Notes", "rich_text"},
+	{"json", "JSON", "rich_text"},
+}
+
+const notionTargetProperty = "Target"
+
+// notionStore creates a page per tweet in a Notion database. Row numbers are
+// positions in the list of pages returned by LastStored, starting at 1.
+type notionStore struct {
+	client     *http.Client
+	token      string
+	databaseID string
+	pages      []string
+	updates    map[string][]notionUpdate
+	appends    map[string][]pendingAppend
+}
+
+type notionUpdate struct {
+	row    int
+	values []interface{}
+}
+
+func newNotionStore(token string, databaseID string) (*notionStore, error) {
+	if token == "" || databaseID == "" {
+		return nil, fmt.Errorf("NOTION_TOKEN and NOTION_DATABASE_ID must be set")
+	}
+	return &notionStore{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		token:      token,
+		databaseID: databaseID,
+		updates:    map[string][]notionUpdate{},
+		appends:    map[string][]pendingAppend{},
+	}, nil
+}
+
+// notionError is the body of a failed Notion API response.
+type notionError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *notionError) Error() string {
+	return fmt.Sprintf("notion: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// do sends a request to the Notion API and decodes the response into out.
+// Rate limited and 5xx responses are retried up to maxNotionRetries times,
+// waiting for Retry-After if Notion sent it, or with exponential backoff and
+// jitter.
+func (s *notionStore) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	delay := initialNotionDelay
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequestWithContext(ctx, method, notionAPI+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		req.Header.Set("Notion-Version", notionVersion)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusOK {
+			if out == nil {
+				return nil
+			}
+			return json.Unmarshal(b, out)
+		}
+		apiErr := &notionError{Status: resp.StatusCode}
+		if err := json.Unmarshal(b, apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(b))
+		}
+		if retry >= maxNotionRetries || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500) {
+			return apiErr
+		}
+		wait := delay + time.Duration(rand.Int63n(int64(delay)))
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		logWarning(logFields{"notion_path": path}, "Notion request failed, retrying in %s (%d/%d): %s", wait, retry+1, maxNotionRetries, apiErr)
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// Header checks that the database has the expected properties, and returns
+// the fields saved in them, the same for all targets.
+func (s *notionStore) Header(ctx context.Context, target string) ([]string, error) {
+	db := struct {
+		Properties map[string]struct {
+			Type string `json:"type"`
+		} `json:"properties"`
+	}{}
+	if err := s.do(ctx, http.MethodGet, "/databases/"+s.databaseID, nil, &db); err != nil {
+		return nil, fmt.Errorf("fetching database %s: %w", s.databaseID, err)
+	}
+	header := []string{}
+	for _, p := range append(notionProperties, notionProperty{"", notionTargetProperty, "rich_text"}) {
+		if db.Properties[p.name].Type != p.kind {
+			return nil, fmt.Errorf("database %s has no %s property of type %s", s.databaseID, p.name, p.kind)
+		}
+		if p.field != "" {
+			header = append(header, p.field)
+		}
+	}
+	return header, nil
+}
+
+// notionPage is the part of a page we read back.
+type notionPage struct {
+	ID         string `json:"id"`
+	Properties map[string]struct {
+		RichText []struct {
+			PlainText string `json:"plain_text"`
+		} `json:"rich_text"`
+	} `json:"properties"`
+}
+
+func (p *notionPage) text(property string) string {
+	r := ""
+	for _, t := range p.Properties[property].RichText {
+		r += t.PlainText
+	}
+	return r
+}
+
+// LastStored reads the JSON of all pages of the target. Notion only orders
+// pages by creation time to the minute, so they are ordered by the time of
+// the DM that submitted them instead, which is the order rows are appended
+// in.
+func (s *notionStore) LastStored(ctx context.Context, target string, header []string, senders map[string]string, allIDs map[string]bool) (map[string]storedTweetInfo, map[string]map[string]bool, error) {
+	pages := []notionPage{}
+	cursor := ""
+	for {
+		query := map[string]interface{}{
+			"filter": map[string]interface{}{
+				"property":  notionTargetProperty,
+				"rich_text": map[string]interface{}{"equals": target},
+			},
+			"sorts":     []interface{}{map[string]interface{}{"timestamp": "created_time", "direction": "ascending"}},
+			"page_size": 100,
+		}
+		if cursor != "" {
+			query["start_cursor"] = cursor
+		}
+		resp := struct {
+			Results    []notionPage `json:"results"`
+			HasMore    bool         `json:"has_more"`
+			NextCursor string       `json:"next_cursor"`
+		}{}
+		if err := s.do(ctx, http.MethodPost, "/databases/"+s.databaseID+"/query", query, &resp); err != nil {
+			return nil, nil, fmt.Errorf("querying database %s: %w", s.databaseID, err)
+		}
+		pages = append(pages, resp.Results...)
+		if !resp.HasMore || resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+
+	stored := []storedTweetInfo{}
+	dmTimes := []string{}
+	for i := range pages {
+		j := pages[i].text("JSON")
+		stored = append(stored, storedTweetInfo{JSON: j})
+		data := struct {
+			DMCreatedAt string `json:"dm_created_at"`
+		}{}
+		json.Unmarshal([]byte(j), &data)
+		dmTimes = append(dmTimes, data.DMCreatedAt)
+	}
+	order := make([]int, len(pages))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return eventIDLess(dmTimes[order[a]], dmTimes[order[b]])
+	})
+	rows := []storedTweetInfo{}
+	for _, i := range order {
+		s.pages = append(s.pages, pages[i].ID)
+		info := stored[i]
+		info.Row = len(s.pages)
+		rows = append(rows, info)
+	}
+	return lastStoredTweets(rows, senders, allIDs)
+}
+
+func (s *notionStore) Update(target string, row int, values []interface{}) {
+	s.updates[target] = append(s.updates[target], notionUpdate{row: row, values: values})
+}
+
+func (s *notionStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.appends[target] = append(s.appends[target], pendingAppend{event: first, row: values})
+}
+
+// Flush writes the pages of each target in turn. Pages are written one
+// request at a time, so a target that fails halfway keeps the writes that
+// weren't made yet for the next flush.
+func (s *notionStore) Flush(ctx context.Context) (updated int, appended int, failed map[string]bool, err error) {
+	failed = map[string]bool{}
+	errs := multiError{}
+	targets := map[string]bool{}
+	for t := range s.updates {
+		targets[t] = true
+	}
+	for t := range s.appends {
+		targets[t] = true
+	}
+	for target := range targets {
+		u, a, err := s.flushTarget(ctx, target)
+		updated += u
+		appended += a
+		if err != nil {
+			failed[target] = true
+			errs.add(fmt.Errorf("writing pages of %s: %w", target, err))
+		}
+	}
+	return updated, appended, failed, errs.err()
+}
+
+func (s *notionStore) flushTarget(ctx context.Context, target string) (updated int, appended int, err error) {
+	for len(s.updates[target]) > 0 {
+		u := s.updates[target][0]
+		if u.row < 1 || u.row > len(s.pages) {
+			return updated, appended, fmt.Errorf("no page for row %d", u.row)
+		}
+		body := map[string]interface{}{"properties": s.properties(target, u.values)}
+		if err := s.do(ctx, http.MethodPatch, "/pages/"+s.pages[u.row-1], body, nil); err != nil {
+			return updated, appended, fmt.Errorf("updating row %d: %w", u.row, err)
+		}
+		s.updates[target] = s.updates[target][1:]
+		updated++
+	}
+	delete(s.updates, target)
+
+	sortPendingAppends(s.appends[target])
+	for len(s.appends[target]) > 0 {
+		p := s.appends[target][0]
+		page := notionPage{}
+		body := map[string]interface{}{
+			"parent":     map[string]interface{}{"database_id": s.databaseID},
+			"properties": s.properties(target, p.row),
+		}
+		if err := s.do(ctx, http.MethodPost, "/pages", body, &page); err != nil {
+			return updated, appended, fmt.Errorf("creating page: %w", err)
+		}
+		s.pages = append(s.pages, page.ID)
+		s.appends[target] = s.appends[target][1:]
+		appended++
+	}
+	delete(s.appends, target)
+	return updated, appended, nil
+}
+
+// properties converts a row made by tweetToRow into page properties,
+// dropping the apostrophe that only tells Sheets to keep text columns as is.
+func (s *notionStore) properties(target string, row []interface{}) map[string]interface{} {
+	r := map[string]interface{}{
+		notionTargetProperty: map[string]interface{}{"rich_text": notionText(target)},
+	}
+	for i, p := range notionProperties {
+		v := ""
+		if i < len(row) && row[i] != nil {
+			v = fmt.Sprint(row[i])
+		}
+		if textColumns[p.field] {
+			v = strings.TrimPrefix(v, "'")
+		}
+		switch p.kind {
+		case "title":
+			r[p.name] = map[string]interface{}{"title": notionText(v)}
+		case "url":
+			if v == "" {
+				r[p.name] = map[string]interface{}{"url": nil}
+			} else {
+				r[p.name] = map[string]interface{}{"url": v}
+			}
+		default:
+			r[p.name] = map[string]interface{}{"rich_text": notionText(v)}
+		}
+	}
+	return r
+}
+
+// notionText splits s into as many pieces of rich text as Notion needs.
+// Text beyond what a property can hold is dropped.
+func notionText(s string) []interface{} {
+	r := []interface{}{}
+	runes := []rune(s)
+	for len(runes) > 0 && len(r) < notionTextPieces {
+		n := len(runes)
+		if n > notionTextLimit {
+			n = notionTextLimit
+		}
+		r = append(r, map[string]interface{}{
+			"type": "text",
+			"text": map[string]interface{}{"content": string(runes[:n])},
+		})
+		runes = runes[n:]
+	}
+	return r
+}
+
+func (s *notionStore) Close() error {
+	return nil
+}
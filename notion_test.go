@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// fakeNotion is a Notion database holding pages in memory. The first
+// request to create a page is rate limited.
+type fakeNotion struct {
+	mu          sync.Mutex
+	pages       []map[string]interface{}
+	ids         []string
+	patched     map[string]map[string]interface{}
+	rateLimited bool
+}
+
+func (f *fakeNotion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Notion-Version") != notionVersion {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": 401, "code": "unauthorized", "message": "API token is invalid."})
+		return
+	}
+	body := map[string]interface{}{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/databases/db":
+		props := map[string]interface{}{"Target": map[string]string{"type": "rich_text"}}
+		for _, p := range notionProperties {
+			props[p.name] = map[string]string{"type": p.kind}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"properties": props})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/databases/db/query":
+		// Two pages per response.
+		start := 0
+		if c, ok := body["start_cursor"].(string); ok {
+			fmt.Sscan(c, &start)
+		}
+		end := start + 2
+		if end > len(f.pages) {
+			end = len(f.pages)
+		}
+		results := []interface{}{}
+		for i := start; i < end; i++ {
+			results = append(results, map[string]interface{}{"id": f.ids[i], "properties": f.pages[i]})
+		}
+		resp := map[string]interface{}{"results": results, "has_more": end < len(f.pages)}
+		if end < len(f.pages) {
+			resp["next_cursor"] = fmt.Sprint(end)
+		}
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/pages":
+		if !f.rateLimited {
+			f.rateLimited = true
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": 429, "code": "rate_limited", "message": "Slow down"})
+			return
+		}
+		id := fmt.Sprintf("page-%d", len(f.ids)+1)
+		f.ids = append(f.ids, id)
+		f.pages = append(f.pages, readableProperties(body["properties"]))
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id})
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/v1/pages/"):
+		f.patched[strings.TrimPrefix(r.URL.Path, "/v1/pages/")] = readableProperties(body["properties"])
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": 404, "code": "object_not_found", "message": r.URL.Path})
+	}
+}
+
+// readableProperties adds the plain_text Notion returns for rich text that
+// was written.
+func readableProperties(v interface{}) map[string]interface{} {
+	props, _ := v.(map[string]interface{})
+	for _, p := range props {
+		texts, _ := p.(map[string]interface{})["rich_text"].([]interface{})
+		for _, t := range texts {
+			t := t.(map[string]interface{})
+			t["plain_text"] = t["text"].(map[string]interface{})["content"]
+		}
+	}
+	return props
+}
+
+// redirectTransport sends requests to a test server instead.
+type redirectTransport struct {
+	to *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.to.Scheme, t.to.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func newTestNotionStore(t *testing.T, f *fakeNotion) *notionStore {
+	t.Helper()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	s, err := newNotionStore("token", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.client = &http.Client{Transport: redirectTransport{u}}
+	return s
+}
+
+func TestNotionStore(t *testing.T) {
+	f := &fakeNotion{patched: map[string]map[string]interface{}{}}
+	tw := newFakeTwitter()
+	events := []twitter.DirectMessageEvent{}
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprint(100 + i)
+		tw.tweets[id] = testTweet(id, "50", "tweet "+id)
+		events = append(events, dmEvent(fmt.Sprint(i), int64(1000*i), "7", "", id))
+	}
+	processEvents(t, &Config{SenderWorkers: 1}, tw, newTestNotionStore(t, f), events, nil)
+	if len(f.pages) != 3 || !f.rateLimited {
+		t.Fatalf("created %d pages, rate limited %t, want 3 pages after a rate limit", len(f.pages), f.rateLimited)
+	}
+	title := f.pages[0]["Text"].(map[string]interface{})["title"].([]interface{})[0].(map[string]interface{})["text"].(map[string]interface{})["content"]
+	if title != "tweet 101" || f.pages[0]["URL"].(map[string]interface{})["url"] != "https://twitter.com/user50/status/101" {
+		t.Errorf("first page = %v", f.pages[0])
+	}
+
+	// A later note updates the page of the last tweet, found across two
+	// pages of query results.
+	events = append(events, dmEvent("4", 4000, "7", "a note", ""))
+	processEvents(t, &Config{SenderWorkers: 1}, tw, newTestNotionStore(t, f), events, nil)
+	notes, ok := f.patched["page-3"]["Notes"]
+	if len(f.pages) != 3 || !ok || !strings.Contains(fmt.Sprint(notes), "a note") {
+		t.Errorf("after the note: %d pages, patched %v, want page-3 patched with the note", len(f.pages), f.patched)
+	}
+}
+
+func TestNotionErrors(t *testing.T) {
+	s := newTestNotionStore(t, &fakeNotion{})
+	s.token = "wrong"
+	_, err := s.Header(context.Background(), "ss")
+	var apiErr *notionError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Errorf("Header with a bad token = %v, want a 401 notionError", err)
+	}
+	if _, err := newNotionStore("", "db"); err == nil {
+		t.Errorf("newNotionStore accepted an empty token")
+	}
+	if got := notionText(strings.Repeat("a", notionTextLimit+1)); len(got) != 2 {
+		t.Errorf("notionText split %d characters into %d pieces, want 2", notionTextLimit+1, len(got))
+	}
+}
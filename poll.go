@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tweetCard is the card attached to a tweet. v1.1 only returns it when
+// asked for with include_cards, which go-twitter doesn't support.
+type tweetCard struct {
+	Name          string `json:"name"`
+	BindingValues map[string]struct {
+		StringValue  string `json:"string_value"`
+		BooleanValue bool   `json:"boolean_value"`
+	} `json:"binding_values"`
+}
+
+// tweetPoll is what's stored in the poll field.
+type tweetPoll struct {
+	Options []pollOption `json:"options"`
+	EndsAt  string       `json:"ends_at,omitempty"`
+	Final   bool         `json:"final"`
+}
+
+type pollOption struct {
+	Label string `json:"label"`
+	Votes int    `json:"votes"`
+}
+
+// fetchPoll fetches the card of the tweet and returns its poll, or nil if
+// the tweet has no poll.
+func fetchPoll(httpClient *http.Client, tweetID string) (*tweetPoll, error) {
+	params := url.Values{}
+	params.Set("id", tweetID)
+	params.Set("trim_user", "true")
+	params.Set("include_cards", "1")
+	params.Set("cards_platform", "Web-12")
+	httpResp, err := httpClient.Get("https://api.twitter.com/1.1/statuses/show.json?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching card: unexpected status %q", httpResp.Status)
+	}
+	r := struct {
+		Card *tweetCard `json:"card"`
+	}{}
+	if err := json.NewDecoder(httpResp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decoding card: %w", err)
+	}
+	if r.Card == nil {
+		return nil, nil
+	}
+	return pollFromCard(r.Card), nil
+}
+
+// pollFromCard reads a poll card, named like "poll2choice_text_only", which
+// has a choiceN_label and a choiceN_count binding value for each option.
+func pollFromCard(c *tweetCard) *tweetPoll {
+	if !strings.HasPrefix(c.Name, "poll") {
+		return nil
+	}
+	r := &tweetPoll{
+		EndsAt: c.BindingValues["end_datetime_utc"].StringValue,
+		Final:  c.BindingValues["counts_are_final"].BooleanValue,
+	}
+	if t, err := time.Parse(time.RFC3339, r.EndsAt); err == nil {
+		r.EndsAt = t.UTC().Format(time.RFC3339)
+	}
+	for i := 1; ; i++ {
+		label, ok := c.BindingValues[fmt.Sprintf("choice%d_label", i)]
+		if !ok {
+			break
+		}
+		votes, _ := strconv.Atoi(c.BindingValues[fmt.Sprintf("choice%d_count", i)].StringValue)
+		r.Options = append(r.Options, pollOption{Label: label.StringValue, Votes: votes})
+	}
+	return r
+}
+
+// applyPoll stores the poll as compact JSON in the poll field.
+func applyPoll(data map[string]interface{}, poll *tweetPoll) error {
+	b, err := json.Marshal(poll)
+	if err != nil {
+		return err
+	}
+	data["poll"] = string(b)
+	return nil
+}
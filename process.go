@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// storedState is what a poll needs to know about the tweets already stored.
+type storedState struct {
+	// Per target spreadsheet: its header and, only when deduplicating, the
+	// set of all tweet IDs stored in it.
+	headers   map[string][]string
+	storedIDs map[string]map[string]bool
+	// Senders map to a single spreadsheet, so their last stored tweets can
+	// share one map.
+	lastTweetID map[string]storedTweetInfo
+	// IDs of all tweets stored for each sender, used to re-create rows that
+	// were deleted by hand.
+	storedBySender map[string]map[string]bool
+}
+
+func loadStoredState(ctx context.Context, cfg *Config, store Store, senderWhitelist map[string]string, senderSpreadsheets map[string]string) (*storedState, error) {
+	r := &storedState{
+		headers:        map[string][]string{},
+		storedIDs:      map[string]map[string]bool{},
+		lastTweetID:    map[string]storedTweetInfo{},
+		storedBySender: map[string]map[string]bool{},
+	}
+	for ssID, senders := range sendersBySpreadsheet(senderWhitelist, senderSpreadsheets) {
+		header, err := store.Header(ctx, ssID)
+		if err != nil {
+			return nil, fmt.Errorf("getting header of spreadsheet %s: %w", ssID, err)
+		}
+		r.headers[ssID] = header
+		if cfg.DedupeGlobally {
+			r.storedIDs[ssID] = map[string]bool{}
+		}
+		last, stored, err := store.LastStored(ctx, ssID, header, senders, r.storedIDs[ssID])
+		if err != nil {
+			return nil, fmt.Errorf("getting last stored tweet ID in spreadsheet %s: %w", ssID, err)
+		}
+		for sender, info := range last {
+			r.lastTweetID[sender] = info
+		}
+		for sender, ids := range stored {
+			r.storedBySender[sender] = ids
+		}
+	}
+	return r, nil
+}
+
+// eventProcessor turns DM events into rows, which it queues in the store.
+// It's separate from fetching the events so that /replay can feed it
+// captured ones.
+type eventProcessor struct {
+	ds         *datastore.Client
+	cfg        *Config
+	httpClient *http.Client
+	twClient   *twitter.Client
+	store      Store
+	stored     *storedState
+	names      *senderNames
+	parents    *parentTweets
+	archiver   *mediaArchiver
+	metrics    *pollMetrics
+	// Set if tweets are fetched from the v2 API.
+	v2Client *http.Client
+	// ID of the bot account the events were sent to.
+	account string
+	// Set by polls to move the DM cursor of a sender at checkpoints.
+	advanceCursor func(ctx context.Context, sender string, eventID string) error
+	// Set by polls to skip events whose tweets were written recently.
+	processed *processedEvents
+	// Set by polls to the DM cursor of each sender, see orphanNotes.
+	senderCursors map[string]string
+	// Record rejected tweets, and find the ones recorded already, so that
+	// polls going over the same events again don't reject them again.
+	deadLetter      func(ctx context.Context, dl *DeadLetter) error
+	findDeadLetters func(ctx context.Context, names []string) (map[string]bool, error)
+	// Set if max_saves_per_sender_per_hour is, reports whether the sender
+	// may save another tweet and counts it.
+	allowSave func(ctx context.Context, sender string) (bool, error)
+	// First event of the oldest group of each sender that failed in a way
+	// worth retrying, such as a tweet that couldn't be fetched. Cursors
+	// are kept behind it, see capCursor.
+	retryFrom map[string]string
+	// Guards the store, metrics and stored IDs shared by the workers of
+	// process.
+	mu *sync.Mutex
+}
+
+func newEventProcessor(ctx context.Context, ds *datastore.Client, account string, cfg *Config, httpClient *http.Client, twClient *twitter.Client, store Store, stored *storedState, metrics *pollMetrics) (*eventProcessor, error) {
+	p := &eventProcessor{
+		ds:         ds,
+		account:    account,
+		cfg:        cfg,
+		httpClient: httpClient,
+		twClient:   twClient,
+		store:      store,
+		stored:     stored,
+		names:      newSenderNames(twClient),
+		parents:    newParentTweets(twClient),
+		metrics:    metrics,
+		retryFrom:  map[string]string{},
+		mu:         &sync.Mutex{},
+	}
+	if ds != nil {
+		p.deadLetter = func(ctx context.Context, dl *DeadLetter) error {
+			return deadLetter(ctx, ds, dl)
+		}
+		p.findDeadLetters = func(ctx context.Context, names []string) (map[string]bool, error) {
+			return findDeadLetters(ctx, ds, names)
+		}
+	}
+	if cfg.MaxSavesPerSenderPerHour > 0 {
+		p.allowSave = func(ctx context.Context, sender string) (bool, error) {
+			return allowSenderSave(ctx, ds, sender, cfg.MaxSavesPerSenderPerHour, time.Now(), cfg.DryRun)
+		}
+	}
+	if cfg.TwitterAPIVersion == "2" {
+		appCreds, err := clients.appCredentials(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get app credentials: %w", err)
+		}
+		p.v2Client = bearerHTTPClient(appCreds.BearerToken)
+	}
+	if cfg.MediaArchiveBucket != "" && !cfg.DryRun {
+		archiver, err := newMediaArchiver(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage service: %w", err)
+		}
+		p.archiver = archiver
+	}
+	return p, nil
+}
+
+// process saves the tweets linked in the events of whitelisted senders.
+// senderWhitelist is the whitelist the events were fetched with, senders no
+// longer in currentWhitelist are skipped.
+func (p *eventProcessor) process(ctx context.Context, events []twitter.DirectMessageEvent, senderWhitelist map[string]string, currentWhitelist map[string]string, senderSpreadsheets map[string]string) {
+	sortEventsByTime(events)
+	eventsBySender := map[string][]twitter.DirectMessageEvent{}
+	for _, e := range events {
+		if e.Type != "message_create" || e.Message == nil {
+			continue
+		}
+		if _, ok := senderWhitelist[e.Message.SenderID]; !ok {
+			continue
+		}
+		eventsBySender[e.Message.SenderID] = append(eventsBySender[e.Message.SenderID], e)
+	}
+
+	// Senders are processed in parallel. Each worker queues its writes in
+	// a buffer, which is moved into the store once the sender is done. The
+	// store orders appended rows by DM time when flushing, so the order in
+	// which senders finish doesn't matter.
+	workers := p.cfg.SenderWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	senders := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sender := range senders {
+				w := p.worker()
+				w.processSender(ctx, sender, eventsBySender[sender], senderWhitelist, currentWhitelist, senderSpreadsheets)
+				p.merge(w)
+			}
+		}()
+	}
+	for sender := range eventsBySender {
+		senders <- sender
+	}
+	close(senders)
+	wg.Wait()
+}
+
+// processSender saves the tweets linked in the events of a single sender.
+func (p *eventProcessor) processSender(ctx context.Context, sender string, events []twitter.DirectMessageEvent, senderWhitelist map[string]string, currentWhitelist map[string]string, senderSpreadsheets map[string]string) {
+	if _, ok := currentWhitelist[sender]; !ok {
+		logWarning(logFields{"sender_id": sender}, "Sender %q was removed from the whitelist, skipping %d events", senderWhitelist[sender], len(events))
+		return
+	}
+	groups := groupDMsPerTweet(events, p.cfg)
+	for i, group := range groups {
+		// Groups before the one with the last stored tweet are only
+		// saved if their row is missing, i.e. it was deleted by hand.
+		if group.TweetID != "" && group.TweetID == p.stored.lastTweetID[sender].ID {
+			missing := []dmGroup{}
+			for _, g := range groups[:i] {
+				if g.TweetID != "" && !p.stored.storedBySender[sender][g.TweetID] {
+					logInfo(logFields{"tweet_id": g.TweetID, "sender_id": sender}, "Tweet is older than the last stored one but missing from the spreadsheet, re-creating its row")
+					missing = append(missing, g)
+				}
+			}
+			groups = append(missing, groups[i:]...)
+			break
+		}
+	}
+	ssID := senderSpreadsheets[sender]
+	header := p.stored.headers[ssID]
+	deadLetters := map[string]bool{}
+	if p.findDeadLetters != nil {
+		names := []string{}
+		for _, g := range groups {
+			if g.TweetID != "" {
+				names = append(names, deadLetterName(g.linkEventID(), g.TweetID))
+			}
+		}
+		var err error
+		if deadLetters, err = p.findDeadLetters(ctx, names); err != nil {
+			// They get rejected again, which is harmless.
+			logWarning(logFields{"sender_id": sender}, "Failed to look up rejected tweets: %s", err)
+			deadLetters = map[string]bool{}
+		}
+	}
+	appended := 0
+	retryFrom := ""
+	checkpoints := p.advanceCursor != nil && p.cfg.CheckpointEvery > 0 && !p.cfg.DryRun
+	for _, group := range groups {
+		data := map[string]interface{}{
+			"sender_id":       sender,
+			"sender_username": senderWhitelist[sender],
+		}
+		tweetID := group.TweetID
+		if tweetID == "" {
+			p.orphanNotes(ctx, sender, ssID, header, group)
+			continue
+		}
+		if tweetID == p.stored.lastTweetID[sender].ID {
+			if err := json.Unmarshal([]byte(p.stored.lastTweetID[sender].JSON), &data); err != nil {
+				logError(logFields{"tweet_id": tweetID, "sender_id": sender, "row": p.stored.lastTweetID[sender].Row}, "Failed to parse JSON from the spreadsheet: %s\nJSON: %q", err, p.stored.lastTweetID[sender].JSON)
+				p.metrics.Errors++
+				continue
+			}
+			data["notes"] = groupToNotes(group.Events, tweetID)
+			applyNoteTags(data)
+			data = applyTransform(ctx, p.cfg, data)
+			row, err := tweetToRow(data, header)
+			if err != nil {
+				logError(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to convert data into a row: %s", err)
+				p.metrics.Errors++
+				continue
+			}
+			p.store.Update(ssID, p.stored.lastTweetID[sender].Row, row)
+			continue
+		}
+		if p.isStored(ssID, tweetID) {
+			logInfo(logFields{"tweet_id": tweetID, "sender_id": sender}, "Tweet is already in the spreadsheet, skipping")
+			continue
+		}
+		if deadLetters[deadLetterName(group.linkEventID(), tweetID)] {
+			logDebug(logFields{"tweet_id": tweetID, "sender_id": sender}, "Tweet was rejected already, skipping")
+			continue
+		}
+		if p.processed != nil && p.processed.seen(group.Events[0].ID, time.Now()) {
+			logWarning(logFields{"tweet_id": tweetID, "sender_id": sender, "event_id": group.Events[0].ID}, "DM event was already saved in the last %s, skipping", processedEventRetention)
+			continue
+		}
+		// Checked before fetching anything, so that a flooding sender
+		// doesn't use up the rate limits either.
+		if p.allowSave != nil {
+			allowed, err := p.allowSave(ctx, sender)
+			if err != nil {
+				// Better to save a few too many than to lose tweets.
+				logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to check the save limit of the sender: %s", err)
+			} else if !allowed {
+				logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Sender saved %d tweets in the last hour already, skipping", p.cfg.MaxSavesPerSenderPerHour)
+				continue
+			}
+		}
+		// Set if the tweet is deleted or protected, or if the group is
+		// media attached to the DM rather than a tweet. Its row is still
+		// written so that curators know it was submitted.
+		status := ""
+		var tweet *twitter.Tweet
+		if isDMAttachmentID(tweetID) {
+			status = statusDMAttachment
+		} else {
+			id, err := strconv.ParseInt(tweetID, 10, 64)
+			if err != nil {
+				logError(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to parse tweet ID as int64: %s", err)
+				p.metrics.Errors++
+				continue
+			}
+
+			tweet, err = p.showTweet(id)
+			if err != nil {
+				if status = unavailableTweetStatus(err); status == "" {
+					logError(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to fetch tweet: %s", err)
+					p.metrics.Errors++
+					if retryFrom == "" {
+						retryFrom = group.Events[0].ID
+						p.markRetry(sender, retryFrom)
+					}
+					continue
+				}
+				logInfo(logFields{"tweet_id": tweetID, "sender_id": sender}, "Tweet is %s, saving the row without it", status)
+			}
+		}
+		if status == "" {
+			if p.cfg.RecordResponses {
+				recordResponse(ctx, p.ds, recordedStatusShow, tweetID, tweet)
+			}
+
+			if p.cfg.IgnoreSelfAuthored && tweet.User != nil && tweet.User.IDStr == p.account {
+				logDebug(logFields{"tweet_id": tweetID, "sender_id": sender}, "Tweet is by the bot account, skipping")
+				continue
+			}
+			text := tweetText(tweet)
+			reason, kw := rejectByAuthor(p.cfg, tweet)
+			if reason == "" {
+				reason, kw = rejectByKeywords(p.cfg, text)
+			}
+			if reason != "" {
+				logInfo(logFields{"tweet_id": tweetID, "sender_id": sender}, "Rejecting tweet: %s %q", reason, kw)
+				if p.cfg.DryRun || p.deadLetter == nil {
+					continue
+				}
+				err := p.deadLetter(ctx, &DeadLetter{
+					TweetID:  tweetID,
+					SenderID: sender,
+					EventID:  group.linkEventID(),
+					Reason:   reason,
+					Keyword:  kw,
+					Notes:    groupToNotes(group.Events, tweetID),
+				})
+				if err != nil {
+					logError(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to record rejected tweet: %s", err)
+					p.metrics.Errors++
+				}
+				continue
+			}
+		}
+
+		notes := groupToNotes(group.Events, tweetID)
+		data["notes"] = notes
+		applyNoteTags(data)
+		data["instance_id"] = instanceID(p.cfg)
+		data["archived_at"] = archivedAt(time.Now())
+		data["dm_created_at"] = group.Events[0].CreatedAt
+		data["sender_name"] = p.names.get(sender)
+		updateSubmittedAt(data)
+		if p.cfg.PrioritySenders[sender] {
+			data["priority"] = p.cfg.PriorityValue
+		}
+		if status == statusDMAttachment {
+			applyDMAttachment(data, tweetID, group.Events)
+		} else if status != "" {
+			applyUnavailable(data, tweetID, status)
+		} else {
+			if age, err := ageAtSave(tweet, time.Now()); err != nil {
+				logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to compute age of tweet: %s", err)
+			} else {
+				data["age_at_save"] = age
+			}
+			updateComputedFields(data, tweet)
+			if p.cfg.FetchPolls {
+				if poll, err := fetchPoll(p.httpClient, tweetID); err != nil {
+					logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to fetch the poll: %s", err)
+				} else if poll != nil {
+					if err := applyPoll(data, poll); err != nil {
+						logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to store the poll: %s", err)
+					}
+				}
+			}
+			if tweet.InReplyToStatusID != 0 {
+				if id, err := p.parents.conversationID(tweet); err != nil {
+					logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to find the start of the conversation: %s", err)
+				} else {
+					data["conversation_id"] = id
+				}
+				if parent, err := p.parents.get(tweet.InReplyToStatusID); err != nil {
+					logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to fetch the tweet it replies to: %s", err)
+				} else {
+					data["in_reply_to_tweet"] = parent
+					applyInReplyTo(data, parent)
+				}
+			}
+			if p.archiver != nil {
+				archived, failures := p.archiver.archive(ctx, tweet)
+				data["archived_media"] = strings.Join(archived, "\n")
+				if len(failures) > 0 {
+					data["media_archive_error"] = strings.Join(failures, "\n")
+				}
+			}
+			if p.cfg.UnrollKeyword != nil && p.cfg.UnrollKeyword.re.MatchString(notes) {
+				ancestors, err := fetchAncestors(p.parents, tweet)
+				if err != nil {
+					logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to unroll the thread: %s", err)
+				} else if len(ancestors) > 0 {
+					data["unrolled"] = ancestors
+					applyUnrolled(data, ancestors)
+				}
+			}
+			if p.cfg.ExpandThreads {
+				thread, err := fetchThread(p.twClient, tweet)
+				if err != nil {
+					logWarning(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to expand the thread: %s", err)
+				} else if len(thread) > 0 {
+					data["thread"] = thread
+					applyThread(data, thread)
+				}
+			}
+		}
+		data = applyTransform(ctx, p.cfg, data)
+
+		row, err := tweetToRow(data, header)
+		if err != nil {
+			logError(logFields{"tweet_id": tweetID, "sender_id": sender}, "Failed to convert data into a row: %s", err)
+			p.metrics.Errors++
+			continue
+		}
+		// Another sender may link the same tweet later in this poll.
+		p.markStored(ssID, tweetID)
+		p.store.Append(ssID, group.Events[0], row)
+		appended++
+		if checkpoints && appended%p.cfg.CheckpointEvery == 0 {
+			if err := p.checkpoint(ctx, sender, ssID, capCursor(group.Events[len(group.Events)-1].ID, retryFrom)); err != nil {
+				// The rows are written at the end of the poll instead.
+				logWarning(logFields{"sender_id": sender}, "Failed to save progress, continuing without checkpoints: %s", err)
+				checkpoints = false
+			}
+		}
+	}
+}
+
+// orphanNotes handles a group of notes without a link. Paging stops at a
+// page boundary once it's past the cursors, which can cut notes off from the
+// link before them. Notes from before the sender's cursor were saved by an
+// earlier poll and are dropped. Newer ones follow the sender's last stored
+// tweet, so they're added to its notes.
+func (p *eventProcessor) orphanNotes(ctx context.Context, sender string, ssID string, header []string, group dmGroup) {
+	first := group.Events[0].ID
+	if c := p.senderCursors[sender]; c != "" && !eventIDLess(c, first) {
+		logDebug(logFields{"sender_id": sender, "event_id": first}, "Notes from before the DM cursor without their link, skipping")
+		return
+	}
+	last := p.stored.lastTweetID[sender]
+	if last.ID == "" {
+		logError(logFields{"sender_id": sender, "event_id": first}, "Missing tweet ID in the first message of a group: %s", stringify(group.Events))
+		p.metrics.Errors++
+		return
+	}
+	data := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(last.JSON), &data); err != nil {
+		logError(logFields{"tweet_id": last.ID, "sender_id": sender, "row": last.Row}, "Failed to parse JSON from the spreadsheet: %s\nJSON: %q", err, last.JSON)
+		p.metrics.Errors++
+		return
+	}
+	notes := groupToNotes(group.Events, last.ID)
+	stored, _ := data["notes"].(string)
+	if notes == "" || strings.Contains(stored, notes) {
+		// Added by a poll that went over the same events already.
+		return
+	}
+	if stored != "" {
+		notes = stored + "\n" + notes
+	}
+	data["notes"] = notes
+	applyNoteTags(data)
+	data = applyTransform(ctx, p.cfg, data)
+	row, err := tweetToRow(data, header)
+	if err != nil {
+		logError(logFields{"tweet_id": last.ID, "sender_id": sender}, "Failed to convert data into a row: %s", err)
+		p.metrics.Errors++
+		return
+	}
+	logInfo(logFields{"tweet_id": last.ID, "sender_id": sender, "event_id": first}, "Adding notes without a link to the last stored tweet")
+	p.store.Update(ssID, last.Row, row)
+}
+
+// checkpoint writes the rows queued by a worker, along with whatever other
+// workers are done with, and moves the sender's DM cursor to eventID, the
+// last event of the group saved last, or the one before a group to retry.
+// The cursor is only moved if the sender's spreadsheet was written, so it
+// never gets ahead of the rows.
+// Writes that fail stay queued for the flush at the end of the poll.
+func (p *eventProcessor) checkpoint(ctx context.Context, sender string, ssID string, eventID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buffer := p.store.(*bufferedStore)
+	buffer.moveTo(buffer.Store)
+	updated, appended, failed, err := buffer.Store.Flush(ctx)
+	p.metrics.TweetsUpdated += int64(updated)
+	p.metrics.TweetsAppended += int64(appended)
+	if failed[ssID] {
+		return err
+	}
+	if err != nil {
+		logWarning(logFields{"sender_id": sender}, "Failed to write the rows of other senders: %s", err)
+	}
+	if eventID == "" {
+		return nil
+	}
+	if err := p.advanceCursor(ctx, sender, eventID); err != nil {
+		return fmt.Errorf("updating DM cursor: %w", err)
+	}
+	logInfo(logFields{"sender_id": sender, "event_id": eventID}, "Saved progress")
+	return nil
+}
+
+// markRetry records that the group starting with eventID has to be tried
+// again by the next poll.
+func (p *eventProcessor) markRetry(sender string, eventID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r := p.retryFrom[sender]; r == "" || eventIDLess(eventID, r) {
+		p.retryFrom[sender] = eventID
+	}
+}
+
+// capCursor returns eventID, or the ID just before retryFrom if that's
+// older, so that a cursor stays behind a group that has to be retried. It
+// returns an empty string, meaning the cursor can't move, if retryFrom isn't
+// a number.
+func capCursor(eventID string, retryFrom string) string {
+	if retryFrom == "" {
+		return eventID
+	}
+	n, err := strconv.ParseInt(retryFrom, 10, 64)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	if before := strconv.FormatInt(n-1, 10); eventIDLess(before, eventID) {
+		return before
+	}
+	return eventID
+}
+
+// showTweet fetches the tweet from the API version picked by
+// TWITTER_API_VERSION.
+func (p *eventProcessor) showTweet(id int64) (*twitter.Tweet, error) {
+	if p.v2Client != nil {
+		return showTweetV2(p.v2Client, strconv.FormatInt(id, 10))
+	}
+	tweet, _, err := p.twClient.Statuses.Show(id, &twitter.StatusShowParams{IncludeEntities: twitter.Bool(true), TweetMode: "extended"})
+	return tweet, err
+}
+
+// worker returns a copy of the processor for one sender. It has its own
+// caches, metrics and write buffer, and shares the rest.
+func (p *eventProcessor) worker() *eventProcessor {
+	w := *p
+	w.store = &bufferedStore{Store: p.store}
+	w.names = newSenderNames(p.twClient)
+	w.parents = newParentTweets(p.twClient)
+	w.metrics = &pollMetrics{}
+	return &w
+}
+
+// merge moves the writes and metrics of a worker into the processor.
+func (p *eventProcessor) merge(w *eventProcessor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.store.(*bufferedStore).moveTo(p.store)
+	p.metrics.add(w.metrics)
+}
+
+func (p *eventProcessor) isStored(ssID string, tweetID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stored.storedIDs[ssID][tweetID]
+}
+
+// markStored records that the tweet is saved, if deduplicating globally.
+func (p *eventProcessor) markStored(ssID string, tweetID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ids := p.stored.storedIDs[ssID]; ids != nil {
+		ids[tweetID] = true
+	}
+}
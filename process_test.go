@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// fakeTwitter serves the parts of the Twitter API polls use from memory.
+// Tweets it doesn't have are answered like deleted ones.
+type fakeTwitter struct {
+	mu     sync.Mutex
+	tweets map[string]*twitter.Tweet
+	// Twitter error codes statuses/show fails with, per tweet ID. Code 0
+	// stands for a server error.
+	errors map[string]int
+	// Number of requests made, per path.
+	requests map[string]int
+}
+
+func newFakeTwitter(tweets ...*twitter.Tweet) *fakeTwitter {
+	f := &fakeTwitter{tweets: map[string]*twitter.Tweet{}, errors: map[string]int{}, requests: map[string]int{}}
+	for _, t := range tweets {
+		f.tweets[t.IDStr] = t
+	}
+	return f
+}
+
+func (f *fakeTwitter) client() *twitter.Client {
+	return twitter.NewClient(&http.Client{Transport: f})
+}
+
+func (f *fakeTwitter) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+func (f *fakeTwitter) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.URL.Path]++
+	switch r.URL.Path {
+	case "/1.1/statuses/show.json":
+		id := r.URL.Query().Get("id")
+		if code, ok := f.errors[id]; ok {
+			status := http.StatusForbidden
+			if code == 0 {
+				status = http.StatusServiceUnavailable
+				code = 131
+			}
+			return fakeResponse(status, map[string]interface{}{
+				"errors": []interface{}{map[string]interface{}{"code": code, "message": "error"}},
+			}), nil
+		}
+		if t, ok := f.tweets[id]; ok {
+			return fakeResponse(http.StatusOK, t), nil
+		}
+	case "/1.1/statuses/lookup.json":
+		found := []*twitter.Tweet{}
+		for _, id := range strings.Split(r.URL.Query().Get("id"), ",") {
+			if t, ok := f.tweets[id]; ok {
+				found = append(found, t)
+			}
+		}
+		return fakeResponse(http.StatusOK, found), nil
+	case "/1.1/users/show.json":
+		id := r.URL.Query().Get("user_id")
+		return fakeResponse(http.StatusOK, &twitter.User{IDStr: id, Name: "User " + id}), nil
+	}
+	return fakeResponse(http.StatusNotFound, map[string]interface{}{
+		"errors": []interface{}{map[string]interface{}{"code": 144, "message": "No status found with that ID."}},
+	}), nil
+}
+
+func fakeResponse(status int, body interface{}) *http.Response {
+	b, _ := json.Marshal(body)
+	return &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+	}
+}
+
+func testTweet(id string, authorID string, text string) *twitter.Tweet {
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return &twitter.Tweet{
+		ID:        n,
+		IDStr:     id,
+		FullText:  text,
+		CreatedAt: "Thu Feb 24 03:00:00 +0000 2022",
+		User:      &twitter.User{IDStr: authorID, ScreenName: "user" + authorID},
+	}
+}
+
+// dmEvent returns a DM event from sender, created at the given time in
+// milliseconds, linking tweetID unless it's empty.
+func dmEvent(id string, createdAt int64, sender string, text string, tweetID string) twitter.DirectMessageEvent {
+	data := &twitter.DirectMessageData{Text: text, Entities: &twitter.Entities{}}
+	if tweetID != "" {
+		u := "https://twitter.com/i/status/" + tweetID
+		data.Text = strings.TrimSpace(text + " https://t.co/" + tweetID)
+		data.Entities.Urls = []twitter.URLEntity{{URL: "https://t.co/" + tweetID, ExpandedURL: u}}
+	}
+	return twitter.DirectMessageEvent{
+		ID:        id,
+		CreatedAt: strconv.FormatInt(createdAt, 10),
+		Type:      "message_create",
+		Message: &twitter.DirectMessageEventMessage{
+			SenderID: sender,
+			Target:   &twitter.DirectMessageTarget{RecipientID: "1"},
+			Data:     data,
+		},
+	}
+}
+
+var testHeader = []string{"url", "text", "notes", "sender_username", "json"}
+
+// memoryStore is a Store keeping the rows of each target in memory. Rows are
+// numbered from 1. Flushing a target in fail writes nothing and keeps its
+// writes queued.
+type memoryStore struct {
+	mu      sync.Mutex
+	header  []string
+	rows    map[string][][]interface{}
+	updates map[string][]bufferedWrite
+	appends map[string][]pendingAppend
+	fail    map[string]bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		header:  testHeader,
+		rows:    map[string][][]interface{}{},
+		updates: map[string][]bufferedWrite{},
+		appends: map[string][]pendingAppend{},
+		fail:    map[string]bool{},
+	}
+}
+
+func (s *memoryStore) Header(ctx context.Context, target string) ([]string, error) {
+	return s.header, nil
+}
+
+func (s *memoryStore) LastStored(ctx context.Context, target string, header []string, senders map[string]string, allIDs map[string]bool) (map[string]storedTweetInfo, map[string]map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	col := jsonColumn(header)
+	rows := []storedTweetInfo{}
+	for i, row := range s.rows[target] {
+		rows = append(rows, storedTweetInfo{Row: i + 1, JSON: fmt.Sprint(row[col])})
+	}
+	return lastStoredTweets(rows, senders, allIDs)
+}
+
+func (s *memoryStore) Update(target string, row int, values []interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates[target] = append(s.updates[target], bufferedWrite{target: target, row: row, values: values})
+}
+
+func (s *memoryStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appends[target] = append(s.appends[target], pendingAppend{event: first, row: values})
+}
+
+func (s *memoryStore) Flush(ctx context.Context) (updated int, appended int, failed map[string]bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed = map[string]bool{}
+	errs := multiError{}
+	for target, writes := range s.updates {
+		if s.fail[target] {
+			continue
+		}
+		for _, w := range writes {
+			s.rows[target][w.row-1] = w.values
+			updated++
+		}
+		delete(s.updates, target)
+	}
+	for target, pending := range s.appends {
+		if s.fail[target] {
+			continue
+		}
+		sortPendingAppends(pending)
+		for _, p := range pending {
+			s.rows[target] = append(s.rows[target], p.row)
+			appended++
+		}
+		delete(s.appends, target)
+	}
+	for target := range s.fail {
+		if len(s.updates[target]) > 0 || len(s.appends[target]) > 0 {
+			failed[target] = true
+			errs.add(fmt.Errorf("writing to %s failed", target))
+		}
+	}
+	return updated, appended, failed, errs.err()
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// storedTweetIDs returns the IDs of the tweets in the rows of the target, in
+// order.
+func (s *memoryStore) storedTweetIDs(t *testing.T, target string) []string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	col := jsonColumn(s.header)
+	r := []string{}
+	for _, row := range s.rows[target] {
+		data := struct {
+			Tweet struct {
+				ID string `json:"id_str"`
+			} `json:"tweet"`
+		}{}
+		if err := json.Unmarshal([]byte(fmt.Sprint(row[col])), &data); err != nil {
+			t.Fatalf("row has invalid JSON %q: %s", row[col], err)
+		}
+		r = append(r, data.Tweet.ID)
+	}
+	return r
+}
+
+// storeRow renders a row for the tweet as the processor would have saved it
+// for sender.
+func storeRow(t *testing.T, s *memoryStore, target string, sender string, tweet *twitter.Tweet, notes string) {
+	t.Helper()
+	data := map[string]interface{}{"sender_id": sender, "notes": notes}
+	updateComputedFields(data, tweet)
+	row, err := tweetToRow(data, s.header)
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	s.rows[target] = append(s.rows[target], row)
+}
+
+// newTestProcessor returns a processor writing to store, with the stored
+// state loaded from it.
+func newTestProcessor(t *testing.T, cfg *Config, tw *fakeTwitter, store Store, whitelist map[string]string, spreadsheets map[string]string) *eventProcessor {
+	t.Helper()
+	ctx := context.Background()
+	stored, err := loadStoredState(ctx, cfg, store, whitelist, spreadsheets)
+	if err != nil {
+		t.Fatalf("loadStoredState: %s", err)
+	}
+	p, err := newEventProcessor(ctx, nil, "1", cfg, &http.Client{Transport: tw}, tw.client(), store, stored, &pollMetrics{})
+	if err != nil {
+		t.Fatalf("newEventProcessor: %s", err)
+	}
+	return p
+}
+
+// processEvents runs the events through a processor writing to store, with
+// every sender whitelisted and mapped to spreadsheet "ss", and flushes the
+// writes.
+func processEvents(t *testing.T, cfg *Config, tw *fakeTwitter, store Store, events []twitter.DirectMessageEvent, configure func(p *eventProcessor)) *pollMetrics {
+	t.Helper()
+	ctx := context.Background()
+	whitelist := map[string]string{}
+	spreadsheets := map[string]string{}
+	for _, e := range events {
+		whitelist[e.Message.SenderID] = "sender" + e.Message.SenderID
+		spreadsheets[e.Message.SenderID] = "ss"
+	}
+	p := newTestProcessor(t, cfg, tw, store, whitelist, spreadsheets)
+	if configure != nil {
+		configure(p)
+	}
+	p.process(ctx, events, whitelist, whitelist, spreadsheets)
+	store.Flush(ctx)
+	return p.metrics
+}
+
+func TestProcessSavesLinkedTweets(t *testing.T) {
+	tw := newFakeTwitter(testTweet("100", "50", "first"), testTweet("200", "50", "second"))
+	store := newMemoryStore()
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "a note", ""),
+		dmEvent("3", 3000, "7", "", "200"),
+	}
+	metrics := processEvents(t, &Config{SenderWorkers: 1}, tw, store, events, nil)
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"100", "200"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+	if metrics.Errors != 0 {
+		t.Errorf("got %d errors", metrics.Errors)
+	}
+	if notes := store.rows["ss"][0][2]; !strings.Contains(fmt.Sprint(notes), "a note") {
+		t.Errorf("notes of the first tweet = %q, want them to include the note", notes)
+	}
+}
+
+func TestProcessDedupeGlobally(t *testing.T) {
+	tweet := testTweet("100", "50", "shared")
+	for _, c := range []struct {
+		dedupe bool
+		want   []string
+	}{
+		{false, []string{"100", "200", "100", "200"}},
+		{true, []string{"100", "200"}},
+	} {
+		tw := newFakeTwitter(tweet, testTweet("200", "50", "other"))
+		store := newMemoryStore()
+		storeRow(t, store, "ss", "7", tweet, "")
+		// Sender 8 links the tweet sender 7 saved, and sender 9 one that
+		// sender 8 links in the same poll.
+		events := []twitter.DirectMessageEvent{
+			dmEvent("1", 1000, "8", "", "200"),
+			dmEvent("2", 2000, "8", "", "100"),
+			dmEvent("3", 3000, "9", "", "200"),
+		}
+		processEvents(t, &Config{SenderWorkers: 1, DedupeGlobally: c.dedupe}, tw, store, events, nil)
+		if got := store.storedTweetIDs(t, "ss"); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("with DedupeGlobally %v, stored tweets %v, want %v", c.dedupe, got, c.want)
+		}
+	}
+}
+
+func TestProcessSkipsRemovedSenders(t *testing.T) {
+	ctx := context.Background()
+	tw := newFakeTwitter(testTweet("100", "50", "first"), testTweet("200", "50", "second"))
+	store := newMemoryStore()
+	cfg := &Config{SenderWorkers: 1}
+	whitelist := map[string]string{"7": "kept", "8": "removed"}
+	spreadsheets := map[string]string{"7": "ss", "8": "ss"}
+	p := newTestProcessor(t, cfg, tw, store, whitelist, spreadsheets)
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "8", "", "200"),
+	}
+	// Sender 8 was removed from the whitelist while the DMs were fetched.
+	p.process(ctx, events, whitelist, map[string]string{"7": "kept"}, spreadsheets)
+	store.Flush(ctx)
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"100"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+	if n := tw.count("/1.1/statuses/show.json"); n != 1 {
+		t.Errorf("fetched %d tweets, want only the one of the kept sender", n)
+	}
+}
+
+func TestProcessRecreatesDeletedRow(t *testing.T) {
+	tweets := []*twitter.Tweet{testTweet("100", "50", "a"), testTweet("200", "50", "b"), testTweet("300", "50", "c")}
+	tw := newFakeTwitter(tweets...)
+	store := newMemoryStore()
+	// The row of tweet 200 was deleted by hand.
+	storeRow(t, store, "ss", "7", tweets[0], "")
+	storeRow(t, store, "ss", "7", tweets[2], "")
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+		dmEvent("3", 3000, "7", "", "300"),
+	}
+	processEvents(t, &Config{SenderWorkers: 1}, tw, store, events, nil)
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"100", "300", "200"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+	if n := tw.count("/1.1/statuses/show.json"); n != 1 {
+		t.Errorf("fetched %d tweets, want only the deleted one", n)
+	}
+}
+
+func TestProcessSavesUnavailableTweets(t *testing.T) {
+	tw := newFakeTwitter()
+	tw.errors["200"] = 179
+	tw.errors["300"] = 0
+	store := newMemoryStore()
+	events := []twitter.DirectMessageEvent{
+		// Tweets the fake doesn't have are answered with code 144.
+		dmEvent("1", 1000, "7", "gone", "100"),
+		dmEvent("2", 2000, "7", "hidden", "200"),
+		dmEvent("3", 3000, "7", "", "300"),
+	}
+	metrics := processEvents(t, &Config{SenderWorkers: 1}, tw, store, events, nil)
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"100", "200"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+	if metrics.Errors != 1 {
+		t.Errorf("got %d errors, want 1 for the server error", metrics.Errors)
+	}
+	for i, want := range []struct{ status, url, notes string }{
+		{statusDeleted, "https://twitter.com/i/status/100", "gone"},
+		{statusProtected, "https://twitter.com/i/status/200", "hidden"},
+	} {
+		row := store.rows["ss"][i]
+		data := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(fmt.Sprint(row[4])), &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["status"] != want.status || row[0] != want.url || !strings.Contains(fmt.Sprint(row[2]), want.notes) {
+			t.Errorf("row %d = status %q, %q, notes %q, want %+v", i+1, data["status"], row[0], row[2], want)
+		}
+	}
+}
+
+func TestFailedSenderKeepsCursor(t *testing.T) {
+	ctx := context.Background()
+	tw := newFakeTwitter(testTweet("100", "50", "first"), testTweet("200", "50", "second"))
+	store := newMemoryStore()
+	store.fail["ss8"] = true
+	whitelist := map[string]string{"7": "seven", "8": "eight"}
+	spreadsheets := map[string]string{"7": "ss7", "8": "ss8"}
+	p := newTestProcessor(t, &Config{SenderWorkers: 2}, tw, store, whitelist, spreadsheets)
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "8", "", "200"),
+	}
+	p.process(ctx, events, whitelist, whitelist, spreadsheets)
+	_, appended, failed, err := store.Flush(ctx)
+	if err == nil || appended != 1 || !failed["ss8"] || failed["ss7"] {
+		t.Fatalf("Flush = %d appended, failed %v, error %v, want only ss8 to fail", appended, failed, err)
+	}
+
+	cursors := map[string]string{}
+	err = advanceSenderCursors(ctx, map[string]string{"7": "1", "8": "2"}, nil, spreadsheets, failed, func(ctx context.Context, sender string, eventID string) error {
+		cursors[sender] = eventID
+		return nil
+	})
+	if err != nil {
+		t.Errorf("advanceSenderCursors: %s", err)
+	}
+	if fmt.Sprint(cursors) != "map[7:1]" {
+		t.Errorf("advanced cursors %v, want only sender 7's", cursors)
+	}
+
+	// The row of sender 8 is written once the spreadsheet recovers.
+	delete(store.fail, "ss8")
+	store.Flush(ctx)
+	if got := store.storedTweetIDs(t, "ss8"); fmt.Sprint(got) != "[200]" {
+		t.Errorf("stored tweets of sender 8 %v, want [200]", got)
+	}
+}
+
+func TestFailedFetchKeepsSenderCursor(t *testing.T) {
+	ctx := context.Background()
+	tw := newFakeTwitter(testTweet("100", "50", "a"), testTweet("200", "50", "b"), testTweet("300", "50", "c"), testTweet("400", "50", "d"))
+	// Fetching 200 fails with a 503, and 300 is the first tweet of sender 8.
+	tw.errors["200"] = 0
+	tw.errors["300"] = 0
+	store := newMemoryStore()
+	whitelist := map[string]string{"7": "seven", "8": "eight"}
+	spreadsheets := map[string]string{"7": "ss", "8": "ss"}
+	p := newTestProcessor(t, &Config{SenderWorkers: 2}, tw, store, whitelist, spreadsheets)
+	events := []twitter.DirectMessageEvent{
+		dmEvent("11", 1000, "7", "", "100"),
+		dmEvent("12", 2000, "7", "", "200"),
+		dmEvent("13", 3000, "7", "", "400"),
+		dmEvent("14", 4000, "8", "", "300"),
+	}
+	p.process(ctx, events, whitelist, whitelist, spreadsheets)
+	_, _, failed, err := store.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	cursors := map[string]string{}
+	err = advanceSenderCursors(ctx, map[string]string{"7": "13", "8": "14"}, p.retryFrom, spreadsheets, failed, func(ctx context.Context, sender string, eventID string) error {
+		cursors[sender] = eventID
+		return nil
+	})
+	if err != nil {
+		t.Errorf("advanceSenderCursors: %s", err)
+	}
+	if fmt.Sprint(cursors) != "map[7:11 8:13]" {
+		t.Errorf("advanced cursors %v, want both kept before their failed tweets", cursors)
+	}
+}
+
+func TestMixedSuccessFlush(t *testing.T) {
+	ctx := context.Background()
+	last := testTweet("100", "50", "first")
+	tw := newFakeTwitter(last, testTweet("200", "50", "second"))
+	store := newMemoryStore()
+	storeRow(t, store, "ss7", "7", last, "")
+	store.fail["ss7"] = true
+	whitelist := map[string]string{"7": "seven", "8": "eight"}
+	spreadsheets := map[string]string{"7": "ss7", "8": "ss8"}
+	p := newTestProcessor(t, &Config{SenderWorkers: 1}, tw, store, whitelist, spreadsheets)
+	events := []twitter.DirectMessageEvent{
+		// Updates the row of sender 7's last tweet in place.
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 1500, "7", "more context", ""),
+		dmEvent("3", 2000, "8", "", "200"),
+	}
+	p.process(ctx, events, whitelist, whitelist, spreadsheets)
+	updated, appended, failed, err := store.Flush(ctx)
+	if err == nil || updated != 0 || appended != 1 || !failed["ss7"] {
+		t.Fatalf("Flush = %d updated, %d appended, failed %v, error %v, want the update of ss7 to fail", updated, appended, failed, err)
+	}
+	if got := store.storedTweetIDs(t, "ss8"); fmt.Sprint(got) != "[200]" {
+		t.Errorf("stored tweets of sender 8 %v, want [200]", got)
+	}
+
+	// A sender whose cursor can't be saved doesn't keep the others'
+	// from moving, and the errors are returned together.
+	delete(failed, "ss7")
+	cursors := map[string]string{}
+	err = advanceSenderCursors(ctx, map[string]string{"7": "2", "8": "3", "9": "4"}, nil, map[string]string{"7": "ss7", "8": "ss8", "9": "ss9"}, failed, func(ctx context.Context, sender string, eventID string) error {
+		if sender == "7" {
+			return fmt.Errorf("datastore unavailable")
+		}
+		cursors[sender] = eventID
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "datastore unavailable") {
+		t.Errorf("advanceSenderCursors error = %v, want the failure of sender 7", err)
+	}
+	if fmt.Sprint(cursors) != "map[8:3 9:4]" {
+		t.Errorf("advanced cursors %v, want senders 8 and 9", cursors)
+	}
+}
+
+func TestProcessIgnoreSelfAuthored(t *testing.T) {
+	// The processor runs as bot account "1".
+	tweets := []*twitter.Tweet{testTweet("100", "1", "by the bot"), testTweet("200", "50", "by someone else")}
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+	}
+	for _, c := range []struct {
+		ignore bool
+		want   []string
+	}{
+		{false, []string{"100", "200"}},
+		{true, []string{"200"}},
+	} {
+		store := newMemoryStore()
+		processEvents(t, &Config{SenderWorkers: 1, IgnoreSelfAuthored: c.ignore}, newFakeTwitter(tweets...), store, events, nil)
+		if got := store.storedTweetIDs(t, "ss"); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("with IgnoreSelfAuthored %v, stored tweets %v, want %v", c.ignore, got, c.want)
+		}
+	}
+}
+
+// unsyncedStore counts writes without locking, like the Sheets store keeps
+// its queue, so that the race detector catches concurrent writes to it.
+type unsyncedStore struct {
+	*memoryStore
+	writes int
+}
+
+func (s *unsyncedStore) Update(target string, row int, values []interface{}) {
+	s.writes++
+	s.memoryStore.Update(target, row, values)
+}
+
+func (s *unsyncedStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.writes++
+	s.memoryStore.Append(target, first, values)
+}
+
+// Run with -race.
+func TestProcessSendersConcurrently(t *testing.T) {
+	tw := newFakeTwitter()
+	events := []twitter.DirectMessageEvent{}
+	want := map[string][]string{}
+	for sender := 10; sender < 30; sender++ {
+		for i := 0; i < 5; i++ {
+			id := strconv.Itoa(sender*100 + i)
+			tw.tweets[id] = testTweet(id, "50", "tweet "+id)
+			events = append(events, dmEvent(strconv.Itoa(len(events)+1), int64(1000*(i+1)), strconv.Itoa(sender), "", id))
+			want[strconv.Itoa(sender)] = append(want[strconv.Itoa(sender)], id)
+		}
+	}
+	store := &unsyncedStore{memoryStore: newMemoryStore()}
+	metrics := processEvents(t, &Config{SenderWorkers: 4}, tw, store, events, nil)
+	if metrics.Errors != 0 || store.writes != len(events) {
+		t.Errorf("got %d errors and %d writes, want none and %d", metrics.Errors, store.writes, len(events))
+	}
+
+	// Rows of each sender are in the order they were sent.
+	got := map[string][]string{}
+	for i, id := range store.storedTweetIDs(t, "ss") {
+		sender := fmt.Sprint(store.rows["ss"][i][3])
+		got[strings.TrimPrefix(sender, "sender")] = append(got[strings.TrimPrefix(sender, "sender")], id)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets per sender:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestCheckpointsResumeAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	tw := newFakeTwitter()
+	events := []twitter.DirectMessageEvent{}
+	for i := 1; i <= 25; i++ {
+		id := strconv.Itoa(100 + i)
+		tw.tweets[id] = testTweet(id, "50", "tweet "+id)
+		events = append(events, dmEvent(strconv.Itoa(i), int64(1000*i), "7", "", id))
+		if i > 15 {
+			tw.errors[id] = 0
+		}
+	}
+	store := newMemoryStore()
+	whitelist := map[string]string{"7": "seven"}
+	spreadsheets := map[string]string{"7": "ss"}
+	cfg := &Config{SenderWorkers: 1, CheckpointEvery: 10}
+
+	// The process dies after fetching tweet 115, without flushing.
+	cursor := ""
+	p := newTestProcessor(t, cfg, tw, store, whitelist, spreadsheets)
+	p.advanceCursor = func(ctx context.Context, sender string, eventID string) error {
+		if n := len(store.storedTweetIDs(t, "ss")); n != 10 {
+			t.Errorf("cursor moved to %s with %d rows written, want 10", eventID, n)
+		}
+		cursor = eventID
+		return nil
+	}
+	p.process(ctx, events, whitelist, whitelist, spreadsheets)
+	if cursor != "10" {
+		t.Fatalf("cursor = %q, want 10", cursor)
+	}
+	// The rows queued since the checkpoint die with the process.
+	store.appends = map[string][]pendingAppend{}
+
+	// After the restart, the poll starts from the events after the cursor.
+	tw = newFakeTwitter()
+	for i := 1; i <= 25; i++ {
+		id := strconv.Itoa(100 + i)
+		tw.tweets[id] = testTweet(id, "50", "tweet "+id)
+	}
+	p = newTestProcessor(t, cfg, tw, store, whitelist, spreadsheets)
+	p.process(ctx, events[10:], whitelist, whitelist, spreadsheets)
+	store.Flush(ctx)
+	want := []string{}
+	for i := 1; i <= 25; i++ {
+		want = append(want, strconv.Itoa(100+i))
+	}
+	if got := store.storedTweetIDs(t, "ss"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+	if n := tw.count("/1.1/statuses/show.json"); n != 15 {
+		t.Errorf("fetched %d tweets after the restart, want 15", n)
+	}
+}
+
+func TestCheckpointsStayBehindFailedFetch(t *testing.T) {
+	ctx := context.Background()
+	tw := newFakeTwitter()
+	events := []twitter.DirectMessageEvent{}
+	for i := 1; i <= 25; i++ {
+		id := strconv.Itoa(100 + i)
+		tw.tweets[id] = testTweet(id, "50", "tweet "+id)
+		events = append(events, dmEvent(strconv.Itoa(i), int64(1000*i), "7", "", id))
+	}
+	// Fetching the tweet of event 5 fails with a 503.
+	tw.errors["105"] = 0
+	store := newMemoryStore()
+	whitelist := map[string]string{"7": "seven"}
+	spreadsheets := map[string]string{"7": "ss"}
+	cfg := &Config{SenderWorkers: 1, CheckpointEvery: 10}
+
+	cursors := []string{}
+	p := newTestProcessor(t, cfg, tw, store, whitelist, spreadsheets)
+	p.advanceCursor = func(ctx context.Context, sender string, eventID string) error {
+		cursors = append(cursors, eventID)
+		return nil
+	}
+	p.process(ctx, events, whitelist, whitelist, spreadsheets)
+	store.Flush(ctx)
+	if fmt.Sprint(cursors) != "[4 4]" {
+		t.Fatalf("checkpoints moved the cursor to %v, want it kept at 4, before the failed tweet", cursors)
+	}
+	if got := p.retryFrom["7"]; got != "5" {
+		t.Errorf("retryFrom = %q, want 5", got)
+	}
+
+	// The next poll starts after the cursor and saves the missing tweet.
+	delete(tw.errors, "105")
+	p = newTestProcessor(t, cfg, tw, store, whitelist, spreadsheets)
+	p.process(ctx, events[4:], whitelist, whitelist, spreadsheets)
+	store.Flush(ctx)
+	got := store.storedTweetIDs(t, "ss")
+	sort.Strings(got)
+	want := []string{}
+	for i := 1; i <= 25; i++ {
+		want = append(want, strconv.Itoa(100+i))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored tweets %v, want %v", got, want)
+	}
+}
+
+func TestProcessNotesWithoutLink(t *testing.T) {
+	tweet := testTweet("100", "50", "first")
+	withCursor := func(p *eventProcessor) {
+		p.senderCursors = map[string]string{"7": "5"}
+	}
+
+	// Notes from before the cursor whose link was on a page that wasn't
+	// fetched were saved already.
+	store := newMemoryStore()
+	storeRow(t, store, "ss", "7", tweet, "old note")
+	metrics := processEvents(t, &Config{SenderWorkers: 1}, newFakeTwitter(), store, []twitter.DirectMessageEvent{dmEvent("4", 4000, "7", "old note", "")}, withCursor)
+	if metrics.Errors != 0 || len(store.rows["ss"]) != 1 || store.rows["ss"][0][2] != "'old note" {
+		t.Errorf("got %d errors, rows %q, want the notes dropped", metrics.Errors, store.rows["ss"])
+	}
+
+	// Newer ones are added to the last stored tweet, once.
+	for i := 0; i < 2; i++ {
+		metrics = processEvents(t, &Config{SenderWorkers: 1}, newFakeTwitter(), store, []twitter.DirectMessageEvent{dmEvent("6", 6000, "7", "new note", "")}, withCursor)
+		if metrics.Errors != 0 || len(store.rows["ss"]) != 1 || store.rows["ss"][0][2] != "'old note\nnew note" {
+			t.Errorf("poll %d: got %d errors, rows %q, want the note added to the last stored tweet", i+1, metrics.Errors, store.rows["ss"])
+		}
+	}
+
+	// Without a stored tweet they can't go anywhere.
+	store = newMemoryStore()
+	metrics = processEvents(t, &Config{SenderWorkers: 1}, newFakeTwitter(), store, []twitter.DirectMessageEvent{dmEvent("6", 6000, "7", "new note", "")}, withCursor)
+	if metrics.Errors != 1 || len(store.rows["ss"]) != 0 {
+		t.Errorf("got %d errors, rows %q, want the notes reported", metrics.Errors, store.rows["ss"])
+	}
+}
+
+func TestProcessUnrollsThread(t *testing.T) {
+	// 101 replies to a deleted tweet, and the author continued the thread
+	// with 102 and 103.
+	thread := []*twitter.Tweet{testTweet("101", "50", "one"), testTweet("102", "50", "two"), testTweet("103", "50", "three")}
+	for i, tweet := range thread {
+		tweet.User.ID = 50
+		tweet.InReplyToStatusID = int64(100 + i)
+		tweet.InReplyToStatusIDStr = fmt.Sprint(100 + i)
+		tweet.InReplyToUserID = 50
+	}
+	tw := newFakeTwitter(thread...)
+	store := newMemoryStore()
+	keyword, err := newKeyword("unroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []twitter.DirectMessageEvent{dmEvent("1", 1000, "7", "Unroll please", "103")}
+	metrics := processEvents(t, &Config{SenderWorkers: 1, UnrollKeyword: &keyword}, tw, store, events, nil)
+	if metrics.Errors != 0 {
+		t.Errorf("got %d errors", metrics.Errors)
+	}
+	if got, want := store.storedTweetIDs(t, "ss"), []string{"103"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("stored tweets %v, want %v", got, want)
+	}
+	row := store.rows["ss"][0]
+	want := "'" + strings.Join([]string{"one", "two", "three"}, threadDelimiter)
+	if row[1] != want {
+		t.Errorf("text = %q, want %q", row[1], want)
+	}
+	data := struct {
+		Unrolled []threadTweet `json:"unrolled"`
+	}{}
+	if err := json.Unmarshal([]byte(fmt.Sprint(row[4])), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Unrolled) != 2 || data.Unrolled[0].ID != "101" || data.Unrolled[1].ID != "102" {
+		t.Errorf("unrolled = %+v, want 101 and 102", data.Unrolled)
+	}
+
+	// Without the keyword only the linked tweet is saved.
+	store = newMemoryStore()
+	events = []twitter.DirectMessageEvent{dmEvent("1", 1000, "7", "unrolling later", "103")}
+	processEvents(t, &Config{SenderWorkers: 1, UnrollKeyword: &keyword}, newFakeTwitter(thread...), store, events, nil)
+	if row := store.rows["ss"][0]; row[1] != "'three" {
+		t.Errorf("text without the keyword = %q, want only the linked tweet", row[1])
+	}
+}
+
+func TestArchivedAtKeptOnRebuild(t *testing.T) {
+	tw := newFakeTwitter(testTweet("100", "50", "first"))
+	store := newMemoryStore()
+	store.header = []string{"url", "archived_at", "json"}
+	before := time.Now().UTC().Truncate(time.Second)
+	processEvents(t, &Config{SenderWorkers: 1}, tw, store, []twitter.DirectMessageEvent{dmEvent("1", 1000, "7", "", "100")}, nil)
+	row := store.rows["ss"][0]
+	archived, err := time.Parse(time.RFC3339, fmt.Sprint(row[1]))
+	if err != nil || archived.Before(before) || archived.After(time.Now()) {
+		t.Fatalf("archived_at = %q, want the time of the write", row[1])
+	}
+
+	// Rebuilt later, with another display timezone, it's still the time of
+	// the original write.
+	data := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(fmt.Sprint(row[2])), &data); err != nil {
+		t.Fatal(err)
+	}
+	data["archived_at"] = "2022-02-24T03:00:00Z"
+	b, _ := json.Marshal(data)
+	defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+	displayLocation = loadDisplayLocation("Europe/Kyiv")
+	rebuilt, err := rebuildRow(string(b), store.header)
+	if err != nil {
+		t.Fatalf("rebuildRow: %s", err)
+	}
+	if rebuilt[1] != "2022-02-24T05:00:00+02:00" {
+		t.Errorf("rebuilt archived_at = %q, want the original in the display timezone", rebuilt[1])
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// How long a processed DM event is remembered.
+const processedEventRetention = time.Hour
+
+// processedEvents remembers the DM events whose tweets were written
+// recently, keyed by the ID of the DM that submitted the tweet. Cursors and
+// the last stored tweet should already keep an event from being saved
+// twice; this catches the cases they miss, such as Twitter returning an
+// event again on a later page. It only lives in memory, so a restart forgets
+// it.
+type processedEvents struct {
+	mu     sync.Mutex
+	events map[string]time.Time
+}
+
+var recentEvents = &processedEvents{events: map[string]time.Time{}}
+
+// add records the events as written at now, and forgets the ones past the
+// retention window.
+func (p *processedEvents) add(ids []string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range ids {
+		p.events[id] = now
+	}
+	for id, t := range p.events {
+		if now.Sub(t) > processedEventRetention {
+			delete(p.events, id)
+		}
+	}
+}
+
+// seen reports whether the event was written within the retention window.
+func (p *processedEvents) seen(id string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.events[id]
+	return ok && now.Sub(t) <= processedEventRetention
+}
+
+type processedEvent struct {
+	EventID     string    `json:"event_id"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// ServeHTTP lists the remembered events as JSON, newest first. Only served
+// with DEBUG set.
+func (p *processedEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	events := []processedEvent{}
+	now := time.Now()
+	for id, t := range p.events {
+		if now.Sub(t) <= processedEventRetention {
+			events = append(events, processedEvent{EventID: id, ProcessedAt: t})
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(events, func(i, j int) bool {
+		return eventIDLess(events[j].EventID, events[i].EventID)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// recordingStore adds the events of appended rows to recentEvents once they
+// are written.
+type recordingStore struct {
+	Store
+	record  *processedEvents
+	pending map[string][]string
+}
+
+func newRecordingStore(s Store, record *processedEvents) *recordingStore {
+	return &recordingStore{Store: s, record: record, pending: map[string][]string{}}
+}
+
+func (s *recordingStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.pending[target] = append(s.pending[target], first.ID)
+	s.Store.Append(target, first, values)
+}
+
+func (s *recordingStore) Flush(ctx context.Context) (int, int, map[string]bool, error) {
+	updated, appended, failed, err := s.Store.Flush(ctx)
+	now := time.Now()
+	for target, ids := range s.pending {
+		if failed[target] {
+			continue
+		}
+		s.record.add(ids, now)
+		delete(s.pending, target)
+	}
+	return updated, appended, failed, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func TestProcessedEventsRetention(t *testing.T) {
+	p := &processedEvents{events: map[string]time.Time{}}
+	start := time.Date(2022, 2, 24, 3, 0, 0, 0, time.UTC)
+	p.add([]string{"1"}, start)
+	if !p.seen("1", start.Add(processedEventRetention)) {
+		t.Errorf("event is forgotten within the retention window")
+	}
+	if p.seen("1", start.Add(processedEventRetention+time.Second)) {
+		t.Errorf("event is remembered past the retention window")
+	}
+	p.add([]string{"2"}, start.Add(2*processedEventRetention))
+	if _, ok := p.events["1"]; ok {
+		t.Errorf("expired event was not dropped")
+	}
+}
+
+func TestProcessSkipsDuplicateEvent(t *testing.T) {
+	tw := newFakeTwitter(testTweet("100", "50", "first"), testTweet("200", "50", "second"))
+	store := newMemoryStore()
+	recent := &processedEvents{events: map[string]time.Time{}}
+	recent.add([]string{"1"}, time.Now())
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+	}
+	processEvents(t, &Config{SenderWorkers: 1}, tw, newRecordingStore(store, recent), events, func(p *eventProcessor) {
+		p.processed = recent
+	})
+	if got := store.storedTweetIDs(t, "ss"); fmt.Sprint(got) != "[200]" {
+		t.Errorf("stored tweets %v, want only 200", got)
+	}
+	if !recent.seen("2", time.Now()) {
+		t.Errorf("written event was not recorded")
+	}
+}
+
+func TestRecordingStoreSkipsFailedTargets(t *testing.T) {
+	store := newMemoryStore()
+	store.fail["bad"] = true
+	recent := &processedEvents{events: map[string]time.Time{}}
+	s := newRecordingStore(store, recent)
+	s.Append("good", twitter.DirectMessageEvent{ID: "1"}, []interface{}{})
+	s.Append("bad", twitter.DirectMessageEvent{ID: "2"}, []interface{}{})
+	if _, _, _, err := s.Flush(context.Background()); err == nil {
+		t.Errorf("Flush succeeded, want an error for the failed target")
+	}
+	now := time.Now()
+	if !recent.seen("1", now) {
+		t.Errorf("event of the written target was not recorded")
+	}
+	if recent.seen("2", now) {
+		t.Errorf("event of the failed target was recorded")
+	}
+	store.fail = map[string]bool{}
+	s.Flush(context.Background())
+	if !recent.seen("2", now) {
+		t.Errorf("event was not recorded once its target was written")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+type quotingTweet struct {
+	Row int    `json:"row"`
+	URL string `json:"url"`
+}
+
+type quoteGroup struct {
+	QuotedTweetID string         `json:"quoted_tweet_id"`
+	Tweets        []quotingTweet `json:"tweets"`
+}
+
+// quoteGroups returns the groups of saved tweets that quote the same
+// original tweet, largest first. Tweets not sharing their quoted tweet with
+// any other saved tweet are omitted.
+func quoteGroups(ctx context.Context) ([]quoteGroup, error) {
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	spreadsheetID, err := rcService.Projects.Configs.Variables.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		return nil, fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	sheetName, err := loadSheetName(rcService.Projects.Configs.Variables)
+	if err != nil {
+		return nil, fmt.Errorf("loading sheet name: %w", err)
+	}
+	sheetsService, err := clients.sheetsService()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sheets service: %w", err)
+	}
+
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		return nil, fmt.Errorf("getting spreadsheet header: %w", err)
+	}
+	jsonColumnNumber := jsonColumn(header)
+	if jsonColumnNumber < 0 {
+		return nil, fmt.Errorf("missing \"json\" column in the spreadsheet")
+	}
+
+	jsonValues, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID.Text, sheetRange(sheetName, fmt.Sprintf("R2C%d:C%d", jsonColumnNumber+1, jsonColumnNumber+1))).MajorDimension("COLUMNS").Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get \"json\" column from spreadsheet: %w", err)
+	}
+	if len(jsonValues.Values) <= 0 {
+		return nil, nil
+	}
+	return groupByQuotedTweet(jsonValues.Values[0]), nil
+}
+
+// groupByQuotedTweet groups the rows of a json column, starting at row 2, by
+// the tweet they quote.
+func groupByQuotedTweet(column []interface{}) []quoteGroup {
+	byQuoted := map[string][]quotingTweet{}
+	for i, v := range column {
+		j := struct {
+			QuotedTweetID string `json:"quoted_tweet_id"`
+			URL           string `json:"url"`
+			Tweet         struct {
+				QuotedStatusID string `json:"quoted_status_id_str"`
+			} `json:"tweet"`
+		}{}
+		if err := json.Unmarshal([]byte(fmt.Sprint(v)), &j); err != nil {
+			continue
+		}
+		// Rows saved before quoted_tweet_id was added only have it in the raw tweet.
+		id := j.QuotedTweetID
+		if id == "" {
+			id = j.Tweet.QuotedStatusID
+		}
+		if id == "" {
+			continue
+		}
+		byQuoted[id] = append(byQuoted[id], quotingTweet{Row: i + 2, URL: j.URL})
+	}
+
+	r := []quoteGroup{}
+	for id, tweets := range byQuoted {
+		if len(tweets) < 2 {
+			continue
+		}
+		r = append(r, quoteGroup{QuotedTweetID: id, Tweets: tweets})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if len(r[i].Tweets) != len(r[j].Tweets) {
+			return len(r[i].Tweets) > len(r[j].Tweets)
+		}
+		return r[i].QuotedTweetID < r[j].QuotedTweetID
+	})
+	return r
+}
+
+// quoteGroupsHandler responds with the quoteGroups of the default
+// spreadsheet. Requests are authenticated like /tweet.
+func quoteGroupsHandler(botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := authenticateBot(w, r, botUserIDs); !ok {
+			return
+		}
+		groups, err := quoteGroups(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupByQuotedTweet(t *testing.T) {
+	column := []interface{}{
+		`{"url":"https://twitter.com/a/status/1","quoted_tweet_id":"9"}`,
+		`{"url":"https://twitter.com/b/status/2"}`,
+		"",
+		// Saved before quoted_tweet_id was added.
+		`{"url":"https://twitter.com/c/status/3","tweet":{"quoted_status_id_str":"9"}}`,
+		`{"url":"https://twitter.com/d/status/4","quoted_tweet_id":"8"}`,
+	}
+	want := []quoteGroup{{
+		QuotedTweetID: "9",
+		Tweets: []quotingTweet{
+			{Row: 2, URL: "https://twitter.com/a/status/1"},
+			{Row: 5, URL: "https://twitter.com/c/status/3"},
+		},
+	}}
+	if got := groupByQuotedTweet(column); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupByQuotedTweet = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const (
+	// defaultThrottleWait is used when a throttled response has no usable
+	// x-rate-limit-reset header.
+	defaultThrottleWait = 15 * time.Minute
+	// rateLimitResetBuffer is added to the reset time to allow for clock skew.
+	rateLimitResetBuffer = 5 * time.Second
+)
+
+// throttleErrorCodes are the Twitter error codes to wait and retry on rather
+// than fail the poll, set from throttle_error_codes at startup. The default is
+// 88 (rate limit exceeded) and 130 (over capacity).
+var throttleErrorCodes = map[int]bool{88: true, 130: true}
+
+// loadThrottleErrorCodes parses throttle_error_codes, a comma-separated list
+// of Twitter error codes. Invalid entries are logged and skipped, and the
+// defaults are kept if there are no valid ones.
+func loadThrottleErrorCodes(entries []string) map[int]bool {
+	r := map[int]bool{}
+	for _, e := range entries {
+		code, err := strconv.Atoi(strings.TrimSpace(e))
+		if err != nil {
+			logWarning(logFields{"throttle_error_codes": e}, "Invalid throttle_error_codes entry, expected a number")
+			continue
+		}
+		r[code] = true
+	}
+	if len(r) == 0 {
+		return throttleErrorCodes
+	}
+	return r
+}
+
+// isThrottled reports whether a request failed because of the rate limit or
+// because Twitter is over capacity, either with an HTTP 429 or with one of
+// throttleErrorCodes.
+func isThrottled(err error, httpResp *http.Response) bool {
+	if err == nil {
+		return false
+	}
+	if httpResp != nil && httpResp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	apiError, ok := err.(twitter.APIError)
+	if !ok {
+		return false
+	}
+	for _, e := range apiError.Errors {
+		if throttleErrorCodes[e.Code] {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitRemaining returns the x-rate-limit-remaining header, if present.
+func rateLimitRemaining(resp *http.Response) (int, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(resp.Header.Get("x-rate-limit-remaining"))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// throttleWait returns how long to wait before retrying a throttled request,
+// based on the x-rate-limit-reset header.
+func throttleWait(resp *http.Response, now time.Time) time.Duration {
+	if resp == nil {
+		return defaultThrottleWait
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64)
+	if err != nil {
+		return defaultThrottleWait
+	}
+	d := time.Unix(reset, 0).Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d + rateLimitResetBuffer
+}
+
+// sleepContext sleeps for d or until ctx is cancelled, whichever is first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
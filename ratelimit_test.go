@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// fixedResponse answers every request with the same response.
+type fixedResponse struct {
+	status int
+	body   interface{}
+}
+
+func (f fixedResponse) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fakeResponse(f.status, f.body), nil
+}
+
+func twitterError(code int) map[string]interface{} {
+	return map[string]interface{}{
+		"errors": []interface{}{map[string]interface{}{"code": code, "message": "error"}},
+	}
+}
+
+func TestIsThrottled(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		status    int
+		body      interface{}
+		throttled bool
+	}{
+		{"rate limit", http.StatusTooManyRequests, twitterError(88), true},
+		{"over capacity", http.StatusServiceUnavailable, twitterError(130), true},
+		{"deleted tweet", http.StatusNotFound, twitterError(144), false},
+		{"bad auth", http.StatusUnauthorized, twitterError(32), false},
+		{"internal error", http.StatusInternalServerError, twitterError(131), false},
+	} {
+		client := twitter.NewClient(&http.Client{Transport: fixedResponse{c.status, c.body}})
+		_, httpResp, err := client.Statuses.Show(1, nil)
+		if err == nil {
+			t.Fatalf("%s: no error", c.name)
+		}
+		if got := isThrottled(err, httpResp); got != c.throttled {
+			t.Errorf("%s: isThrottled = %v, want %v", c.name, got, c.throttled)
+		}
+	}
+	if isThrottled(nil, &http.Response{StatusCode: http.StatusTooManyRequests}) {
+		t.Errorf("throttled without an error")
+	}
+	if !isThrottled(errors.New("unexpected body"), &http.Response{StatusCode: http.StatusTooManyRequests}) {
+		t.Errorf("not throttled on HTTP 429")
+	}
+	if isThrottled(errors.New("connection reset"), nil) {
+		t.Errorf("throttled on a network error")
+	}
+}
+
+func TestThrottleErrorCodesConfig(t *testing.T) {
+	if codes := loadThrottleErrorCodes([]string{"x"}); !codes[88] || !codes[130] {
+		t.Errorf("no valid entries gave %v, want the defaults", codes)
+	}
+
+	defer func(c map[int]bool) { throttleErrorCodes = c }(throttleErrorCodes)
+	throttleErrorCodes = loadThrottleErrorCodes([]string{"88", " 131 ", "x"})
+	if !throttleErrorCodes[131] || !throttleErrorCodes[88] || throttleErrorCodes[130] || len(throttleErrorCodes) != 2 {
+		t.Fatalf("loaded codes %v, want 88 and 131", throttleErrorCodes)
+	}
+	err := twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 131}}}
+	if !isThrottled(err, &http.Response{StatusCode: http.StatusInternalServerError}) {
+		t.Errorf("configured code 131 isn't throttled")
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	now := time.Unix(1000, 0)
+	resp := &http.Response{Header: http.Header{"X-Rate-Limit-Reset": {"1060"}}}
+	if d := throttleWait(resp, now); d != time.Minute+rateLimitResetBuffer {
+		t.Errorf("throttleWait = %s, want %s", d, time.Minute+rateLimitResetBuffer)
+	}
+	if d := throttleWait(&http.Response{Header: http.Header{}}, now); d != defaultThrottleWait {
+		t.Errorf("throttleWait without a reset = %s, want %s", d, defaultThrottleWait)
+	}
+}
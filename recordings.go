@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+	"google.golang.org/api/sheets/v4"
+)
+
+const recordedResponseEntity = "RecordedResponse"
+
+const (
+	recordedEventsList = "events_list"
+	recordedStatusShow = "status_show"
+)
+
+// RecordedResponse is a Twitter API response stored for debugging when the
+// record_responses config flag is set.
+type RecordedResponse struct {
+	Endpoint string
+	Body     string `datastore:",noindex"`
+	Created  time.Time
+}
+
+// recordResponse stores resp under "<endpoint>/<id>". Failures are only
+// logged, recording must never break a poll.
+func recordResponse(ctx context.Context, ds *datastore.Client, endpoint string, id string, resp interface{}) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal %s response for recording: %s", endpoint, err)
+		return
+	}
+	r := &RecordedResponse{Endpoint: endpoint, Body: string(b), Created: time.Now()}
+	if _, err := ds.Put(ctx, datastore.NameKey(recordedResponseEntity, endpoint+"/"+id, nil), r); err != nil {
+		log.Printf("Failed to record %s response: %s", endpoint, err)
+	}
+}
+
+type replayedGroup struct {
+	SenderID string `json:"sender_id"`
+	TweetID  string `json:"tweet_id"`
+	Notes    string `json:"notes"`
+}
+
+// replayHandler runs a recorded response through the parsing pipeline and
+// returns the result: the per-tweet DM groups for an EventsList response, or
+// the rendered row for a Statuses.Show response. Nothing is written.
+// Requests are authenticated like /tweet. Only enabled with DEBUG set.
+func replayHandler(ds *datastore.Client, botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, _, ok := authenticateBot(w, req, botUserIDs); !ok {
+			return
+		}
+		ctx := req.Context()
+		key := req.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key parameter", http.StatusBadRequest)
+			return
+		}
+		recorded := &RecordedResponse{}
+		if err := ds.Get(ctx, datastore.NameKey(recordedResponseEntity, key, nil), recorded); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to load recorded response %q: %s", key, err), http.StatusNotFound)
+			return
+		}
+
+		var result interface{}
+		var err error
+		switch recorded.Endpoint {
+		case recordedEventsList:
+			result, err = replayEventsList(ctx, recorded.Body)
+		case recordedStatusShow:
+			result, err = replayStatusShow(ctx, recorded.Body)
+		default:
+			err = fmt.Errorf("unknown endpoint %q", recorded.Endpoint)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func replayEventsList(ctx context.Context, body string) ([]replayedGroup, error) {
+	resp := &twitter.DirectMessageEvents{}
+	if err := json.Unmarshal([]byte(body), resp); err != nil {
+		return nil, fmt.Errorf("unmarshaling events: %w", err)
+	}
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig(rcService.Projects.Configs.Variables)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+	events := resp.Events
+	sortEventsByTime(events)
+	eventsBySender := map[string][]twitter.DirectMessageEvent{}
+	senders := []string{}
+	for _, e := range events {
+		if e.Type != "message_create" {
+			continue
+		}
+		if _, ok := eventsBySender[e.Message.SenderID]; !ok {
+			senders = append(senders, e.Message.SenderID)
+		}
+		eventsBySender[e.Message.SenderID] = append(eventsBySender[e.Message.SenderID], e)
+	}
+
+	r := []replayedGroup{}
+	for _, sender := range senders {
+		for _, group := range groupDMsPerTweet(eventsBySender[sender], cfg) {
+			r = append(r, replayedGroup{SenderID: sender, TweetID: group.TweetID, Notes: groupToNotes(group.Events, group.TweetID)})
+		}
+	}
+	return r, nil
+}
+
+func replayStatusShow(ctx context.Context, body string) ([]interface{}, error) {
+	tweet := &twitter.Tweet{}
+	if err := json.Unmarshal([]byte(body), tweet); err != nil {
+		return nil, fmt.Errorf("unmarshaling tweet: %w", err)
+	}
+
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	spreadsheetID, err := rcService.Projects.Configs.Variables.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		return nil, fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	sheetName, err := loadSheetName(rcService.Projects.Configs.Variables)
+	if err != nil {
+		return nil, fmt.Errorf("loading sheet name: %w", err)
+	}
+	sheetsService, err := sheets.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sheets service: %w", err)
+	}
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		return nil, fmt.Errorf("getting spreadsheet header: %w", err)
+	}
+
+	data := map[string]interface{}{}
+	updateComputedFields(data, tweet)
+	return tweetToRow(data, header)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Fields kept in the json column of a redacted row. Everything about the
+// tweet itself is dropped.
+var redactedKeptFields = []string{"sender_id", "sender_username", "sender_name", "dm_created_at", "submitted_at", "archived_at", "instance_id", "fingerprint"}
+
+// redactHandler takes down the rows of the tweet in the tweet_id form field
+// from the default spreadsheet. With mode=delete the rows are deleted,
+// otherwise they are blanked and marked as redacted. Requests are
+// authenticated like /tweet.
+func redactHandler(botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, _, ok := authenticateBot(w, r, botUserIDs); !ok {
+			return
+		}
+		tweetID := strings.TrimSpace(r.FormValue("tweet_id"))
+		if tweetID == "" {
+			http.Error(w, "missing tweet_id", http.StatusBadRequest)
+			return
+		}
+		deleteRows := false
+		switch r.URL.Query().Get("mode") {
+		case "", "blank":
+		case "delete":
+			deleteRows = true
+		default:
+			http.Error(w, fmt.Sprintf("unknown mode %q", r.URL.Query().Get("mode")), http.StatusBadRequest)
+			return
+		}
+		n, err := redactTweet(r.Context(), tweetID, deleteRows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%d rows affected\n", n)
+	})
+}
+
+// redactTweet deletes or blanks all rows of the tweet in the default
+// spreadsheet and returns how many there were.
+func redactTweet(ctx context.Context, tweetID string, deleteRows bool) (int, error) {
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return 0, err
+	}
+	vars := rcService.Projects.Configs.Variables
+	spreadsheetID, err := vars.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		return 0, fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	sheetName, err := loadSheetName(vars)
+	if err != nil {
+		return 0, fmt.Errorf("loading sheet name: %w", err)
+	}
+	sheetsService, err := clients.sheetsService()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create sheets service: %w", err)
+	}
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		return 0, fmt.Errorf("getting spreadsheet header: %w", err)
+	}
+	return redactSheet(ctx, sheetsService, spreadsheetID.Text, sheetName, header, tweetID, deleteRows)
+}
+
+// redactSheet does the work of redactTweet on the given sheet.
+func redactSheet(ctx context.Context, sheetsService *sheets.Service, spreadsheetID string, sheetName string, header []string, tweetID string, deleteRows bool) (int, error) {
+	jsonColumnNumber := jsonColumn(header)
+	if jsonColumnNumber < 0 {
+		return 0, fmt.Errorf("missing \"json\" column in the spreadsheet")
+	}
+	rng := sheetRange(sheetName, fmt.Sprintf("R2C%d:C%d", jsonColumnNumber+1, jsonColumnNumber+1))
+	values, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID, rng).MajorDimension("COLUMNS").Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get spreadsheet data: %w", err)
+	}
+	if len(values.Values) <= 0 {
+		return 0, nil
+	}
+
+	rows := []int{}
+	redacted := map[int]map[string]interface{}{}
+	for i, v := range values.Values[0] {
+		s, _ := v.(string)
+		data := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(s), &data); err != nil {
+			continue
+		}
+		tweet, _ := data["tweet"].(map[string]interface{})
+		if id, _ := tweet["id_str"].(string); id != tweetID {
+			continue
+		}
+		rows = append(rows, i+2)
+		redacted[i+2] = redactData(data, tweetID)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	if deleteRows {
+		sheetID, err := sheetIDByTitle(sheetsService, spreadsheetID, sheetName)
+		if err != nil {
+			return 0, err
+		}
+		// Bottom up, so that deleting a row doesn't move the next one.
+		sort.Sort(sort.Reverse(sort.IntSlice(rows)))
+		requests := []*sheets.Request{}
+		for _, row := range rows {
+			requests = append(requests, &sheets.Request{
+				DeleteDimension: &sheets.DeleteDimensionRequest{
+					Range: &sheets.DimensionRange{
+						SheetId:    sheetID,
+						Dimension:  "ROWS",
+						StartIndex: int64(row - 1),
+						EndIndex:   int64(row),
+					},
+				},
+			})
+		}
+		_, err = sheetsService.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).Context(ctx).Do()
+		// Even a failed request may have deleted them.
+		rowsMoved++
+		if err != nil {
+			return 0, fmt.Errorf("deleting rows: %w", err)
+		}
+		return len(rows), nil
+	}
+
+	writes := newSheetWrites(sheetName)
+	for _, row := range rows {
+		values, err := tweetToRow(redacted[row], header)
+		if err != nil {
+			return 0, fmt.Errorf("converting row %d: %w", row, err)
+		}
+		writes.update(spreadsheetID, sheetRange(sheetName, fmt.Sprintf("R%dC1:R%d", row, row)), values)
+	}
+	if _, _, _, err := writes.flush(ctx, sheetsService); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// redactData returns the data of a redacted row: who submitted the tweet
+// and when, and only the ID of the tweet, which keeps deduplication working.
+func redactData(data map[string]interface{}, tweetID string) map[string]interface{} {
+	r := map[string]interface{}{
+		"status": statusRedacted,
+		"tweet":  map[string]interface{}{"id_str": tweetID},
+	}
+	for _, f := range redactedKeptFields {
+		if v, ok := data[f]; ok {
+			r[f] = v
+		}
+	}
+	return r
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// fakeSheet is sheet "Tweets" with ID 5 of spreadsheet "ss". It serves
+// reads of the json column, row deletions and row updates.
+type fakeSheet struct {
+	header []string
+	// Rows from row 2 on.
+	rows [][]interface{}
+}
+
+var rowRangeRe = regexp.MustCompile(`^Tweets!R([0-9]+)C1:R([0-9]+)$`)
+
+func (f *fakeSheet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v4/spreadsheets/ss")
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		json.NewEncoder(w).Encode(&sheets.Spreadsheet{Sheets: []*sheets.Sheet{
+			{Properties: &sheets.SheetProperties{Title: "Tweets", SheetId: 5}},
+		}})
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/values/"):
+		col := jsonColumn(f.header)
+		column := []interface{}{}
+		for _, row := range f.rows {
+			column = append(column, row[col])
+		}
+		json.NewEncoder(w).Encode(&sheets.ValueRange{Values: [][]interface{}{column}})
+	case path == ":batchUpdate":
+		req := &sheets.BatchUpdateSpreadsheetRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		for _, rq := range req.Requests {
+			d := rq.DeleteDimension.Range
+			if d.SheetId != 5 || d.EndIndex != d.StartIndex+1 {
+				http.Error(w, "unexpected delete", http.StatusBadRequest)
+				return
+			}
+			i := int(d.StartIndex) - 1
+			f.rows = append(f.rows[:i], f.rows[i+1:]...)
+		}
+		json.NewEncoder(w).Encode(&sheets.BatchUpdateSpreadsheetResponse{})
+	case path == "/values:batchUpdate":
+		req := &sheets.BatchUpdateValuesRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		for _, d := range req.Data {
+			m := rowRangeRe.FindStringSubmatch(d.Range)
+			if m == nil || m[1] != m[2] {
+				http.Error(w, "unexpected range "+d.Range, http.StatusBadRequest)
+				return
+			}
+			row, _ := strconv.Atoi(m[1])
+			f.rows[row-2] = d.Values[0]
+		}
+		json.NewEncoder(w).Encode(&sheets.BatchUpdateValuesResponse{})
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+	}
+}
+
+func newFakeSheet(t *testing.T, tweetIDs ...string) (*fakeSheet, *sheets.Service) {
+	t.Helper()
+	f := &fakeSheet{header: testHeader}
+	for i, id := range tweetIDs {
+		data := map[string]interface{}{"sender_id": "7", "sender_username": "seven", "notes": "note " + strconv.Itoa(i)}
+		updateComputedFields(data, testTweet(id, "50", "text of "+id))
+		row, err := tweetToRow(data, testHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.rows = append(f.rows, row)
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	svc, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, svc
+}
+
+func TestRedactDeletesRows(t *testing.T) {
+	f, svc := newFakeSheet(t, "100", "200", "300", "200")
+	moved := rowsMoved
+	n, err := redactSheet(context.Background(), svc, "ss", "Tweets", testHeader, "200", true)
+	if err != nil || n != 2 {
+		t.Fatalf("redactSheet = %d, %v, want 2 rows", n, err)
+	}
+	urls := []string{}
+	for _, row := range f.rows {
+		urls = append(urls, fmt.Sprint(row[0]))
+	}
+	if want := "[https://twitter.com/user50/status/100 https://twitter.com/user50/status/300]"; fmt.Sprint(urls) != want {
+		t.Errorf("rows left %v, want %s", urls, want)
+	}
+	if rowsMoved == moved {
+		t.Errorf("rowsMoved wasn't bumped, polls would write to shifted rows")
+	}
+}
+
+func TestRedactBlanksRows(t *testing.T) {
+	f, svc := newFakeSheet(t, "100", "200")
+	n, err := redactSheet(context.Background(), svc, "ss", "Tweets", testHeader, "200", false)
+	if err != nil || n != 1 {
+		t.Fatalf("redactSheet = %d, %v, want 1 row", n, err)
+	}
+	row := f.rows[1]
+	if row[0] != "" || row[1] != "" || row[2] != "" || row[3] != "seven" {
+		t.Errorf("redacted row = %q, want only the sender", row[:4])
+	}
+	data := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(row[4].(string)), &data); err != nil {
+		t.Fatal(err)
+	}
+	if tweet, _ := data["tweet"].(map[string]interface{}); data["status"] != statusRedacted || data["text"] != nil || tweet["id_str"] != "200" {
+		t.Errorf("redacted json = %v", data)
+	}
+	if f.rows[0][1] != "'text of 100" {
+		t.Errorf("other row changed: %q", f.rows[0])
+	}
+
+	if n, err := redactSheet(context.Background(), svc, "ss", "Tweets", testHeader, "999", false); err != nil || n != 0 {
+		t.Errorf("redacting a tweet that isn't there = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+// statuses/lookup accepts at most 100 IDs per request.
+const statusLookupBatchSize = 100
+
+// inLookupBatches calls f with consecutive slices of ids small enough for a
+// single statuses/lookup request, stopping at the first error.
+func inLookupBatches(ids []int64, f func(batch []int64) error) error {
+	for start := 0; start < len(ids); start += statusLookupBatchSize {
+		end := start + statusLookupBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := f(ids[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshMetricsHandler re-fetches all saved tweets and updates their like,
+// retweet and reply counts. Requests are authenticated like /tweet, and the
+// tweets are fetched with the credentials they carry.
+func refreshMetricsHandler(botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_, twClient, ok := authenticateBot(w, r, botUserIDs)
+		if !ok {
+			return
+		}
+		refreshed, deleted, updated, err := refreshMetrics(r.Context(), twClient)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		totals.addRefresh(updated, time.Now())
+		fmt.Fprintf(w, "refreshed %d, deleted %d, %d rows changed\n", refreshed, deleted, updated)
+	})
+}
+
+// refreshMetrics updates the counts stored with each row of the default
+// spreadsheet. Only the counts in the stored tweet change, so the text and
+// notes stay as they were when the tweet was saved. Rows whose tweet is gone
+// get marked as deleted. Only rows that changed are written, their number is
+// returned as updated and shown on /metrics.
+func refreshMetrics(ctx context.Context, twClient *twitter.Client) (refreshed int, deleted int, updated int, err error) {
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	vars := rcService.Projects.Configs.Variables
+	spreadsheetID, err := vars.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	sheetName, err := loadSheetName(vars)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("loading sheet name: %w", err)
+	}
+
+	sheetsService, err := clients.sheetsService()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to create sheets service: %w", err)
+	}
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("getting spreadsheet header: %w", err)
+	}
+	jsonColumnNumber := jsonColumn(header)
+	if jsonColumnNumber < 0 {
+		return 0, 0, 0, fmt.Errorf("missing \"json\" column in the spreadsheet")
+	}
+	rng := sheetRange(sheetName, fmt.Sprintf("R2C%d:C%d", jsonColumnNumber+1, jsonColumnNumber+1))
+	values, err := sheetsService.Spreadsheets.Values.Get(spreadsheetID.Text, rng).MajorDimension("COLUMNS").Context(ctx).Do()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to get spreadsheet data: %w", err)
+	}
+	if len(values.Values) <= 0 {
+		return 0, 0, 0, nil
+	}
+
+	type storedRow struct {
+		row  int
+		data map[string]interface{}
+	}
+	rowsByID := map[int64][]storedRow{}
+	ids := []int64{}
+	for i, v := range values.Values[0] {
+		s, _ := v.(string)
+		data := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(s), &data); err != nil {
+			continue
+		}
+		if isUnavailable(data) {
+			continue
+		}
+		tweet, _ := data["tweet"].(map[string]interface{})
+		idStr, _ := tweet["id_str"].(string)
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := rowsByID[id]; !ok {
+			ids = append(ids, id)
+		}
+		rowsByID[id] = append(rowsByID[id], storedRow{row: i + 2, data: data})
+	}
+
+	writes := newSheetWrites(sheetName)
+	err = inLookupBatches(ids, func(batch []int64) error {
+		tweets, _, err := twClient.Statuses.Lookup(batch, &twitter.StatusLookupParams{TweetMode: "extended"})
+		if err != nil {
+			return fmt.Errorf("looking up tweets: %w", err)
+		}
+		found := map[int64]twitter.Tweet{}
+		for _, t := range tweets {
+			found[t.ID] = t
+		}
+		for _, id := range batch {
+			t, ok := found[id]
+			for _, r := range rowsByID[id] {
+				if ok {
+					refreshed++
+					if !applyCounts(r.data, &t) {
+						continue
+					}
+				} else {
+					// statuses/lookup silently leaves out tweets it can't
+					// return.
+					r.data["status"] = statusDeleted
+					deleted++
+				}
+				row, err := tweetToRow(r.data, header)
+				if err != nil {
+					log.Printf("Failed to convert row %d: %s", r.row, err)
+					continue
+				}
+				writes.update(spreadsheetID.Text, sheetRange(sheetName, fmt.Sprintf("R%dC1:R%d", r.row, r.row)), row)
+				updated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return refreshed, deleted, updated, err
+	}
+	if _, _, _, err := writes.flush(ctx, sheetsService); err != nil {
+		return refreshed, deleted, updated, err
+	}
+	return refreshed, deleted, updated, nil
+}
+
+// applyCounts copies the counts of a freshly fetched tweet into the row data,
+// both into the stored tweet, so rebuilds keep them, and into the columns.
+// It reports whether any of them changed.
+func applyCounts(data map[string]interface{}, fresh *twitter.Tweet) bool {
+	counts := map[string]int{
+		"favorite_count": fresh.FavoriteCount,
+		"retweet_count":  fresh.RetweetCount,
+		"reply_count":    fresh.ReplyCount,
+	}
+	changed := false
+	tweet, _ := data["tweet"].(map[string]interface{})
+	for field, n := range counts {
+		if !sameCount(data[field], n) {
+			data[field] = n
+			changed = true
+		}
+		if tweet != nil && !sameCount(tweet[field], n) {
+			tweet[field] = n
+			changed = true
+		}
+	}
+	return changed
+}
+
+// sameCount reports whether a count read back from the json column is n.
+// Numbers in JSON are read as float64.
+func sameCount(v interface{}, n int) bool {
+	switch v := v.(type) {
+	case float64:
+		return v == float64(n)
+	case int:
+		return v == n
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func TestApplyCounts(t *testing.T) {
+	stored := `{"favorite_count":1000000,"retweet_count":5,"reply_count":2,"tweet":{"id_str":"100","favorite_count":1000000,"retweet_count":5,"reply_count":2}}`
+	data := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(stored), &data); err != nil {
+		t.Fatal(err)
+	}
+	if applyCounts(data, &twitter.Tweet{FavoriteCount: 1000000, RetweetCount: 5, ReplyCount: 2}) {
+		t.Errorf("applyCounts reported a change for the same counts")
+	}
+	if !applyCounts(data, &twitter.Tweet{FavoriteCount: 1000000, RetweetCount: 6, ReplyCount: 2}) {
+		t.Errorf("applyCounts didn't report a changed retweet count")
+	}
+	if data["retweet_count"] != 6 || data["tweet"].(map[string]interface{})["retweet_count"] != 6 {
+		t.Errorf("retweet count was not updated: %v", data)
+	}
+
+	// Rows saved before the counts had columns.
+	old := map[string]interface{}{"tweet": map[string]interface{}{"id_str": "100"}}
+	if !applyCounts(old, &twitter.Tweet{}) {
+		t.Errorf("applyCounts didn't report counts missing from the row")
+	}
+}
+
+func TestMetricsShowRefreshedRows(t *testing.T) {
+	m := &metricTotals{}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), "refresh_rows_updated") {
+		t.Errorf("refresh_rows_updated shown before any refresh:\n%s", w.Body)
+	}
+	m.addRefresh(3, time.Now())
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "\nrefresh_rows_updated 3\n") {
+		t.Errorf("refresh_rows_updated missing from:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+// replayEventsHandler runs a captured DM events list response, POSTed as
+// the request body, through the same processing as a poll and responds with
+// the rows that would be written. All senders are routed to the spreadsheet
+// given by ?spreadsheet_id=, which is only read from. Tweets are fetched with
+// the credentials of the first bot account. Only enabled with DEBUG set, and
+// requests are authenticated like /tweet.
+func replayEventsHandler(ds *datastore.Client, botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := authenticateBot(w, r, botUserIDs); !ok {
+			return
+		}
+		account := botUserIDs[0]
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		spreadsheetID := r.URL.Query().Get("spreadsheet_id")
+		if spreadsheetID == "" {
+			http.Error(w, "missing spreadsheet_id", http.StatusBadRequest)
+			return
+		}
+		resp := &twitter.DirectMessageEvents{}
+		if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+			http.Error(w, fmt.Sprintf("unmarshaling events: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		rcService, err := runtimeconfig.NewService(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		vars := rcService.Projects.Configs.Variables
+		cfg, err := loadConfig(vars)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("loading config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		// Nothing gets written, not even recorded responses.
+		cfg.DryRun = true
+		cfg.RecordResponses = false
+		sheetName, err := loadSheetName(vars)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("loading sheet name: %s", err), http.StatusInternalServerError)
+			return
+		}
+		senderWhitelist, senderSpreadsheets, err := loadWhitelist(ctx, ds, vars, spreadsheetID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("fetching whitelist: %s", err), http.StatusInternalServerError)
+			return
+		}
+		for sender := range senderSpreadsheets {
+			senderSpreadsheets[sender] = spreadsheetID
+		}
+
+		userCreds, err := loadUserCredentials(ctx, ds, account, true)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get user token: %s", err), http.StatusInternalServerError)
+			return
+		}
+		appCreds, err := clients.appCredentials(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get app credentials: %s", err), http.StatusInternalServerError)
+			return
+		}
+		httpClient, twClient := clients.twitterClient(account, appCreds, *userCreds)
+
+		store, err := newStore(ctx, cfg, sheetName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer store.Close()
+		stored, err := loadStoredState(ctx, cfg, store, senderWhitelist, senderSpreadsheets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p, err := newEventProcessor(ctx, ds, account, cfg, httpClient, twClient, store, stored, &pollMetrics{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if cfg.ResolveShorteners {
+			shorteners := newShortenerResolver()
+			for _, e := range resp.Events {
+				if e.Message != nil {
+					shorteners.resolveMessageURLs(ctx, e.Message)
+				}
+			}
+		}
+		p.process(ctx, resp.Events, senderWhitelist, senderWhitelist, senderSpreadsheets)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.(*dryRunStore).rows)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// How many replies up conversationID walks before giving up.
+const maxConversationDepth = 20
+
+// parentTweets fetches the tweets that saved tweets reply to. It's created
+// for a single poll, so each parent is fetched at most once per poll.
+type parentTweets struct {
+	client *twitter.Client
+	tweets map[int64]*twitter.Tweet
+	errs   map[int64]error
+}
+
+func newParentTweets(client *twitter.Client) *parentTweets {
+	return &parentTweets{
+		client: client,
+		tweets: map[int64]*twitter.Tweet{},
+		errs:   map[int64]error{},
+	}
+}
+
+func (p *parentTweets) get(id int64) (*twitter.Tweet, error) {
+	if t, ok := p.tweets[id]; ok {
+		return t, nil
+	}
+	if err, ok := p.errs[id]; ok {
+		return nil, err
+	}
+	t, _, err := p.client.Statuses.Show(id, &twitter.StatusShowParams{IncludeEntities: twitter.Bool(true), TweetMode: "extended"})
+	if err != nil {
+		p.errs[id] = err
+		return nil, err
+	}
+	p.tweets[id] = t
+	return t, nil
+}
+
+// conversationID returns the ID of the tweet that started the conversation
+// the tweet belongs to, found by following its chain of replies up. v1.1
+// tweets don't include it.
+func (p *parentTweets) conversationID(tweet *twitter.Tweet) (string, error) {
+	cur := tweet
+	for depth := 0; cur.InReplyToStatusID != 0; depth++ {
+		if depth >= maxConversationDepth {
+			return "", fmt.Errorf("more than %d replies deep", maxConversationDepth)
+		}
+		parent, err := p.get(cur.InReplyToStatusID)
+		if err != nil {
+			return "", fmt.Errorf("fetching %s: %w", cur.InReplyToStatusIDStr, err)
+		}
+		cur = parent
+	}
+	return cur.IDStr, nil
+}
+
+// applyInReplyTo fills in the fields describing the tweet being replied to.
+func applyInReplyTo(data map[string]interface{}, parent *twitter.Tweet) {
+	if parent == nil {
+		return
+	}
+	// Covers rows saved before conversation IDs were, and replies whose
+	// conversation couldn't be walked, if the parent started it.
+	if _, ok := data["conversation_id"]; !ok && parent.InReplyToStatusID == 0 && parent.IDStr != "" {
+		data["conversation_id"] = parent.IDStr
+	}
+	data["in_reply_to_text"], _ = splitTweetText(expandedText(parent))
+	if parent.User != nil {
+		data["in_reply_to_url"] = tweetURL(parent)
+	}
+}
+
+// storedInReplyTo returns the parent tweet stored in the "in_reply_to_tweet"
+// field, if any.
+func storedInReplyTo(data map[string]interface{}) (*twitter.Tweet, error) {
+	v, ok := data["in_reply_to_tweet"]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	r := &twitter.Tweet{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
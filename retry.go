@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	maxSheetsWriteRetries   = 5
+	initialSheetsWriteDelay = time.Second
+)
+
+func isRetryableSheetsError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+}
+
+func isSheetsRateLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests
+}
+
+// retrySheetsWrite calls write until it succeeds, retrying 5xx and 429
+// errors up to maxSheetsWriteRetries times with exponential backoff and
+// jitter. Other errors are returned straight away.
+func retrySheetsWrite(ctx context.Context, fields logFields, write func() error) error {
+	return retrySheets(ctx, fields, isRetryableSheetsError, write)
+}
+
+// retrySheetsAppend is retrySheetsWrite for appends, which aren't
+// idempotent. After a 5xx the rows may have been appended anyway, so only
+// 429s, which are rejected before anything is written, are retried.
+func retrySheetsAppend(ctx context.Context, fields logFields, write func() error) error {
+	return retrySheets(ctx, fields, isSheetsRateLimitError, write)
+}
+
+func retrySheets(ctx context.Context, fields logFields, retryable func(error) bool, write func() error) error {
+	delay := initialSheetsWriteDelay
+	for retry := 0; ; retry++ {
+		err := write()
+		if err == nil || retry >= maxSheetsWriteRetries || !retryable(err) {
+			return err
+		}
+		wait := delay + time.Duration(rand.Int63n(int64(delay)))
+		logWarning(fields, "Sheets write failed, retrying in %s (%d/%d): %s", wait, retry+1, maxSheetsWriteRetries, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetrySheetsAppendOnlyRetriesRateLimits(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	err := retrySheetsAppend(ctx, logFields{}, func() error {
+		calls++
+		return &googleapi.Error{Code: 503}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("append failing with 503: %d calls, error %v; want 1 call and the error", calls, err)
+	}
+
+	calls = 0
+	err = retrySheetsAppend(ctx, logFields{}, func() error {
+		calls++
+		if calls == 1 {
+			return &googleapi.Error{Code: 429}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("append rate limited once: %d calls, error %v; want 2 calls and no error", calls, err)
+	}
+}
+
+func TestRetrySheetsWriteRetriesServerErrors(t *testing.T) {
+	calls := 0
+	err := retrySheetsWrite(context.Background(), logFields{}, func() error {
+		calls++
+		if calls == 1 {
+			return &googleapi.Error{Code: 500}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("update failing with 500 once: %d calls, error %v; want 2 calls and no error", calls, err)
+	}
+
+	calls = 0
+	err = retrySheetsWrite(context.Background(), logFields{}, func() error {
+		calls++
+		return &googleapi.Error{Code: 400}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("update failing with 400: %d calls, error %v; want 1 call and the error", calls, err)
+	}
+}
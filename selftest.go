@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/datastore"
+	"github.com/dghubble/go-twitter/twitter"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+// Tweet fetched by /selftest unless selftest_tweet_id or the tweet_id query
+// parameter says otherwise. It's the first public tweet, so it's unlikely to
+// go away.
+const defaultSelftestTweetID = "20"
+
+type selftestCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type selftestCell struct {
+	Column string      `json:"column"`
+	Value  interface{} `json:"value"`
+}
+
+type selftestReport struct {
+	OK     bool            `json:"ok"`
+	Checks []selftestCheck `json:"checks"`
+	// The row the test tweet would be saved as, in column order.
+	Row []selftestCell `json:"row,omitempty"`
+}
+
+func (r *selftestReport) check(name string, err error) bool {
+	c := selftestCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, c)
+	return err == nil
+}
+
+// selftestHandler checks the configuration, the credentials of every bot
+// account and read access to the default spreadsheet, then renders a known
+// tweet into a row against the live header without writing it. It responds
+// with a selftestReport, with status 503 if any check failed. Requests are
+// authenticated like /tweet.
+func selftestHandler(ds *datastore.Client, botUserIDs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, twClient, ok := authenticateBot(w, r, botUserIDs)
+		if !ok {
+			return
+		}
+		report := selftest(r.Context(), ds, botUserIDs, twClient, r.URL.Query().Get("tweet_id"))
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+func selftest(ctx context.Context, ds *datastore.Client, botUserIDs []string, twClient *twitter.Client, tweetID string) *selftestReport {
+	report := &selftestReport{OK: true}
+
+	appCreds, err := clients.appCredentials(ctx)
+	if report.check("app_credentials", err) {
+		for i, account := range botUserIDs {
+			userCreds, err := loadUserCredentials(ctx, ds, account, i == 0)
+			if err == nil {
+				_, client := clients.twitterClient(account, appCreds, *userCreds)
+				_, _, err = client.Accounts.VerifyCredentials(&twitter.AccountVerifyParams{SkipStatus: twitter.Bool(true)})
+			}
+			report.check("twitter_auth/"+account, err)
+		}
+	}
+
+	rcService, err := runtimeconfig.NewService(ctx)
+	if !report.check("runtime_config", err) {
+		return report
+	}
+	vars := rcService.Projects.Configs.Variables
+	if tweetID == "" {
+		if tweetID, err = optionalVariable(vars, "selftest_tweet_id"); err != nil {
+			report.check("selftest_tweet_id", err)
+			return report
+		}
+	}
+	if tweetID == "" {
+		tweetID = defaultSelftestTweetID
+	}
+
+	var header []string
+	err = func() error {
+		spreadsheetID, err := vars.Get(variableName("spreadsheet_id")).Do()
+		if err != nil {
+			return fmt.Errorf("fetching spreadsheet_id: %w", err)
+		}
+		sheetName, err := loadSheetName(vars)
+		if err != nil {
+			return fmt.Errorf("loading sheet name: %w", err)
+		}
+		sheetsService, err := clients.sheetsService()
+		if err != nil {
+			return fmt.Errorf("failed to create sheets service: %w", err)
+		}
+		header, err = getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+		return err
+	}()
+	report.check("sheets_header", err)
+
+	var tweet *twitter.Tweet
+	id, err := strconv.ParseInt(tweetID, 10, 64)
+	if err == nil {
+		tweet, _, err = twClient.Statuses.Show(id, &twitter.StatusShowParams{IncludeEntities: twitter.Bool(true), TweetMode: "extended"})
+	}
+	if !report.check("fetch_tweet/"+tweetID, err) || header == nil {
+		return report
+	}
+
+	data := map[string]interface{}{"notes": "selftest"}
+	updateComputedFields(data, tweet)
+	row, err := tweetToRow(data, header)
+	if !report.check("render_row", err) {
+		return report
+	}
+	for i, column := range header {
+		if i < len(row) {
+			report.Row = append(report.Row, selftestCell{Column: column, Value: row[i]})
+		}
+	}
+	return report
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const senderSavesEntity = "SenderSaves"
+
+// Window of max_saves_per_sender_per_hour.
+const senderSavesWindow = time.Hour
+
+// SenderSaves holds the times of a sender's saves within the last
+// senderSavesWindow, keyed by the sender ID.
+type SenderSaves struct {
+	Times []time.Time `datastore:",noindex"`
+}
+
+// allowSenderSave reports whether the sender has saved fewer than limit
+// tweets in the last hour, and if so records a save at now. In dry runs the
+// save isn't recorded.
+func allowSenderSave(ctx context.Context, ds *datastore.Client, senderID string, limit int, now time.Time, dryRun bool) (bool, error) {
+	key := datastore.NameKey(senderSavesEntity, senderID, nil)
+	allowed := false
+	_, err := ds.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		s := &SenderSaves{}
+		if err := tx.Get(key, s); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		allowed = s.allow(limit, now)
+		if !allowed || dryRun {
+			return nil
+		}
+		_, err := tx.Put(key, s)
+		return err
+	})
+	return allowed, err
+}
+
+// allow drops the saves that are out of the window and, if fewer than limit
+// are left, records a save at now.
+func (s *SenderSaves) allow(limit int, now time.Time) bool {
+	recent := []time.Time{}
+	for _, t := range s.Times {
+		if now.Sub(t) < senderSavesWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.Times = recent
+	if len(recent) >= limit {
+		return false
+	}
+	s.Times = append(s.Times, now)
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func TestSenderSavesAllow(t *testing.T) {
+	start := time.Date(2022, 2, 24, 3, 0, 0, 0, time.UTC)
+	s := &SenderSaves{}
+	for i := 0; i < 2; i++ {
+		if !s.allow(2, start.Add(time.Duration(i)*time.Minute)) {
+			t.Fatalf("save %d was refused under the limit", i+1)
+		}
+	}
+	if s.allow(2, start.Add(30*time.Minute)) {
+		t.Errorf("save over the limit was allowed")
+	}
+	if len(s.Times) != 2 {
+		t.Errorf("refused save was recorded: %v", s.Times)
+	}
+	// The window is rolling: the first save drops out an hour later.
+	if !s.allow(2, start.Add(senderSavesWindow)) {
+		t.Errorf("save was refused after the first one left the window")
+	}
+	if s.allow(2, start.Add(senderSavesWindow)) {
+		t.Errorf("save over the limit was allowed")
+	}
+}
+
+func TestProcessChecksSenderCapBeforeFetching(t *testing.T) {
+	tw := newFakeTwitter(testTweet("100", "50", "first"), testTweet("200", "50", "second"), testTweet("300", "50", "third"))
+	store := newMemoryStore()
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+		dmEvent("3", 3000, "7", "", "300"),
+	}
+	cfg := &Config{SenderWorkers: 1, MaxSavesPerSenderPerHour: 1}
+	saves := &SenderSaves{}
+	processEvents(t, cfg, tw, store, events, func(p *eventProcessor) {
+		p.allowSave = func(ctx context.Context, sender string) (bool, error) {
+			return saves.allow(cfg.MaxSavesPerSenderPerHour, time.Now()), nil
+		}
+	})
+	if got := store.storedTweetIDs(t, "ss"); fmt.Sprint(got) != "[100]" {
+		t.Errorf("stored tweets %v, want only the first", got)
+	}
+	if n := tw.count("/1.1/statuses/show.json"); n != 1 {
+		t.Errorf("fetched %d tweets, want only the one under the cap", n)
+	}
+}
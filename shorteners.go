@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const (
+	maxShortenerRedirects = 3
+	shortenerTimeout      = 5 * time.Second
+)
+
+// shortenerResolver follows redirects of shortened URLs (bit.ly and the
+// like) that don't look like tweet URLs. Resolved URLs are cached for the
+// lifetime of the resolver, which is a single poll.
+type shortenerResolver struct {
+	client *http.Client
+	cache  map[string]string
+}
+
+func newShortenerResolver() *shortenerResolver {
+	return &shortenerResolver{
+		client: &http.Client{
+			Timeout: shortenerTimeout,
+			// Redirects are followed one at a time in resolve.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache: map[string]string{},
+	}
+}
+
+// resolveMessageURLs replaces the expanded URLs in msg that don't match
+// tweetIDRe with the location they redirect to.
+func (r *shortenerResolver) resolveMessageURLs(ctx context.Context, msg *twitter.DirectMessageEventMessage) {
+	if msg == nil || msg.Data == nil || msg.Data.Entities == nil {
+		return
+	}
+	for i, u := range msg.Data.Entities.Urls {
+		if u.ExpandedURL == "" || tweetIDRe.MatchString(u.ExpandedURL) {
+			continue
+		}
+		msg.Data.Entities.Urls[i].ExpandedURL = r.resolve(ctx, u.ExpandedURL)
+	}
+}
+
+// resolve returns the URL u redirects to, following at most
+// maxShortenerRedirects redirects and stopping early at a tweet URL. On
+// failure the last URL reached is returned.
+func (r *shortenerResolver) resolve(ctx context.Context, u string) string {
+	if v, ok := r.cache[u]; ok {
+		return v
+	}
+	final := u
+	for i := 0; i < maxShortenerRedirects; i++ {
+		next, ok := r.next(ctx, final)
+		if !ok {
+			break
+		}
+		final = next
+		if tweetIDRe.MatchString(final) {
+			break
+		}
+	}
+	r.cache[u] = final
+	return final
+}
+
+// next returns the redirect location of u, trying HEAD first and falling
+// back to GET for servers that don't support it.
+func (r *shortenerResolver) next(ctx context.Context, u string) (string, bool) {
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return "", false
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			logDebug(logFields{"url": u}, "Failed to resolve URL: %s", err)
+			return "", false
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 && method == http.MethodHead {
+			continue
+		}
+		loc, err := resp.Location()
+		if err != nil {
+			return "", false
+		}
+		return loc.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const defaultSQLitePath = "tweets.db"
+
+// Columns of a new SQLite table, unless SQLITE_COLUMNS lists others.
+var defaultSQLiteColumns = []string{"json", "url", "text", "notes", "author", "sender_name", "submitted_at"}
+
+// sqliteStore keeps tweets in the "tweets" table of a SQLite database. It
+// has a text column per field, like the columns of the spreadsheet header,
+// and the spreadsheet ID the sender is mapped to as the target. Row numbers
+// are the IDs of the table rows.
+type sqliteStore struct {
+	db      *sql.DB
+	header  []string
+	updates map[string][]sqliteUpdate
+	appends map[string][]pendingAppend
+}
+
+type sqliteUpdate struct {
+	id     int
+	values []interface{}
+}
+
+func openSQLiteStore(ctx context.Context, path string, columns []string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	s := &sqliteStore{
+		db:      db,
+		updates: map[string][]sqliteUpdate{},
+		appends: map[string][]pendingAppend{},
+	}
+	if len(columns) == 0 {
+		columns = defaultSQLiteColumns
+	}
+	if err := s.migrate(ctx, columns); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating the tweets table in %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// migrate creates the table and adds the columns it doesn't have yet.
+// Columns are never dropped.
+func (s *sqliteStore) migrate(ctx context.Context, columns []string) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS tweets (id INTEGER PRIMARY KEY AUTOINCREMENT, target TEXT NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	existing, err := s.columns(ctx)
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, c := range existing {
+		present[c] = true
+	}
+	for _, c := range columns {
+		if present[c] {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE tweets ADD COLUMN %s TEXT`, quoteIdent(c))); err != nil {
+			return fmt.Errorf("adding column %q: %w", c, err)
+		}
+		present[c] = true
+	}
+	return nil
+}
+
+// columns returns the field columns of the table, in order.
+func (s *sqliteStore) columns(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM pragma_table_info('tweets') ORDER BY cid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if name == "id" || name == "target" {
+			continue
+		}
+		r = append(r, name)
+	}
+	return r, rows.Err()
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// Header returns the same columns for all targets, as they share the table.
+func (s *sqliteStore) Header(ctx context.Context, target string) ([]string, error) {
+	header, err := s.columns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateHeader(header); err != nil {
+		return nil, err
+	}
+	s.header = header
+	return header, nil
+}
+
+func (s *sqliteStore) LastStored(ctx context.Context, target string, header []string, senders map[string]string, allIDs map[string]bool) (map[string]storedTweetInfo, map[string]map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, json FROM tweets WHERE target = ? ORDER BY id`, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	stored := []storedTweetInfo{}
+	for rows.Next() {
+		var id int
+		var j sql.NullString
+		if err := rows.Scan(&id, &j); err != nil {
+			return nil, nil, err
+		}
+		stored = append(stored, storedTweetInfo{Row: id, JSON: j.String})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return lastStoredTweets(stored, senders, allIDs)
+}
+
+func (s *sqliteStore) Update(target string, id int, values []interface{}) {
+	s.updates[target] = append(s.updates[target], sqliteUpdate{id: id, values: values})
+}
+
+func (s *sqliteStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.appends[target] = append(s.appends[target], pendingAppend{event: first, row: values})
+}
+
+// Flush writes each target in its own transaction, so a failure for one
+// target doesn't affect the others.
+func (s *sqliteStore) Flush(ctx context.Context) (updated int, appended int, failed map[string]bool, err error) {
+	failed = map[string]bool{}
+	errs := multiError{}
+	targets := map[string]bool{}
+	for t := range s.updates {
+		targets[t] = true
+	}
+	for t := range s.appends {
+		targets[t] = true
+	}
+	for target := range targets {
+		u, a, err := s.flushTarget(ctx, target)
+		if err != nil {
+			failed[target] = true
+			errs.add(fmt.Errorf("writing rows of %s: %w", target, err))
+			continue
+		}
+		updated += u
+		appended += a
+		delete(s.updates, target)
+		delete(s.appends, target)
+	}
+	return updated, appended, failed, errs.err()
+}
+
+func (s *sqliteStore) flushTarget(ctx context.Context, target string) (updated int, appended int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	columns := []string{}
+	placeholders := []string{}
+	for _, c := range s.header {
+		columns = append(columns, quoteIdent(c))
+		placeholders = append(placeholders, "?")
+	}
+	set := strings.Join(columns, " = ?, ") + " = ?"
+	for _, u := range s.updates[target] {
+		args := append(s.values(u.values), u.id, target)
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE tweets SET %s WHERE id = ? AND target = ?`, set), args...); err != nil {
+			return 0, 0, fmt.Errorf("updating row %d: %w", u.id, err)
+		}
+		updated++
+	}
+	pending := s.appends[target]
+	sortPendingAppends(pending)
+	insert := fmt.Sprintf(`INSERT INTO tweets (target, %s) VALUES (?, %s)`, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	for _, p := range pending {
+		args := append([]interface{}{target}, s.values(p.row)...)
+		if _, err := tx.ExecContext(ctx, insert, args...); err != nil {
+			return 0, 0, fmt.Errorf("inserting row: %w", err)
+		}
+		appended++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return updated, appended, nil
+}
+
+// values converts a row made by tweetToRow for the table, dropping the
+// apostrophe that only tells Sheets to keep text columns as is.
+func (s *sqliteStore) values(row []interface{}) []interface{} {
+	r := make([]interface{}, len(s.header))
+	for i := range s.header {
+		if i >= len(row) {
+			continue
+		}
+		v := row[i]
+		if str, ok := v.(string); ok && textColumns[s.header[i]] {
+			v = strings.TrimPrefix(str, "'")
+		}
+		r[i] = v
+	}
+	return r
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
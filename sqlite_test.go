@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// openMemorySQLiteStore opens a store on the named in-memory database,
+// shared by the connections of the pool.
+func openMemorySQLiteStore(t *testing.T, name string, columns []string) *sqliteStore {
+	t.Helper()
+	s, err := openSQLiteStore(context.Background(), fmt.Sprintf("file:%s?mode=memory&cache=shared", name), columns)
+	if err != nil {
+		t.Fatalf("openSQLiteStore: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	store := openMemorySQLiteStore(t, "store", nil)
+	tw := newFakeTwitter(testTweet("100", "50", "first"), testTweet("200", "50", "=second"))
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+	}
+	processEvents(t, &Config{SenderWorkers: 1}, tw, store, events, nil)
+
+	// A note sent later updates the row of the last tweet in place.
+	events = append(events, dmEvent("3", 3000, "7", "a note", ""))
+	processEvents(t, &Config{SenderWorkers: 1}, tw, store, events, nil)
+
+	rows, err := store.db.QueryContext(ctx, `SELECT id, target, url, text, notes FROM tweets ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := []string{}
+	for rows.Next() {
+		var id int
+		var target, url, text, notes string
+		if err := rows.Scan(&id, &target, &url, &text, &notes); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s %q %q", id, target, url, text, notes))
+	}
+	want := []string{
+		`1 ss https://twitter.com/user50/status/100 "first" ""`,
+		`2 ss https://twitter.com/user50/status/200 "=second" "a note"`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rows:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSQLiteStoreAddsColumns(t *testing.T) {
+	ctx := context.Background()
+	store := openMemorySQLiteStore(t, "migrated", []string{"json", "url"})
+	if err := store.migrate(ctx, []string{"json", "url", "text", "odd \"name\""}); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	header, err := store.Header(ctx, "ss")
+	if err != nil {
+		t.Fatalf("Header: %s", err)
+	}
+	if want := []string{"json", "url", "text", "odd \"name\""}; fmt.Sprint(header) != fmt.Sprint(want) {
+		t.Errorf("header = %q, want %q", header, want)
+	}
+
+	other := openMemorySQLiteStore(t, "nojson", []string{"url", "text"})
+	if _, err := other.Header(ctx, "ss"); err == nil {
+		t.Errorf("Header accepted a table without a json column")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Store is where polls save tweets. Targets are the spreadsheet IDs senders
+// are mapped to by the whitelist, rows are numbered the way LastStored
+// returns them. Writes are collected until Flush.
+type Store interface {
+	// Header returns the field stored in each column.
+	Header(ctx context.Context, target string) ([]string, error)
+	// LastStored works like lastStoredTweetIDPerUser.
+	LastStored(ctx context.Context, target string, header []string, senders map[string]string, allIDs map[string]bool) (map[string]storedTweetInfo, map[string]map[string]bool, error)
+	Update(target string, row int, values []interface{})
+	Append(target string, first twitter.DirectMessageEvent, values []interface{})
+	// Flush works like sheetWrites.flush.
+	Flush(ctx context.Context) (updated int, appended int, failed map[string]bool, err error)
+	Close() error
+}
+
+// newStore returns the store selected by STORAGE_BACKEND, Google Sheets by
+// default. In dry runs it's wrapped in a dryRunStore.
+func newStore(ctx context.Context, cfg *Config, sheetName string) (Store, error) {
+	s, err := newBackendStore(ctx, cfg, sheetName)
+	if err != nil || !cfg.DryRun {
+		return s, err
+	}
+	return &dryRunStore{Store: s}, nil
+}
+
+func newBackendStore(ctx context.Context, cfg *Config, sheetName string) (Store, error) {
+	switch cfg.StorageBackend {
+	case "", "sheets":
+		sheetsService, err := clients.sheetsService()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sheets service: %w", err)
+		}
+		writes := newSheetWrites(sheetName)
+		writes.autoExpand = cfg.AutoExpandGrid
+		return &sheetsStore{sheetsService: sheetsService, writes: writes}, nil
+	case "sqlite":
+		return openSQLiteStore(ctx, cfg.SQLitePath, cfg.SQLiteColumns)
+	case "notion":
+		return newNotionStore(cfg.NotionToken, cfg.NotionDatabaseID)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
+
+type sheetsStore struct {
+	sheetsService *sheets.Service
+	writes        *sheetWrites
+}
+
+func (s *sheetsStore) Header(ctx context.Context, spreadsheetID string) ([]string, error) {
+	return getSheetHeader(ctx, s.sheetsService, spreadsheetID, s.writes.sheetName)
+}
+
+func (s *sheetsStore) LastStored(ctx context.Context, spreadsheetID string, header []string, senders map[string]string, allIDs map[string]bool) (map[string]storedTweetInfo, map[string]map[string]bool, error) {
+	return lastStoredTweetIDPerUser(ctx, s.sheetsService, spreadsheetID, s.writes.sheetName, header, senders, allIDs)
+}
+
+func (s *sheetsStore) Update(spreadsheetID string, row int, values []interface{}) {
+	s.writes.update(spreadsheetID, sheetRange(s.writes.sheetName, fmt.Sprintf("R%dC1:R%d", row, row)), values)
+}
+
+func (s *sheetsStore) Append(spreadsheetID string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.writes.append(spreadsheetID, first, values)
+}
+
+func (s *sheetsStore) Flush(ctx context.Context) (int, int, map[string]bool, error) {
+	return s.writes.flush(ctx, s.sheetsService)
+}
+
+func (s *sheetsStore) Close() error {
+	return nil
+}
+
+// dryRunStore reads from the underlying store, but only logs and collects
+// the writes.
+type dryRunStore struct {
+	Store
+	rows []plannedRow
+}
+
+// plannedRow is a write a dry run skipped. Row is 0 for appends.
+type plannedRow struct {
+	SpreadsheetID string        `json:"spreadsheet_id"`
+	Row           int           `json:"row,omitempty"`
+	Values        []interface{} `json:"values"`
+}
+
+func (s *dryRunStore) Update(target string, row int, values []interface{}) {
+	logInfo(logFields{"spreadsheet_id": target}, "Dry run: would update row %d with %s", row, stringify(values))
+	s.rows = append(s.rows, plannedRow{SpreadsheetID: target, Row: row, Values: values})
+}
+
+func (s *dryRunStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	logInfo(logFields{"spreadsheet_id": target}, "Dry run: would append %s", stringify(values))
+	s.rows = append(s.rows, plannedRow{SpreadsheetID: target, Values: values})
+}
+
+func (s *dryRunStore) Flush(ctx context.Context) (int, int, map[string]bool, error) {
+	return 0, 0, map[string]bool{}, nil
+}
+
+// bufferedStore queues writes until they are moved into the underlying
+// store, which doesn't have to be safe for concurrent use.
+type bufferedStore struct {
+	Store
+	writes []bufferedWrite
+}
+
+type bufferedWrite struct {
+	target string
+	// Row to update, or 0 to append.
+	row    int
+	first  twitter.DirectMessageEvent
+	values []interface{}
+}
+
+func (s *bufferedStore) Update(target string, row int, values []interface{}) {
+	s.writes = append(s.writes, bufferedWrite{target: target, row: row, values: values})
+}
+
+func (s *bufferedStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.writes = append(s.writes, bufferedWrite{target: target, first: first, values: values})
+}
+
+func (s *bufferedStore) moveTo(store Store) {
+	for _, w := range s.writes {
+		if w.row == 0 {
+			store.Append(w.target, w.first, w.values)
+		} else {
+			store.Update(w.target, w.row, w.values)
+		}
+	}
+	s.writes = nil
+}
+
+// lockedStore holds sheetsMu while reading the stored state and while
+// flushing, so that a poll doesn't block other writers while it talks to
+// Twitter. Updates address rows by the number they had when the state was
+// read, so if rows were moved in between, flushing fails for every target
+// written to and the poll is retried from scratch.
+type lockedStore struct {
+	Store
+	// rowsMoved when the state was read.
+	rowsMoved int
+	targets   map[string]bool
+}
+
+func newLockedStore(s Store) *lockedStore {
+	return &lockedStore{Store: s, targets: map[string]bool{}}
+}
+
+func (s *lockedStore) loadStoredState(ctx context.Context, cfg *Config, senderWhitelist map[string]string, senderSpreadsheets map[string]string) (*storedState, error) {
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+	s.rowsMoved = rowsMoved
+	return loadStoredState(ctx, cfg, s.Store, senderWhitelist, senderSpreadsheets)
+}
+
+func (s *lockedStore) Update(target string, row int, values []interface{}) {
+	s.targets[target] = true
+	s.Store.Update(target, row, values)
+}
+
+func (s *lockedStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.targets[target] = true
+	s.Store.Append(target, first, values)
+}
+
+func (s *lockedStore) Flush(ctx context.Context) (int, int, map[string]bool, error) {
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+	if s.rowsMoved != rowsMoved {
+		failed := map[string]bool{}
+		for t := range s.targets {
+			failed[t] = true
+		}
+		return 0, 0, failed, fmt.Errorf("rows were moved since they were read, retrying on the next poll")
+	}
+	updated, appended, failed, err := s.Store.Flush(ctx)
+	for t := range s.targets {
+		if !failed[t] {
+			delete(s.targets, t)
+		}
+	}
+	return updated, appended, failed, err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func TestLockedStoreFailsAfterRowsMoved(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryStore()
+	s := newLockedStore(backend)
+	if _, err := s.loadStoredState(ctx, &Config{}, map[string]string{"7": "sender"}, map[string]string{"7": "ss"}); err != nil {
+		t.Fatalf("loadStoredState: %s", err)
+	}
+	s.Append("ss", twitter.DirectMessageEvent{ID: "1"}, []interface{}{"a"})
+
+	sheetsMu.Lock()
+	rowsMoved++
+	sheetsMu.Unlock()
+
+	_, appended, failed, err := s.Flush(ctx)
+	if err == nil || appended != 0 || !failed["ss"] {
+		t.Errorf("Flush = %d appended, failed %v, error %v; want the target to fail", appended, failed, err)
+	}
+	if len(backend.rows["ss"]) != 0 {
+		t.Errorf("rows were written after rows moved: %v", backend.rows["ss"])
+	}
+
+	s.loadStoredState(ctx, &Config{}, map[string]string{"7": "sender"}, map[string]string{"7": "ss"})
+	if _, appended, _, err := s.Flush(ctx); err != nil || appended != 1 {
+		t.Errorf("Flush after re-reading = %d appended, error %v; want 1 row written", appended, err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var noteTagRe = regexp.MustCompile(`^#[\pL\pN_]+$`)
+
+// splitNoteTags moves the tags that start lines of the notes, as in
+// "#priority #verified checked with the source", out of the notes. Tags are
+// returned without the "#", in order and without duplicates. Hashtags
+// further into a line are part of the text and stay. Lines left with
+// nothing but tags are dropped.
+func splitNoteTags(notes string) (string, []string) {
+	tags := []string{}
+	seen := map[string]bool{}
+	lines := []string{}
+	for _, line := range strings.Split(notes, "\n") {
+		rest := strings.TrimLeftFunc(line, unicode.IsSpace)
+		found := false
+		for strings.HasPrefix(rest, "#") {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			if !noteTagRe.MatchString(rest[:end]) {
+				break
+			}
+			tag := rest[1:end]
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+			found = true
+			rest = strings.TrimLeftFunc(rest[end:], unicode.IsSpace)
+		}
+		if !found {
+			lines = append(lines, line)
+		} else if rest != "" {
+			lines = append(lines, rest)
+		}
+	}
+	return strings.Join(lines, "\n"), tags
+}
+
+// applyNoteTags moves the tags out of the notes field into a comma-separated
+// tags field.
+func applyNoteTags(data map[string]interface{}) {
+	notes, _ := data["notes"].(string)
+	notes, tags := splitNoteTags(notes)
+	data["notes"] = notes
+	if len(tags) > 0 {
+		data["tags"] = strings.Join(tags, ",")
+	} else {
+		delete(data, "tags")
+	}
+}
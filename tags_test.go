@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitNoteTags(t *testing.T) {
+	for _, c := range []struct {
+		notes string
+		want  string
+		tags  []string
+	}{
+		{"#priority #verified checked with the source", "checked with the source", []string{"priority", "verified"}},
+		{"#priority\nshelling reported in #Kharkiv", "shelling reported in #Kharkiv", []string{"priority"}},
+		{"  #Verified #verified #Verified", "", []string{"Verified", "verified"}},
+		{"#перевірено джерело", "джерело", []string{"перевірено"}},
+		{"#not-a-tag stays", "#not-a-tag stays", []string{}},
+		{"no tags here", "no tags here", []string{}},
+		{"#a first\n#b second", "first\nsecond", []string{"a", "b"}},
+	} {
+		notes, tags := splitNoteTags(c.notes)
+		if notes != c.want || fmt.Sprint(tags) != fmt.Sprint(c.tags) {
+			t.Errorf("splitNoteTags(%q) = %q, %q, want %q, %q", c.notes, notes, tags, c.want, c.tags)
+		}
+	}
+}
+
+func TestApplyNoteTags(t *testing.T) {
+	data := map[string]interface{}{"notes": "#priority #verified looks real", "tags": "stale"}
+	applyNoteTags(data)
+	if data["notes"] != "looks real" || data["tags"] != "priority,verified" {
+		t.Errorf("data = %v", data)
+	}
+	// Rebuilding notes without tags clears tags saved earlier.
+	data["notes"] = "looks real"
+	applyNoteTags(data)
+	if _, ok := data["tags"]; ok {
+		t.Errorf("tags = %q, want none", data["tags"])
+	}
+}
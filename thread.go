@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const (
+	// Including the first tweet.
+	maxThreadLength = 50
+	// Each page holds up to 200 tweets of the author's timeline.
+	maxThreadTimelinePages = 4
+	threadDelimiter        = "\n\n---\n\n"
+)
+
+// threadTweet is what's stored in the "thread" field for each reply, and in
+// the "unrolled" field for each tweet before an unrolled one, enough to
+// rebuild the text without keeping whole tweets in the json cell.
+type threadTweet struct {
+	ID   string `json:"id_str"`
+	Text string `json:"text"`
+}
+
+// fetchThread follows the chain of self-replies that starts at tweet and
+// returns the replies in order. Twitter has no API for replies to a tweet,
+// so they're looked up in the author's timeline since the first tweet. A
+// deleted reply ends the chain.
+func fetchThread(twClient *twitter.Client, tweet *twitter.Tweet) ([]threadTweet, error) {
+	if tweet.User == nil {
+		return nil, nil
+	}
+	byParent := map[int64]twitter.Tweet{}
+	maxID := int64(0)
+	for page := 0; page < maxThreadTimelinePages; page++ {
+		tweets, _, err := twClient.Timelines.UserTimeline(&twitter.UserTimelineParams{
+			UserID:          tweet.User.ID,
+			SinceID:         tweet.ID,
+			MaxID:           maxID,
+			Count:           200,
+			ExcludeReplies:  twitter.Bool(false),
+			IncludeRetweets: twitter.Bool(false),
+			TweetMode:       "extended",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fetching timeline of %s: %w", tweet.User.ScreenName, err)
+		}
+		if len(tweets) == 0 {
+			break
+		}
+		for _, t := range tweets {
+			if maxID == 0 || t.ID <= maxID {
+				maxID = t.ID - 1
+			}
+			if t.InReplyToStatusID == 0 || t.InReplyToUserID != tweet.User.ID {
+				continue
+			}
+			// If the author replied to the same tweet more than once, the
+			// earliest reply is the one continuing the thread.
+			if prev, ok := byParent[t.InReplyToStatusID]; ok && prev.ID < t.ID {
+				continue
+			}
+			byParent[t.InReplyToStatusID] = t
+		}
+	}
+
+	r := []threadTweet{}
+	cur := tweet.ID
+	for len(r) < maxThreadLength-1 {
+		next, ok := byParent[cur]
+		if !ok {
+			break
+		}
+		text, _ := splitTweetText(expandedText(&next))
+		r = append(r, threadTweet{ID: next.IDStr, Text: text})
+		cur = next.ID
+	}
+	return r, nil
+}
+
+// applyThread appends the text of the thread replies to the text field.
+func applyThread(data map[string]interface{}, thread []threadTweet) {
+	if len(thread) == 0 {
+		return
+	}
+	texts := []string{fmt.Sprint(data["text"])}
+	for _, t := range thread {
+		texts = append(texts, t.Text)
+	}
+	data["text"] = strings.Join(texts, threadDelimiter)
+}
+
+// fetchAncestors follows the replies up from tweet for as long as the author
+// replied to themselves, and returns the tweets before it, oldest first. A
+// deleted or protected tweet ends the chain like the start of the thread
+// does.
+func fetchAncestors(parents *parentTweets, tweet *twitter.Tweet) ([]threadTweet, error) {
+	if tweet.User == nil {
+		return nil, nil
+	}
+	r := []threadTweet{}
+	cur := tweet
+	for len(r) < maxThreadLength-1 && cur.InReplyToStatusID != 0 && cur.InReplyToUserID == tweet.User.ID {
+		parent, err := parents.get(cur.InReplyToStatusID)
+		if err != nil {
+			if status := unavailableTweetStatus(err); status != "" {
+				logInfo(logFields{"tweet_id": cur.InReplyToStatusIDStr}, "Tweet in the thread is %s, stopping there", status)
+				break
+			}
+			return nil, fmt.Errorf("fetching %s: %w", cur.InReplyToStatusIDStr, err)
+		}
+		text, _ := splitTweetText(expandedText(parent))
+		r = append(r, threadTweet{ID: parent.IDStr, Text: text})
+		cur = parent
+	}
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return r, nil
+}
+
+// applyUnrolled puts the text of the tweets before the saved one in the
+// thread ahead of the text field.
+func applyUnrolled(data map[string]interface{}, ancestors []threadTweet) {
+	if len(ancestors) == 0 {
+		return
+	}
+	texts := []string{}
+	for _, t := range ancestors {
+		texts = append(texts, t.Text)
+	}
+	texts = append(texts, fmt.Sprint(data["text"]))
+	data["text"] = strings.Join(texts, threadDelimiter)
+}
+
+// storedThreadField returns the thread tweets saved in a field of the row
+// data, if any.
+func storedThreadField(data map[string]interface{}, field string) ([]threadTweet, error) {
+	v, ok := data[field]
+	if !ok {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	r := []threadTweet{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// storedThread returns the thread replies saved in the row data, if any.
+func storedThread(data map[string]interface{}) ([]threadTweet, error) {
+	return storedThreadField(data, "thread")
+}
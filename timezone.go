@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// displayLocation is the time zone of the timestamp columns, set from
+// display_timezone at startup. The JSON column always keeps UTC.
+var displayLocation = time.UTC
+
+// Layouts of the timestamps found in row data: ours, and Twitter's.
+var timestampLayouts = []string{time.RFC3339, time.RubyDate}
+
+// loadDisplayLocation returns the named time zone, or UTC if the name is
+// empty or not a valid zone.
+func loadDisplayLocation(name string) *time.Location {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logWarning(logFields{"display_timezone": name}, "Invalid display_timezone, using UTC: %s", err)
+		return time.UTC
+	}
+	return loc
+}
+
+// isTimestampColumn reports whether the column holds a time that should be
+// shown in displayLocation. dm_created_at is left out, it's milliseconds
+// since the epoch.
+func isTimestampColumn(field string) bool {
+	return field == "submitted_at" || field == "archived_at" || field == "created_at" || strings.HasSuffix(field, ".created_at")
+}
+
+// localTimestamp converts a timestamp to loc, keeping its layout. Values
+// that aren't timestamps are returned as is.
+func localTimestamp(s string, loc *time.Location) string {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.In(loc).Format(layout)
+		}
+	}
+	return s
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	// Zones are loaded from the embedded database where the system has
+	// none.
+	_ "time/tzdata"
+)
+
+func TestLoadDisplayLocation(t *testing.T) {
+	if loc := loadDisplayLocation(" Europe/Kyiv "); loc.String() != "Europe/Kyiv" {
+		t.Errorf("loadDisplayLocation(Europe/Kyiv) = %s", loc)
+	}
+	for _, name := range []string{"", "Mars/Olympus_Mons"} {
+		if loc := loadDisplayLocation(name); loc != time.UTC {
+			t.Errorf("loadDisplayLocation(%q) = %s, want UTC", name, loc)
+		}
+	}
+}
+
+func TestTimestampsInDisplayLocation(t *testing.T) {
+	defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+	displayLocation = loadDisplayLocation("Europe/Kyiv")
+
+	data := map[string]interface{}{"submitted_at": "2022-02-24T03:00:00Z", "dm_created_at": "1645671600000"}
+	updateComputedFields(data, testTweet("100", "50", "text"))
+	row, err := tweetToRow(data, []string{"submitted_at", "tweet.created_at", "dm_created_at", "json"})
+	if err != nil {
+		t.Fatalf("tweetToRow: %s", err)
+	}
+	want := []interface{}{"2022-02-24T05:00:00+02:00", "Thu Feb 24 05:00:00 +0200 2022", "1645671600000"}
+	for i, w := range want {
+		if row[i] != w {
+			t.Errorf("column %d = %q, want %q", i, row[i], w)
+		}
+	}
+
+	// The json column keeps UTC.
+	stored := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(row[3].(string)), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["submitted_at"] != "2022-02-24T03:00:00Z" {
+		t.Errorf("json submitted_at = %q, want UTC", stored["submitted_at"])
+	}
+}
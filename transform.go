@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// applyTransform posts the row data to the configured transform hook and
+// merges the fields it returns into data. On any failure the original data
+// is returned unchanged.
+func applyTransform(ctx context.Context, cfg *Config, data map[string]interface{}) map[string]interface{} {
+	if cfg.TransformURL == "" {
+		return data
+	}
+	fields, err := callTransform(ctx, cfg.TransformURL, cfg.TransformTimeout, data)
+	if err != nil {
+		log.Printf("Transform hook failed, keeping original data: %s", err)
+		return data
+	}
+	for k, v := range fields {
+		data[k] = v
+	}
+	return data
+}
+
+func callTransform(ctx context.Context, url string, timeout time.Duration, data map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling data: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	r := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return r, nil
+}
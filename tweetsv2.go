@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+type tweetV2 struct {
+	ID            string `json:"id"`
+	Text          string `json:"text"`
+	AuthorID      string `json:"author_id"`
+	CreatedAt     string `json:"created_at"`
+	Lang          string `json:"lang"`
+	InReplyToUser string `json:"in_reply_to_user_id"`
+	PublicMetrics struct {
+		RetweetCount int `json:"retweet_count"`
+		ReplyCount   int `json:"reply_count"`
+		LikeCount    int `json:"like_count"`
+		QuoteCount   int `json:"quote_count"`
+	} `json:"public_metrics"`
+	ReferencedTweets []struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	} `json:"referenced_tweets"`
+	Attachments struct {
+		MediaKeys []string `json:"media_keys"`
+	} `json:"attachments"`
+	Entities struct {
+		URLs []struct {
+			Start       int    `json:"start"`
+			End         int    `json:"end"`
+			URL         string `json:"url"`
+			ExpandedURL string `json:"expanded_url"`
+			DisplayURL  string `json:"display_url"`
+		} `json:"urls"`
+		Hashtags []struct {
+			Start int    `json:"start"`
+			End   int    `json:"end"`
+			Tag   string `json:"tag"`
+		} `json:"hashtags"`
+		Mentions []struct {
+			Start    int    `json:"start"`
+			End      int    `json:"end"`
+			Username string `json:"username"`
+			ID       string `json:"id"`
+		} `json:"mentions"`
+	} `json:"entities"`
+}
+
+type userV2 struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+type mediaV2 struct {
+	MediaKey        string `json:"media_key"`
+	Type            string `json:"type"`
+	URL             string `json:"url"`
+	PreviewImageURL string `json:"preview_image_url"`
+	Variants        []struct {
+		BitRate     int    `json:"bit_rate"`
+		ContentType string `json:"content_type"`
+		URL         string `json:"url"`
+	} `json:"variants"`
+}
+
+type tweetV2Response struct {
+	Data     *tweetV2 `json:"data"`
+	Includes struct {
+		Users  []userV2  `json:"users"`
+		Media  []mediaV2 `json:"media"`
+		Tweets []tweetV2 `json:"tweets"`
+	} `json:"includes"`
+	Errors []struct {
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+		Type   string `json:"type"`
+	} `json:"errors"`
+}
+
+// v2 problem types of tweets that are gone or hidden, mapped to the v1.1
+// error codes that unavailableTweetStatus knows.
+var v2ProblemCodes = map[string]int{
+	"https://api.twitter.com/2/problems/resource-not-found":          144,
+	"https://api.twitter.com/2/problems/not-authorized-for-resource": 179,
+}
+
+// bearerHTTPClient returns a client that authenticates as the app, which
+// is all the v2 tweet lookup needs.
+func bearerHTTPClient(token string) *http.Client {
+	return &http.Client{Transport: &bearerTransport{token: token}}
+}
+
+type bearerTransport struct {
+	token string
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// showTweetV2 fetches a tweet from the v2 API, with its author, media and
+// quoted tweet, and maps it into the v1.1 shape that the rest of the
+// processing expects. Like statuses/show, it fails with a twitter.APIError
+// for tweets that are deleted or protected.
+func showTweetV2(httpClient *http.Client, tweetID string) (*twitter.Tweet, error) {
+	params := url.Values{}
+	params.Set("expansions", "author_id,attachments.media_keys,referenced_tweets.id,referenced_tweets.id.author_id")
+	params.Set("tweet.fields", "created_at,lang,in_reply_to_user_id,public_metrics,referenced_tweets,attachments,entities")
+	params.Set("user.fields", "name,username")
+	params.Set("media.fields", "type,url,preview_image_url,variants")
+	httpResp, err := httpClient.Get("https://api.twitter.com/2/tweets/" + url.PathEscape(tweetID) + "?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	v2 := &tweetV2Response{}
+	if err := json.NewDecoder(httpResp.Body).Decode(v2); err != nil {
+		return nil, fmt.Errorf("decoding v2 tweet (status %q): %w", httpResp.Status, err)
+	}
+	if v2.Data == nil {
+		apiErr := twitter.APIError{}
+		for _, e := range v2.Errors {
+			apiErr.Errors = append(apiErr.Errors, twitter.ErrorDetail{Message: e.Detail, Code: v2ProblemCodes[e.Type]})
+		}
+		if len(apiErr.Errors) > 0 {
+			return nil, apiErr
+		}
+		return nil, fmt.Errorf("v2 tweet: unexpected status %q", httpResp.Status)
+	}
+
+	users := map[string]userV2{}
+	for _, u := range v2.Includes.Users {
+		users[u.ID] = u
+	}
+	media := map[string]mediaV2{}
+	for _, m := range v2.Includes.Media {
+		media[m.MediaKey] = m
+	}
+	tweets := map[string]tweetV2{}
+	for _, t := range v2.Includes.Tweets {
+		tweets[t.ID] = t
+	}
+	tweet := tweetFromV2(v2.Data, users, media)
+	if tweet.QuotedStatusIDStr != "" {
+		if q, ok := tweets[tweet.QuotedStatusIDStr]; ok {
+			tweet.QuotedStatus = tweetFromV2(&q, users, media)
+		}
+	}
+	return tweet, nil
+}
+
+func tweetFromV2(t *tweetV2, users map[string]userV2, media map[string]mediaV2) *twitter.Tweet {
+	r := &twitter.Tweet{
+		IDStr:         t.ID,
+		FullText:      t.Text,
+		Lang:          t.Lang,
+		FavoriteCount: t.PublicMetrics.LikeCount,
+		RetweetCount:  t.PublicMetrics.RetweetCount,
+		ReplyCount:    t.PublicMetrics.ReplyCount,
+		QuoteCount:    t.PublicMetrics.QuoteCount,
+		Entities:      &twitter.Entities{},
+	}
+	r.ID, _ = strconv.ParseInt(t.ID, 10, 64)
+	if created, err := time.Parse(time.RFC3339, t.CreatedAt); err == nil {
+		// The layout of created_at in v1.1.
+		r.CreatedAt = created.UTC().Format(time.RubyDate)
+	}
+	if u, ok := users[t.AuthorID]; ok {
+		r.User = &twitter.User{Name: u.Name, ScreenName: u.Username, IDStr: u.ID}
+		r.User.ID, _ = strconv.ParseInt(u.ID, 10, 64)
+	}
+	for _, ref := range t.ReferencedTweets {
+		id, _ := strconv.ParseInt(ref.ID, 10, 64)
+		switch ref.Type {
+		case "replied_to":
+			r.InReplyToStatusID, r.InReplyToStatusIDStr = id, ref.ID
+			r.InReplyToUserIDStr = t.InReplyToUser
+			r.InReplyToUserID, _ = strconv.ParseInt(t.InReplyToUser, 10, 64)
+			r.InReplyToScreenName = users[t.InReplyToUser].Username
+		case "quoted":
+			r.QuotedStatusID, r.QuotedStatusIDStr = id, ref.ID
+		}
+	}
+	for _, u := range t.Entities.URLs {
+		r.Entities.Urls = append(r.Entities.Urls, twitter.URLEntity{
+			Indices:     twitter.Indices{u.Start, u.End},
+			URL:         u.URL,
+			ExpandedURL: u.ExpandedURL,
+			DisplayURL:  u.DisplayURL,
+		})
+	}
+	for _, h := range t.Entities.Hashtags {
+		r.Entities.Hashtags = append(r.Entities.Hashtags, twitter.HashtagEntity{
+			Indices: twitter.Indices{h.Start, h.End},
+			Text:    h.Tag,
+		})
+	}
+	for _, m := range t.Entities.Mentions {
+		id, _ := strconv.ParseInt(m.ID, 10, 64)
+		r.Entities.UserMentions = append(r.Entities.UserMentions, twitter.MentionEntity{
+			Indices:    twitter.Indices{m.Start, m.End},
+			ID:         id,
+			IDStr:      m.ID,
+			ScreenName: m.Username,
+		})
+	}
+	if len(t.Attachments.MediaKeys) > 0 {
+		r.ExtendedEntities = &twitter.ExtendedEntity{}
+		for _, key := range t.Attachments.MediaKeys {
+			m, ok := media[key]
+			if !ok {
+				continue
+			}
+			e := twitter.MediaEntity{Type: m.Type, MediaURLHttps: m.URL}
+			if e.MediaURLHttps == "" {
+				e.MediaURLHttps = m.PreviewImageURL
+			}
+			for _, v := range m.Variants {
+				e.VideoInfo.Variants = append(e.VideoInfo.Variants, twitter.VideoVariant{
+					ContentType: v.ContentType,
+					Bitrate:     v.BitRate,
+					URL:         v.URL,
+				})
+			}
+			r.ExtendedEntities.Media = append(r.ExtendedEntities.Media, e)
+		}
+	}
+	return r
+}
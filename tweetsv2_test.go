@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// recordedV2 answers v2 tweet lookups with recorded responses, keyed by
+// tweet ID.
+type recordedV2 map[string]string
+
+func (f recordedV2) RoundTrip(r *http.Request) (*http.Response, error) {
+	id := strings.TrimPrefix(r.URL.Path, "/2/tweets/")
+	body, ok := f[id]
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusNotFound
+		body = `{"title": "Not Found Error", "type": "about:blank"}`
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+	}, nil
+}
+
+const recordedV2Tweet = `{
+	"data": {
+		"id": "1496732423406923776",
+		"text": "@someone Air raid sirens in Kyiv https://t.co/abc https://t.co/pic",
+		"author_id": "50",
+		"created_at": "2022-02-24T03:40:15.000Z",
+		"lang": "en",
+		"public_metrics": {"retweet_count": 12, "reply_count": 3, "like_count": 40, "quote_count": 1},
+		"referenced_tweets": [{"type": "quoted", "id": "1496700000000000000"}],
+		"attachments": {"media_keys": ["3_1", "7_2"]},
+		"entities": {
+			"urls": [
+				{"start": 33, "end": 49, "url": "https://t.co/abc", "expanded_url": "https://example.com/live", "display_url": "example.com/live"},
+				{"start": 50, "end": 66, "url": "https://t.co/pic", "expanded_url": "https://twitter.com/kyivreporter/status/1496732423406923776/photo/1", "display_url": "pic.twitter.com/pic"}
+			],
+			"mentions": [{"start": 0, "end": 8, "username": "someone", "id": "60"}]
+		}
+	},
+	"includes": {
+		"users": [
+			{"id": "50", "name": "Kyiv Reporter", "username": "kyivreporter"},
+			{"id": "70", "name": "Source", "username": "source"}
+		],
+		"media": [
+			{"media_key": "3_1", "type": "photo", "url": "https://pbs.twimg.com/media/a.jpg"},
+			{"media_key": "7_2", "type": "video", "preview_image_url": "https://pbs.twimg.com/preview.jpg", "variants": [
+				{"bit_rate": 256000, "content_type": "video/mp4", "url": "https://video.twimg.com/low.mp4"},
+				{"bit_rate": 2176000, "content_type": "video/mp4", "url": "https://video.twimg.com/high.mp4"},
+				{"content_type": "application/x-mpegURL", "url": "https://video.twimg.com/pl.m3u8"}
+			]}
+		],
+		"tweets": [{"id": "1496700000000000000", "text": "Original report", "author_id": "70"}]
+	}
+}`
+
+const recordedV2Deleted = `{
+	"errors": [{
+		"value": "1",
+		"detail": "Could not find tweet with id: [1].",
+		"title": "Not Found Error",
+		"resource_type": "tweet",
+		"type": "https://api.twitter.com/2/problems/resource-not-found"
+	}]
+}`
+
+func TestShowTweetV2(t *testing.T) {
+	client := &http.Client{Transport: recordedV2{"1496732423406923776": recordedV2Tweet, "1": recordedV2Deleted}}
+	tweet, err := showTweetV2(client, "1496732423406923776")
+	if err != nil {
+		t.Fatalf("showTweetV2: %s", err)
+	}
+	data := map[string]interface{}{}
+	updateComputedFields(data, tweet)
+	for field, want := range map[string]interface{}{
+		"text":           "Air raid sirens in Kyiv https://example.com/live https://twitter.com/kyivreporter/status/1496732423406923776/photo/1",
+		"mentions":       "@someone",
+		"url":            "https://twitter.com/kyivreporter/status/1496732423406923776",
+		"author":         "kyivreporter",
+		"media":          "https://pbs.twimg.com/media/a.jpg\nhttps://video.twimg.com/high.mp4",
+		"quoted_text":    "Original report",
+		"quoted_author":  "source",
+		"favorite_count": 40,
+	} {
+		if data[field] != want {
+			t.Errorf("%s = %#v, want %#v", field, data[field], want)
+		}
+	}
+	if tweet.CreatedAt != "Thu Feb 24 03:40:15 +0000 2022" {
+		t.Errorf("created_at = %q, want the v1.1 layout", tweet.CreatedAt)
+	}
+
+	if _, err := showTweetV2(client, "1"); unavailableTweetStatus(err) != statusDeleted {
+		t.Errorf("deleted tweet: error %v, want one for a deleted tweet", err)
+	}
+	if _, err := showTweetV2(client, "2"); err == nil || unavailableTweetStatus(err) != "" {
+		t.Errorf("unexpected response: error %v, want a transient one", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// Values of the "status" field for tweets that couldn't be fetched when they
+// were submitted, for media attached to DMs, which have no tweet, and for
+// rows taken down with /redact.
+const (
+	statusDeleted      = "deleted"
+	statusProtected    = "protected"
+	statusDMAttachment = "dm_attachment"
+	statusRedacted     = "redacted"
+)
+
+// Twitter error codes returned by statuses/show for tweets that are gone or
+// hidden from us, as opposed to transient failures.
+var unavailableTweetErrorCodes = map[int]string{
+	144: statusDeleted,   // No status found with that ID.
+	179: statusProtected, // Sorry, you are not authorized to see this status.
+}
+
+// unavailableTweetStatus returns the status to record for a tweet that
+// statuses/show failed to return with err, or an empty string if the error
+// might be transient.
+func unavailableTweetStatus(err error) string {
+	apiError, ok := err.(twitter.APIError)
+	if !ok {
+		return ""
+	}
+	for _, e := range apiError.Errors {
+		if s, ok := unavailableTweetErrorCodes[e.Code]; ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// applyUnavailable fills in the fields of a row for a tweet that couldn't
+// be fetched. Only the ID is known, which is enough to find the row again
+// when more notes arrive.
+func applyUnavailable(data map[string]interface{}, tweetID string, status string) {
+	data["status"] = status
+	data["tweet"] = map[string]interface{}{"id_str": tweetID}
+	updateFingerprint(data)
+	data["url"] = fmt.Sprintf("https://twitter.com/i/status/%s", tweetID)
+}
+
+// isUnavailable reports whether the row was saved without the tweet.
+func isUnavailable(data map[string]interface{}) bool {
+	s, _ := data["status"].(string)
+	return s == statusDeleted || s == statusProtected || s == statusDMAttachment || s == statusRedacted
+}
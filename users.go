@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// senderNames looks up display names of senders. It's created for a single
+// poll, so names are fetched at most once per poll.
+type senderNames struct {
+	client *twitter.Client
+	names  map[string]string
+}
+
+func newSenderNames(client *twitter.Client) *senderNames {
+	return &senderNames{client: client, names: map[string]string{}}
+}
+
+// get returns the display name of the user, or an empty string if the
+// account can't be looked up, e.g. because it's suspended or deleted.
+func (c *senderNames) get(id string) string {
+	if name, ok := c.names[id]; ok {
+		return name
+	}
+	// Failures are cached too, so they're only logged once.
+	c.names[id] = ""
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		logWarning(logFields{"sender_id": id}, "Failed to parse sender ID: %s", err)
+		return ""
+	}
+	user, _, err := c.client.Users.Show(&twitter.UserShowParams{UserID: userID})
+	if err != nil {
+		logWarning(logFields{"sender_id": id}, "Failed to fetch sender profile: %s", err)
+		return ""
+	}
+	c.names[id] = user.Name
+	return user.Name
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+	"google.golang.org/api/sheets/v4"
+)
+
+// applyValidationRules sets a dropdown data validation rule on every column
+// that has a validation/<column> runtime config variable. The variable value
+// is a comma-separated list of allowed values. Only the configured columns
+// below the header row are touched, existing values are left as they are.
+func applyValidationRules(ctx context.Context) error {
+	rcService, err := runtimeconfig.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	vars := rcService.Projects.Configs.Variables
+	rules, err := listVariables(ctx, vars, "validation/")
+	if err != nil {
+		return fmt.Errorf("fetching validation rules: %w", err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	spreadsheetID, err := vars.Get(variableName("spreadsheet_id")).Do()
+	if err != nil {
+		return fmt.Errorf("fetching spreadsheet_id: %w", err)
+	}
+	sheetName, err := loadSheetName(vars)
+	if err != nil {
+		return fmt.Errorf("loading sheet name: %w", err)
+	}
+	sheetsService, err := sheets.NewService(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create sheets service: %w", err)
+	}
+
+	header, err := getSheetHeader(ctx, sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		return fmt.Errorf("getting spreadsheet header: %w", err)
+	}
+	sheetID, err := sheetIDByTitle(sheetsService, spreadsheetID.Text, sheetName)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{}
+	for column := range rules {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	requests := []*sheets.Request{}
+	for _, column := range columns {
+		columnNumber := -1
+		for i, h := range header {
+			if h == column {
+				columnNumber = i
+			}
+		}
+		if columnNumber < 0 {
+			log.Printf("Ignoring validation rule for column %q: no such column in the spreadsheet", column)
+			continue
+		}
+		values := []*sheets.ConditionValue{}
+		for _, v := range strings.Split(rules[column], ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			values = append(values, &sheets.ConditionValue{UserEnteredValue: v})
+		}
+		if len(values) == 0 {
+			log.Printf("Ignoring validation rule for column %q: no allowed values", column)
+			continue
+		}
+		requests = append(requests, &sheets.Request{
+			SetDataValidation: &sheets.SetDataValidationRequest{
+				Range: &sheets.GridRange{
+					SheetId:          sheetID,
+					StartRowIndex:    1,
+					StartColumnIndex: int64(columnNumber),
+					EndColumnIndex:   int64(columnNumber + 1),
+				},
+				Rule: &sheets.DataValidationRule{
+					Condition: &sheets.BooleanCondition{
+						Type:   "ONE_OF_LIST",
+						Values: values,
+					},
+					ShowCustomUi: true,
+				},
+			},
+		})
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+
+	_, err = sheetsService.Spreadsheets.BatchUpdate(spreadsheetID.Text, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: requests,
+	}).Do()
+	if err != nil {
+		return fmt.Errorf("setting validation rules: %w", err)
+	}
+	log.Printf("Applied validation rules to %d columns", len(requests))
+	return nil
+}
+
+func sheetIDByTitle(sheetsService *sheets.Service, spreadsheetID string, title string) (int64, error) {
+	spreadsheet, err := sheetsService.Spreadsheets.Get(spreadsheetID).Fields("sheets.properties").Do()
+	if err != nil {
+		return 0, fmt.Errorf("fetching spreadsheet properties: %w", err)
+	}
+	for _, s := range spreadsheet.Sheets {
+		if s.Properties != nil && s.Properties.Title == title {
+			return s.Properties.SheetId, nil
+		}
+	}
+	return 0, fmt.Errorf("sheet %q not found", title)
+}
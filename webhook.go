@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+const defaultSaveWebhookTimeout = 10 * time.Second
+
+// saveNotification is the JSON posted to SAVE_WEBHOOK_URL for each saved
+// tweet.
+type saveNotification struct {
+	TweetID        string `json:"tweet_id"`
+	URL            string `json:"url"`
+	Author         string `json:"author"`
+	SenderUsername string `json:"sender_username"`
+	Notes          string `json:"notes"`
+}
+
+// webhookStore posts a saveNotification for each appended row once it's
+// written. The posts run in the background, a failed one is only logged.
+type webhookStore struct {
+	Store
+	url     string
+	client  *http.Client
+	headers map[string][]string
+	pending map[string][]saveNotification
+}
+
+func newWebhookStore(s Store, url string, timeout time.Duration) *webhookStore {
+	return &webhookStore{
+		Store:   s,
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		headers: map[string][]string{},
+		pending: map[string][]saveNotification{},
+	}
+}
+
+func (s *webhookStore) Header(ctx context.Context, target string) ([]string, error) {
+	header, err := s.Store.Header(ctx, target)
+	if err == nil {
+		s.headers[target] = header
+	}
+	return header, err
+}
+
+func (s *webhookStore) Append(target string, first twitter.DirectMessageEvent, values []interface{}) {
+	s.Store.Append(target, first, values)
+	i := jsonColumn(s.headers[target])
+	if i < 0 || i >= len(values) {
+		return
+	}
+	j, _ := values[i].(string)
+	data := struct {
+		Tweet struct {
+			ID string `json:"id_str"`
+		} `json:"tweet"`
+		URL            string `json:"url"`
+		Author         string `json:"author"`
+		SenderUsername string `json:"sender_username"`
+		Notes          string `json:"notes"`
+	}{}
+	if err := json.Unmarshal([]byte(j), &data); err != nil {
+		logWarning(logFields{"event_id": first.ID}, "Failed to parse the row for the save webhook: %s", err)
+		return
+	}
+	s.pending[target] = append(s.pending[target], saveNotification{
+		TweetID:        data.Tweet.ID,
+		URL:            data.URL,
+		Author:         data.Author,
+		SenderUsername: data.SenderUsername,
+		Notes:          data.Notes,
+	})
+}
+
+func (s *webhookStore) Flush(ctx context.Context) (int, int, map[string]bool, error) {
+	updated, appended, failed, err := s.Store.Flush(ctx)
+	for target, notifications := range s.pending {
+		if failed[target] {
+			continue
+		}
+		for _, n := range notifications {
+			go s.post(n)
+		}
+		delete(s.pending, target)
+	}
+	return updated, appended, failed, err
+}
+
+func (s *webhookStore) post(n saveNotification) {
+	b, err := json.Marshal(n)
+	if err != nil {
+		logWarning(logFields{"tweet_id": n.TweetID}, "Failed to marshal the save notification: %s", err)
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("got %s", resp.Status)
+		}
+	}
+	if err != nil {
+		logWarning(logFields{"tweet_id": n.TweetID}, "Failed to post to the save webhook: %s", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// newWebhookServer returns a server that sends each notification posted to
+// it on the returned channel, once the returned release function is called.
+func newWebhookServer(t *testing.T) (*httptest.Server, chan saveNotification, func()) {
+	t.Helper()
+	posted := make(chan saveNotification, 10)
+	held := make(chan struct{})
+	var once sync.Once
+	release := func() { once.Do(func() { close(held) }) }
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-held
+		n := saveNotification{}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&n) != nil {
+			t.Errorf("unexpected request %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		posted <- n
+	}))
+	t.Cleanup(server.Close)
+	// Runs first, so that closing the server doesn't wait for held posts.
+	t.Cleanup(release)
+	return server, posted, release
+}
+
+func receive(t *testing.T, posted chan saveNotification) saveNotification {
+	t.Helper()
+	select {
+	case n := <-posted:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification posted")
+		return saveNotification{}
+	}
+}
+
+func TestWebhookStore(t *testing.T) {
+	server, posted, release := newWebhookServer(t)
+	tw := newFakeTwitter(testTweet("100", "50", "first"), testTweet("200", "60", "second"))
+	events := []twitter.DirectMessageEvent{
+		dmEvent("1", 1000, "7", "a note", "100"),
+		dmEvent("2", 2000, "7", "", "200"),
+	}
+	store := newMemoryStore()
+	// The server holds the posts until they are released, so the poll
+	// finishing first shows it doesn't wait for them.
+	processEvents(t, &Config{SenderWorkers: 1}, tw, newWebhookStore(store, server.URL, time.Minute), events, nil)
+	if got := store.storedTweetIDs(t, "ss"); len(got) != 2 {
+		t.Fatalf("stored tweets %v, want 2", got)
+	}
+	release()
+
+	got := map[string]saveNotification{}
+	for i := 0; i < 2; i++ {
+		n := receive(t, posted)
+		got[n.TweetID] = n
+	}
+	want := saveNotification{TweetID: "100", URL: "https://twitter.com/user50/status/100", Author: "user50", SenderUsername: "sender7", Notes: "a note"}
+	if got["100"] != want {
+		t.Errorf("notification = %+v, want %+v", got["100"], want)
+	}
+	if got["200"].Author != "user60" {
+		t.Errorf("notification = %+v, want one for 200 by user60", got["200"])
+	}
+}
+
+func TestWebhookStoreWaitsForWrite(t *testing.T) {
+	server, posted, release := newWebhookServer(t)
+	release()
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.fail["ss"] = true
+	s := newWebhookStore(store, server.URL, time.Minute)
+	processEvents(t, &Config{SenderWorkers: 1}, newFakeTwitter(testTweet("100", "50", "first")), s, []twitter.DirectMessageEvent{dmEvent("1", 1000, "7", "", "100")}, nil)
+	select {
+	case n := <-posted:
+		t.Fatalf("posted %+v for a failed write", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The next flush writes the row, and only then is it posted.
+	delete(store.fail, "ss")
+	if _, _, failed, err := s.Flush(ctx); err != nil || len(failed) > 0 {
+		t.Fatalf("Flush = %v, %v", failed, err)
+	}
+	if n := receive(t, posted); n.TweetID != "100" {
+		t.Errorf("notification = %+v, want one for 100", n)
+	}
+}
+
+func TestWebhookFailureIsLogged(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Doesn't answer until the test is over.
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	s := newWebhookStore(newMemoryStore(), server.URL, 50*time.Millisecond)
+	start := time.Now()
+	// Neither a timeout nor an unreachable server panics or blocks past
+	// the timeout.
+	s.post(saveNotification{TweetID: "100"})
+	s.url = "http://127.0.0.1:0"
+	s.post(saveNotification{TweetID: "100"})
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("posting took %s, want the timeout to cut it short", d)
+	}
+}
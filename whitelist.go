@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	runtimeconfig "google.golang.org/api/runtimeconfig/v1beta1"
+)
+
+const whitelistEntity = "Whitelist"
+
+// WhitelistEntry is a whitelisted sender, stored under its sender ID when
+// WHITELIST_SOURCE is "datastore". SpreadsheetID is optional, as in the
+// runtime config variables.
+type WhitelistEntry struct {
+	SenderID      string
+	Username      string
+	SpreadsheetID string
+}
+
+func whitelistFromDatastore() bool {
+	return os.Getenv("WHITELIST_SOURCE") == "datastore"
+}
+
+// loadWhitelist returns the whitelisted senders, mapping their IDs to
+// usernames, and the spreadsheet each sender's tweets go to. Senders without
+// a spreadsheet use defaultSpreadsheetID. The whitelist is read from runtime
+// config, or from Datastore if WHITELIST_SOURCE is "datastore".
+func loadWhitelist(ctx context.Context, ds *datastore.Client, vars *runtimeconfig.ProjectsConfigsVariablesService, defaultSpreadsheetID string) (map[string]string, map[string]string, error) {
+	switch os.Getenv("WHITELIST_SOURCE") {
+	case "", "runtimeconfig":
+		return loadWhitelistVariables(ctx, vars, defaultSpreadsheetID)
+	case "datastore":
+		return loadWhitelistEntities(ctx, ds, defaultSpreadsheetID)
+	default:
+		return nil, nil, fmt.Errorf("unknown whitelist source %q", os.Getenv("WHITELIST_SOURCE"))
+	}
+}
+
+func loadWhitelistEntities(ctx context.Context, ds *datastore.Client, defaultSpreadsheetID string) (map[string]string, map[string]string, error) {
+	entries := []WhitelistEntry{}
+	if _, err := ds.GetAll(ctx, datastore.NewQuery(whitelistEntity), &entries); err != nil {
+		return nil, nil, err
+	}
+	usernames := map[string]string{}
+	spreadsheets := map[string]string{}
+	for _, e := range entries {
+		ssID := e.SpreadsheetID
+		if ssID == "" {
+			ssID = defaultSpreadsheetID
+		}
+		usernames[e.SenderID] = e.Username
+		spreadsheets[e.SenderID] = ssID
+	}
+	return usernames, spreadsheets, nil
+}
+
+func addWhitelistEntry(ctx context.Context, ds *datastore.Client, e *WhitelistEntry) error {
+	_, err := ds.Put(ctx, datastore.NameKey(whitelistEntity, e.SenderID, nil), e)
+	return err
+}
+
+func removeWhitelistEntry(ctx context.Context, ds *datastore.Client, senderID string) error {
+	return ds.Delete(ctx, datastore.NameKey(whitelistEntity, senderID, nil))
+}
+
+// whitelistHandler adds the sender in the sender_id, username and optional
+// spreadsheet_id form fields to the Datastore whitelist, or removes the one
+// in sender_id if remove is set. Requests are authenticated like /tweet.
+func whitelistHandler(ds *datastore.Client, botUserIDs []string, remove bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, _, ok := authenticateBot(w, r, botUserIDs); !ok {
+			return
+		}
+		if !whitelistFromDatastore() {
+			http.Error(w, "the whitelist is read from runtime config, set WHITELIST_SOURCE=datastore to edit it here", http.StatusConflict)
+			return
+		}
+		senderID := strings.TrimSpace(r.FormValue("sender_id"))
+		if senderID == "" {
+			http.Error(w, "missing sender_id", http.StatusBadRequest)
+			return
+		}
+		if remove {
+			if err := removeWhitelistEntry(r.Context(), ds, senderID); err != nil {
+				http.Error(w, fmt.Sprintf("removing %s: %s", senderID, err), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "removed %s\n", senderID)
+			return
+		}
+		e := &WhitelistEntry{
+			SenderID:      senderID,
+			Username:      strings.TrimPrefix(strings.TrimSpace(r.FormValue("username")), "@"),
+			SpreadsheetID: strings.TrimSpace(r.FormValue("spreadsheet_id")),
+		}
+		if e.Username == "" {
+			http.Error(w, "missing username", http.StatusBadRequest)
+			return
+		}
+		if err := addWhitelistEntry(r.Context(), ds, e); err != nil {
+			http.Error(w, fmt.Sprintf("adding %s: %s", senderID, err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "added %s\n", senderID)
+	})
+}